@@ -0,0 +1,620 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package archive reads the members of zip and tar archives,
+// so that code search can index and search them as files.
+//
+// Code search refers to a member of an archive by a name of the form
+// file!/member, where file is the name of the archive file and member
+// the slash-separated name of the member within it, as in
+// deps.tar.gz!/src/foo.go.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mars9/kanabe/codesearch/source"
+)
+
+// Is reports whether name has the extension of an archive
+// that the package can read: .zip, .tar, .tar.gz, or .tgz.
+func Is(name string) bool {
+	return isZip(name) || isTar(name)
+}
+
+func isZip(name string) bool {
+	return hasSuffix(name, ".zip")
+}
+
+func isTar(name string) bool {
+	return hasSuffix(name, ".tar") || isTgz(name)
+}
+
+func isTgz(name string) bool {
+	return hasSuffix(name, ".tar.gz") || hasSuffix(name, ".tgz")
+}
+
+func hasSuffix(name, ext string) bool {
+	return len(name) > len(ext) && strings.EqualFold(name[len(name)-len(ext):], ext)
+}
+
+// Name returns the name of member in the archive file.
+func Name(file, member string) string {
+	return file + "!/" + member
+}
+
+// SplitName splits a name returned by Name into its parts.
+// It reports whether name is such a name.
+func SplitName(name string) (file, member string, ok bool) {
+	for i := 0; ; {
+		j := strings.Index(name[i:], "!/")
+		if j < 0 {
+			return "", "", false
+		}
+		i += j
+		if Is(name[:i]) {
+			return name[:i], name[i+2:], true
+		}
+		i++
+	}
+}
+
+// A Source is a source.Source that adds to the files in Base the
+// members of the archives among them, under names of the form returned
+// by Name.  It lists an archive as a directory holding its members.
+// The members have the modification time of the archive, so that a
+// changed archive means changed members.
+type Source struct {
+	Base source.Source // nil means source.Local
+
+	mu    sync.Mutex
+	cache []*tarCache // most recently used last
+	n     int64       // total size of the archives cached in memory
+}
+
+func (s *Source) base() source.Source {
+	if s.Base == nil {
+		return source.Local
+	}
+	return s.Base
+}
+
+// List calls fn for the files in the tree rooted at root,
+// and for the members of the archives among them.
+func (s *Source) List(root string, fn filepath.WalkFunc) error {
+	if file, member, ok := SplitName(root); ok {
+		return s.listArchive(root, file, member, fn)
+	}
+	return s.base().List(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || !Is(path) {
+			return fn(path, info, err)
+		}
+		return s.listArchive(path, path, "", fn)
+	})
+}
+
+// listArchive calls fn for the members of the archive file
+// in the tree prefix, which is named root.
+func (s *Source) listArchive(root, file, prefix string, fn filepath.WalkFunc) error {
+	fi, err := s.base().Stat(file)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	dir := &fileInfo{path.Base(root), 0, fi.ModTime(), true}
+	if prefix == "" {
+		if err := fn(root, dir, nil); err != nil {
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
+		}
+	}
+	members, err := s.list(file)
+	if err != nil {
+		if err := fn(root, dir, err); err != nil && err != filepath.SkipDir {
+			return err
+		}
+		return nil
+	}
+	for _, m := range members {
+		if prefix != "" && m.name != prefix && !strings.HasPrefix(m.name, prefix+"/") {
+			continue
+		}
+		err := fn(Name(file, m.name), &fileInfo{path.Base(m.name), m.size, fi.ModTime(), false}, nil)
+		if err == filepath.SkipDir {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open opens the named file, which can be an archive member,
+// for reading.  The reader for a member has a Stat method.
+func (s *Source) Open(name string) (io.ReadCloser, error) {
+	f, err := s.base().Open(name)
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+	file, member, ok := SplitName(name)
+	if !ok {
+		return nil, err
+	}
+	fi, err := s.base().Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.openMember(file, member, fi)
+	if err != nil {
+		if err == os.ErrNotExist {
+			err = &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		return nil, err
+	}
+	r.info.name = path.Base(member)
+	r.info.mtime = fi.ModTime()
+	return r, nil
+}
+
+// Stat returns information about the named file, which can be
+// an archive member.  It reports archives as directories.
+func (s *Source) Stat(name string) (os.FileInfo, error) {
+	fi, err := s.base().Stat(name)
+	if err == nil {
+		if fi.Mode().IsRegular() && Is(name) {
+			fi = &fileInfo{fi.Name(), 0, fi.ModTime(), true}
+		}
+		return fi, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, member, ok := SplitName(name)
+	if !ok {
+		return nil, err
+	}
+	afi, err := s.base().Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	members, err := s.list(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range members {
+		if m.name == member {
+			return &fileInfo{path.Base(member), m.size, afi.ModTime(), false}, nil
+		}
+		if strings.HasPrefix(m.name, member+"/") {
+			return &fileInfo{path.Base(member), 0, afi.ModTime(), true}, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// A member describes a regular file in an archive.
+type member struct {
+	name string // slash-separated name, cleaned
+	size int64
+}
+
+// list returns the regular files in the archive file, sorted by name.
+// If the archive holds a name more than once, list returns the first.
+func (s *Source) list(file string) ([]member, error) {
+	var list []member
+	seen := make(map[string]bool)
+	add := func(name string, size int64) {
+		if name, ok := clean(name); ok && !seen[name] {
+			seen[name] = true
+			list = append(list, member{name, size})
+		}
+	}
+	if isZip(file) {
+		z, c, err := s.openZip(file)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		for _, f := range z.File {
+			if f.Mode().IsRegular() {
+				add(f.Name, int64(f.UncompressedSize64))
+			}
+		}
+	} else {
+		t, err := s.openTar(file)
+		if err != nil {
+			return nil, err
+		}
+		defer t.Close()
+		for {
+			hdr, err := t.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				add(hdr.Name, hdr.Size)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list, nil
+}
+
+// clean returns name as a clean relative path,
+// without leading /, ./ or ../ elements.
+// It reports false for names that are empty after cleaning.
+func clean(name string) (string, bool) {
+	name = path.Clean("/" + name)[1:]
+	return name, name != ""
+}
+
+// openZip opens the zip archive file.
+func (s *Source) openZip(file string) (*zip.Reader, io.Closer, error) {
+	f, err := s.base().Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Zip files need random access, as *os.File provides.
+	type readerAt interface {
+		io.ReaderAt
+		Stat() (os.FileInfo, error)
+	}
+	var ra io.ReaderAt
+	var size int64
+	if r, ok := f.(readerAt); ok {
+		fi, err := r.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		ra, size = r, fi.Size()
+	} else {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		ra, size = bytes.NewReader(data), int64(len(data))
+	}
+	z, err := zip.NewReader(ra, size)
+	if err != nil {
+		f.Close()
+		return nil, nil, &os.PathError{Op: "open", Path: file, Err: err}
+	}
+	return z, f, nil
+}
+
+// A tarFile is an open, possibly compressed, tar archive.
+type tarFile struct {
+	*tar.Reader
+	r io.Reader // the uncompressed archive
+	f io.Closer
+}
+
+// openTar opens the tar archive file.
+func (s *Source) openTar(file string) (*tarFile, error) {
+	f, err := s.base().Open(file)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = f
+	if isTgz(file) {
+		z, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, &os.PathError{Op: "open", Path: file, Err: err}
+		}
+		r = z
+	}
+	return &tarFile{tar.NewReader(r), r, f}, nil
+}
+
+func (t *tarFile) Close() error {
+	return t.f.Close()
+}
+
+// A reader reads an archive member opened by Source.Open.
+type reader struct {
+	io.Reader
+	c    io.Closer // archive to close, or nil
+	info fileInfo
+}
+
+func (r *reader) Close() error {
+	if r.c == nil {
+		return nil
+	}
+	return r.c.Close()
+}
+
+func (r *reader) Stat() (os.FileInfo, error) {
+	return &r.info, nil
+}
+
+// openMember opens member in the archive file, whose information is fi.
+func (s *Source) openMember(file, member string, fi os.FileInfo) (*reader, error) {
+	if isZip(file) {
+		z, c, err := s.openZip(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range z.File {
+			if name, ok := clean(f.Name); ok && name == member && f.Mode().IsRegular() {
+				rc, err := f.Open()
+				if err != nil {
+					c.Close()
+					return nil, err
+				}
+				return &reader{rc, c, fileInfo{size: int64(f.UncompressedSize64)}}, nil
+			}
+		}
+		c.Close()
+		return nil, os.ErrNotExist
+	}
+
+	// Reading a tar member means reading all that precede it,
+	// so read each archive once and keep it for later opens.
+	c, err := s.cachedTar(file, fi)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := c.members[member]
+	if !ok {
+		s.release(c)
+		return nil, os.ErrNotExist
+	}
+	return &reader{io.NewSectionReader(c.data, m.off, m.size), &tarRef{s, c}, fileInfo{size: m.size}}, nil
+}
+
+// maxCache is the total size of the tar archives a Source keeps in
+// memory.  Larger archives are kept in temporary files instead.
+// It is a variable so that tests can change it.
+var maxCache int64 = 64 << 20
+
+// maxSpool is the number of archives a Source keeps in temporary files.
+const maxSpool = 4
+
+// A tarCache holds a tar archive, uncompressed, in memory or in a
+// temporary file, and the location of each of its members.
+type tarCache struct {
+	file  string
+	size  int64
+	mtime time.Time
+	ready chan struct{} // closed once the fields below are set
+
+	err     error
+	data    io.ReaderAt        // the uncompressed archive
+	members map[string]section // by cleaned name
+	n       int64              // size of data, if in memory
+	spool   *os.File           // file holding data, if not
+	refs    int                // open members, plus one while cached
+}
+
+// A section locates a member in the uncompressed archive.
+type section struct {
+	off, size int64
+}
+
+// cachedTar returns the cache of the tar archive file, whose information
+// is fi, reading the archive if it is not cached.  The caller must
+// release the cache when done with it.  Reading is done without holding
+// s.mu, and other callers that want the same archive meanwhile wait
+// for it rather than read it again.
+func (s *Source) cachedTar(file string, fi os.FileInfo) (*tarCache, error) {
+	s.mu.Lock()
+	for i, c := range s.cache {
+		if c.file == file && c.size == fi.Size() && c.mtime.Equal(fi.ModTime()) {
+			copy(s.cache[i:], s.cache[i+1:])
+			s.cache[len(s.cache)-1] = c
+			c.refs++
+			s.mu.Unlock()
+			<-c.ready
+			if c.err != nil {
+				s.release(c)
+				return nil, c.err
+			}
+			return c, nil
+		}
+	}
+	c := &tarCache{file: file, size: fi.Size(), mtime: fi.ModTime(), ready: make(chan struct{}), refs: 2}
+	s.cache = append(s.cache, c)
+	s.mu.Unlock()
+
+	c.err = s.readTar(c)
+	close(c.ready)
+
+	s.mu.Lock()
+	if c.err != nil {
+		s.drop(c)
+	}
+	s.n += c.n
+	spooled := 0
+	for _, d := range s.cache {
+		if d.spool != nil {
+			spooled++
+		}
+	}
+	for i := 0; i < len(s.cache)-1 && (s.n > maxCache || spooled > maxSpool); {
+		if d := s.cache[i]; d.n > 0 && s.n > maxCache || d.spool != nil && spooled > maxSpool {
+			if d.spool != nil {
+				spooled--
+			}
+			s.drop(d)
+			continue
+		}
+		i++
+	}
+	s.mu.Unlock()
+	if c.err != nil {
+		s.release(c)
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// drop removes c from the cache.  The caller holds s.mu.
+func (s *Source) drop(c *tarCache) {
+	for i, d := range s.cache {
+		if d == c {
+			s.cache = append(s.cache[:i], s.cache[i+1:]...)
+			s.n -= c.n
+			c.refs--
+			c.free()
+			return
+		}
+	}
+}
+
+// release releases a cache returned by cachedTar.
+func (s *Source) release(c *tarCache) {
+	s.mu.Lock()
+	c.refs--
+	c.free()
+	s.mu.Unlock()
+}
+
+// free removes the temporary file of c once nothing uses it.
+func (c *tarCache) free() {
+	if c.refs == 0 && c.spool != nil {
+		c.spool.Close()
+		os.Remove(c.spool.Name())
+	}
+}
+
+// readTar reads the tar archive c.file, uncompressed, into c.
+func (s *Source) readTar(c *tarCache) error {
+	t, err := s.openTar(c.file)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	// The tar reader reads each header and member in full,
+	// and nothing beyond, so w.n is where the next member starts.
+	w := &spooler{}
+	t.Reader = tar.NewReader(io.TeeReader(t.r, w))
+	c.members = make(map[string]section)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.close()
+			return err
+		}
+		name, ok := clean(hdr.Name)
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if _, dup := c.members[name]; !dup {
+			c.members[name] = section{w.n, hdr.Size}
+		}
+	}
+	if w.err != nil {
+		w.close()
+		return w.err
+	}
+	if w.f != nil {
+		c.data, c.spool = w.f, w.f
+	} else {
+		c.data, c.n = bytes.NewReader(w.buf.Bytes()), int64(w.buf.Len())
+	}
+	return nil
+}
+
+// A spooler holds the data written to it in memory until it grows
+// beyond maxCache and in a temporary file after that.
+type spooler struct {
+	buf bytes.Buffer
+	f   *os.File
+	n   int64 // bytes written
+	err error
+}
+
+func (w *spooler) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.f == nil && int64(w.buf.Len()+len(p)) > maxCache {
+		w.f, w.err = ioutil.TempFile("", "codesearch-archive-")
+		if w.err == nil {
+			// Where an open file can be removed, remove it now,
+			// so that it goes away when the program exits.
+			// Otherwise tarCache.free removes it.
+			os.Remove(w.f.Name())
+			_, w.err = w.f.Write(w.buf.Bytes())
+		}
+		w.buf = bytes.Buffer{}
+	}
+	if w.err == nil {
+		if w.f != nil {
+			_, w.err = w.f.Write(p)
+		} else {
+			w.buf.Write(p)
+		}
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// close discards what was written.
+func (w *spooler) close() {
+	if w.f != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+	}
+}
+
+// A tarRef closes a member read from a cached archive
+// by releasing the cache.
+type tarRef struct {
+	s *Source
+	c *tarCache
+}
+
+func (r *tarRef) Close() error {
+	r.s.release(r.c)
+	return nil
+}
+
+// A fileInfo implements os.FileInfo for an archive or a member.
+type fileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	isDir bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.isDir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
@@ -0,0 +1,336 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mars9/kanabe/codesearch/source"
+)
+
+var archiveFiles = []struct {
+	name string
+	data string
+}{
+	{"./src/foo.go", "package foo\n"},
+	{"README", "read me\n"},
+	{"src/foo.go", "duplicate\n"},
+	{"/abs/x.c", "int x;\n"},
+	{"../escape", "outside\n"},
+}
+
+var wantList = []member{
+	{"README", 8},
+	{"abs/x.c", 7},
+	{"escape", 8},
+	{"src/foo.go", 12},
+}
+
+func writeZip(t *testing.T, file string) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	if _, err := w.Create("src/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range archiveFiles {
+		fw, err := w.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(f.data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTar(t *testing.T, file string, compress bool) {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	w.WriteHeader(&tar.Header{Name: "src/", Typeflag: tar.TypeDir, Mode: 0755})
+	w.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "README"})
+	for _, f := range archiveFiles {
+		hdr := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.data))}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if compress {
+		var zbuf bytes.Buffer
+		z := gzip.NewWriter(&zbuf)
+		z.Write(data)
+		z.Close()
+		data = zbuf.Bytes()
+	}
+	if err := ioutil.WriteFile(file, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var src Source
+	mtime := time.Unix(1300000000, 0)
+	for _, name := range []string{"a.zip", "a.tar", "a.tar.gz", "a.TGZ"} {
+		file := filepath.Join(dir, name)
+		switch name {
+		case "a.zip":
+			writeZip(t, file)
+		case "a.tar":
+			writeTar(t, file, false)
+		default:
+			writeTar(t, file, true)
+		}
+		os.Chtimes(file, mtime, mtime)
+		if !Is(file) {
+			t.Errorf("Is(%s) = false", name)
+		}
+
+		list, err := src.list(file)
+		if err != nil {
+			t.Errorf("list(%s): %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(list, wantList) {
+			t.Errorf("list(%s) = %v, want %v", name, list, wantList)
+		}
+
+		for _, m := range []struct{ name, data string }{
+			{"src/foo.go", "package foo\n"},
+			{"abs/x.c", "int x;\n"},
+			{"escape", "outside\n"},
+		} {
+			f, err := src.Open(Name(file, m.name))
+			if err != nil {
+				t.Errorf("Open(%s, %s): %v", name, m.name, err)
+				continue
+			}
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil || string(data) != m.data {
+				t.Errorf("Open(%s, %s) read %q, %v, want %q", name, m.name, data, err, m.data)
+			}
+			fi, _ := f.(*reader).Stat()
+			if fi.Size() != int64(len(m.data)) || !fi.ModTime().Equal(mtime) || fi.Name() != filepath.Base(m.name) {
+				t.Errorf("Stat(%s, %s) = %s, %d, %v", name, m.name, fi.Name(), fi.Size(), fi.ModTime())
+			}
+		}
+		for _, m := range []string{"missing", "src", "link", "../escape"} {
+			if _, err := src.Open(Name(file, m)); !os.IsNotExist(err) {
+				t.Errorf("Open(%s, %s): %v, want not exist", name, m, err)
+			}
+		}
+		if fi, err := src.Stat(Name(file, "src")); err != nil || !fi.IsDir() {
+			t.Errorf("Stat(%s, src) = %v, %v, want directory", name, fi, err)
+		}
+	}
+
+	// List shows archives as directories.
+	var got []string
+	src.List(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			t.Errorf("List: %s: %v", path, err)
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if fi.IsDir() {
+			got = append(got, filepath.ToSlash(rel)+" dir")
+		} else {
+			got = append(got, fmt.Sprintf("%s %d", filepath.ToSlash(rel), fi.Size()))
+		}
+		if strings.HasSuffix(path, ".tar.gz") {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	want := []string{
+		". dir",
+		"a.TGZ dir",
+		"a.TGZ!/README 8",
+		"a.TGZ!/abs/x.c 7",
+		"a.TGZ!/escape 8",
+		"a.TGZ!/src/foo.go 12",
+		"a.tar dir",
+		"a.tar!/README 8",
+		"a.tar!/abs/x.c 7",
+		"a.tar!/escape 8",
+		"a.tar!/src/foo.go 12",
+		"a.tar.gz dir",
+		"a.zip dir",
+		"a.zip!/README 8",
+		"a.zip!/abs/x.c 7",
+		"a.zip!/escape 8",
+		"a.zip!/src/foo.go 12",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestArchiveSource(t *testing.T) {
+	// Archives can come from any source, here one in memory.
+	dir, err := ioutil.TempDir("", "archive-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeZip(t, filepath.Join(dir, "a.zip"))
+	writeTar(t, filepath.Join(dir, "a.tgz"), true)
+	zipData, _ := ioutil.ReadFile(filepath.Join(dir, "a.zip"))
+	tgzData, _ := ioutil.ReadFile(filepath.Join(dir, "a.tgz"))
+
+	src := &Source{Base: source.Map{
+		"m/a.zip": string(zipData),
+		"m/a.tgz": string(tgzData),
+		"m/x.go":  "package x\n",
+	}}
+	var got []string
+	src.List("m", func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			got = append(got, path)
+		}
+		return err
+	})
+	want := []string{
+		"m/a.tgz!/README", "m/a.tgz!/abs/x.c", "m/a.tgz!/escape", "m/a.tgz!/src/foo.go",
+		"m/a.zip!/README", "m/a.zip!/abs/x.c", "m/a.zip!/escape", "m/a.zip!/src/foo.go",
+		"m/x.go",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+	for _, name := range []string{"m/a.zip!/abs/x.c", "m/a.tgz!/abs/x.c"} {
+		f, err := src.Open(name)
+		if err != nil {
+			t.Errorf("Open(%s): %v", name, err)
+			continue
+		}
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(data) != "int x;\n" {
+			t.Errorf("Open(%s) read %q", name, data)
+		}
+	}
+}
+
+// A countSource counts the times it opens each file.
+type countSource struct {
+	source.Source
+	mu sync.Mutex
+	n  map[string]int
+}
+
+func (s *countSource) Open(name string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.n[name]++
+	s.mu.Unlock()
+	return s.Source.Open(name)
+}
+
+func TestTarCache(t *testing.T) {
+	// Many members, more than fit in memory.
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	var names []string
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("f%03d", i)
+		data := strings.Repeat(name+"\n", 100)
+		w.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))})
+		w.Write([]byte(data))
+		names = append(names, name)
+	}
+	w.Close()
+	var zbuf bytes.Buffer
+	z := gzip.NewWriter(&zbuf)
+	z.Write(buf.Bytes())
+	z.Close()
+
+	for _, limit := range []int64{64 << 20, 4096} {
+		defer func(n int64) { maxCache = n }(maxCache)
+		maxCache = limit
+		base := &countSource{Source: source.Map{"a.tgz": zbuf.String()}, n: make(map[string]int)}
+		src := &Source{Base: base}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := i; j < len(names); j += 4 {
+					name := names[j]
+					f, err := src.Open(Name("a.tgz", name))
+					if err != nil {
+						t.Errorf("Open(%s): %v", name, err)
+						continue
+					}
+					data, err := ioutil.ReadAll(f)
+					f.Close()
+					if want := strings.Repeat(name+"\n", 100); err != nil || string(data) != want {
+						t.Errorf("Open(%s) read %d bytes, %v, want %d", name, len(data), err, len(want))
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		if n := base.n["a.tgz"]; n != 1 {
+			t.Errorf("with cache limit %d, opened archive %d times for %d members, want once", limit, n, len(names))
+		}
+		src.mu.Lock()
+		for _, c := range src.cache {
+			if spooled := c.spool != nil; spooled != (limit < int64(buf.Len())) || c.refs != 1 {
+				t.Errorf("with cache limit %d, spooled = %v, refs = %d", limit, spooled, c.refs)
+			}
+		}
+		src.mu.Unlock()
+	}
+}
+
+var splitTests = []struct {
+	name   string
+	file   string
+	member string
+	ok     bool
+}{
+	{"/d/deps.tar.gz!/src/foo.go", "/d/deps.tar.gz", "src/foo.go", true},
+	{"/d/x!/y.zip!/a/b", "/d/x!/y.zip", "a/b", true},
+	{"/d/x.zip!/a.tar!/b", "/d/x.zip", "a.tar!/b", true},
+	{"/d/wow!/x.go", "", "", false},
+	{"/d/a.zip", "", "", false},
+	{".zip!/x", "", "", false},
+}
+
+func TestSplitName(t *testing.T) {
+	for _, tt := range splitTests {
+		file, member, ok := SplitName(tt.name)
+		if file != tt.file || member != tt.member || ok != tt.ok {
+			t.Errorf("SplitName(%q) = %q, %q, %v, want %q, %q, %v", tt.name, file, member, ok, tt.file, tt.member, tt.ok)
+		}
+	}
+}
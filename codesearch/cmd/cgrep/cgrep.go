@@ -14,14 +14,43 @@ import (
 	"github.com/mars9/kanabe/codesearch/regexp"
 )
 
-var usageMessage = `Usage: cgrep [-c] [-h] [-i] [-l] [-n] regexp [file...]
+var usageMessage = `Usage: cgrep [-A n] [-B n] [-C n] [-F] [-c] [-color when] [-h] [-i] [-json] [-l] [-n] [-p n]
+	[-rank n] [-w] regexp [file...]
+       cgrep [flags] [-e pattern]... [-patterns file] [file...]
 
 Cgrep behaves like grep, searching for regexp, an RE2 (nearly PCRE)
 regular expression.
 
-The -c, -h, -i, -l, and -n flags are as in grep, although note that as
-per Go's flag parsing convention, they cannot be combined: the option
-pair -i -n cannot be abbreviated to -in.
+The -A, -B, -C, -c, -h, -i, -l, and -n flags are as in grep, although
+note that as per Go's flag parsing convention, they cannot be combined:
+the option pair -i -n cannot be abbreviated to -in.
+
+The -F, -w, and -e flags are as in grep: -F searches for fixed strings
+rather than regular expressions, -w matches only whole words, and each
+-e gives a pattern to search for in place of the regexp argument; a line
+matches if any of them does. The -patterns flag, grep's -f, reads the
+patterns from a file, one per line, ignoring blank lines. Searches for
+fixed strings, and for regexps that amount to a few fixed strings, run
+faster than others.
+
+The -p flag sets the number of files searched in parallel; it defaults
+to the number of CPUs. The output is the same regardless.
+
+The -color flag highlights matches, file names, and line numbers.
+When may be always, never, or auto, the default, which highlights
+only when standard output is a terminal. As in grep, the colors can
+be changed with the GREP_COLORS environment variable.
+
+The -json flag prints one JSON object per line instead of plain text:
+a "match" object for each matching line, holding the file name, line
+number, byte offsets of the match within the line, and the line text,
+followed by a "summary" object counting the files searched and the
+matching lines. With -l and -c, "file" and "count" objects take the
+place of match objects. Context lines are not printed in JSON mode.
+
+The -rank flag prints the results for the n most relevant matching files
+first, as described in csearch -help, followed by the rest in the usual
+order.
 `
 
 func usage() {
@@ -36,13 +65,15 @@ var (
 
 func main() {
 	var g regexp.Grep
+	var p regexp.Patterns
 	g.AddFlags()
+	p.AddFlags()
 	g.Stdout = os.Stdout
 	g.Stderr = os.Stderr
 	flag.Usage = usage
 	flag.Parse()
 	args := flag.Args()
-	if len(args) == 0 {
+	if len(args) == 0 && !p.Listed() {
 		flag.Usage()
 	}
 
@@ -56,7 +87,11 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	pat := "(?m)" + args[0]
+	expr, args, err := p.Expr(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pat := "(?m)" + expr
 	if *iflag {
 		pat = "(?i)" + pat
 	}
@@ -65,13 +100,12 @@ func main() {
 		log.Fatal(err)
 	}
 	g.Regexp = re
-	if len(args) == 1 {
+	if len(args) == 0 {
 		g.Reader(os.Stdin, "<standard input>")
 	} else {
-		for _, arg := range args[1:] {
-			g.File(arg)
-		}
+		g.Files(args)
 	}
+	g.Done()
 	if !g.Match {
 		os.Exit(1)
 	}
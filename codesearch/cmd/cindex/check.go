@@ -0,0 +1,140 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/mars9/kanabe/codesearch/index"
+)
+
+// topN is the number of trigrams that check lists in each ranking.
+const topN = 10
+
+// check checks the shards of the index in master and prints
+// statistics about them.  It exits with status 1 if any is damaged.
+func check(master string) {
+	files, err := index.Shards(master)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bad := false
+	for _, file := range files {
+		if err := index.Check(file); err != nil {
+			log.Print(err)
+			bad = true
+		}
+	}
+	if bad {
+		os.Exit(1)
+	}
+
+	var (
+		numFiles, numDeleted  int
+		textBytes, indexBytes int64
+		postings              int64
+		lists                 = make(map[string]*index.ListInfo)
+		perPath               = make(map[string]int)
+		perLang               = make(map[string]int)
+	)
+	_, ixs := openIndex(master)
+	defer closeIndex(ixs)
+	for i, ix := range ixs {
+		fmt.Printf("%s: ok, version %d, %d files\n", files[i], ix.Version(), ix.NumFiles())
+		numFiles += ix.NumFiles()
+		numDeleted += ix.NumDeleted()
+		indexBytes += fileSize(files[i])
+		for id := 0; id < ix.NumFiles(); id++ {
+			if ix.Deleted(uint32(id)) {
+				continue
+			}
+			if size, _, ok := ix.Stat(uint32(id)); ok {
+				textBytes += size
+			}
+			perLang[ix.Lang(uint32(id))]++
+		}
+		for _, p := range ix.Paths() {
+			perPath[p] += len(ix.FilesUnder(p))
+		}
+		for _, l := range ix.Lists() {
+			if *verboseFlag {
+				fmt.Printf("\t%q: %d files, %d bytes\n", l.Trigram, l.Count, l.Size)
+			}
+			postings += int64(l.Count)
+			if t := lists[l.Trigram]; t != nil {
+				t.Count += l.Count
+				t.Size += l.Size
+			} else {
+				l := l
+				lists[l.Trigram] = &l
+			}
+		}
+	}
+
+	fmt.Printf("files: %d (%d deleted), %d bytes\n", numFiles, numDeleted, textBytes)
+	if len(files) > 1 {
+		fmt.Printf("index: %d bytes in %d shards\n", indexBytes, len(files))
+	} else {
+		fmt.Printf("index: %d bytes\n", indexBytes)
+	}
+	fmt.Printf("trigrams: %d, %d postings\n", len(lists), postings)
+
+	var all []*index.ListInfo
+	for _, l := range lists {
+		all = append(all, l)
+	}
+	top := func(title string, less func(a, b *index.ListInfo) bool) {
+		sort.Slice(all, func(i, j int) bool {
+			if less(all[i], all[j]) {
+				return true
+			}
+			if less(all[j], all[i]) {
+				return false
+			}
+			return all[i].Trigram < all[j].Trigram
+		})
+		fmt.Printf("%s:\n", title)
+		for i, l := range all {
+			if i == topN {
+				break
+			}
+			fmt.Printf("\t%q\t%d files\t%d bytes\n", l.Trigram, l.Count, l.Size)
+		}
+	}
+	top("most common trigrams", func(a, b *index.ListInfo) bool { return a.Count > b.Count })
+	top("largest posting lists", func(a, b *index.ListInfo) bool { return a.Size > b.Size })
+
+	var langs []string
+	for l := range perLang {
+		langs = append(langs, l)
+	}
+	sort.Slice(langs, func(i, j int) bool {
+		if perLang[langs[i]] != perLang[langs[j]] {
+			return perLang[langs[i]] > perLang[langs[j]]
+		}
+		return langs[i] < langs[j]
+	})
+	fmt.Printf("languages:\n")
+	for _, l := range langs {
+		name := l
+		if name == "" {
+			name = "unknown"
+		}
+		fmt.Printf("\t%s\t%d files\n", name, perLang[l])
+	}
+
+	var paths []string
+	for p := range perPath {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	fmt.Printf("paths:\n")
+	for _, p := range paths {
+		fmt.Printf("\t%s\t%d files\n", p, perPath[p])
+	}
+}
@@ -12,14 +12,22 @@ import (
 	"path/filepath"
 	"runtime/pprof"
 	"sort"
+	"strings"
+	"time"
 
+	"github.com/mars9/kanabe/codesearch/archive"
+	"github.com/mars9/kanabe/codesearch/git"
 	"github.com/mars9/kanabe/codesearch/index"
+	"github.com/mars9/kanabe/codesearch/source"
 )
 
-var usageMessage = `Usage: cindex [-list] [-reset] [path...]
+var usageMessage = `Usage: cindex [-check] [-exclude glob] [-git dir [-rev rev]] [-include glob] [-list]
+	[-maxfilelen n] [-maxlinelen n] [-maxtrigrams n] [-p n] [-reset] [-rm] [-shardsize n] [-skipped]
+	[-upgrade] [-watch] [path...]
 
 Cindex prepares the trigram index for use by csearch. The index is the
-file named by $CSEARCHINDEX, or else $HOME/.csearchindex.
+file named by $CSEARCHINDEX, or else $HOME/.csearchindex. If
+$CSEARCHINDEX lists several files for csearch, cindex uses the first.
 
 The simplest invocation is
 
@@ -39,14 +47,113 @@ If cindex is invoked with no paths, it reindexes the paths that have
 already been added, in case the files have changed. Thus, 'cindex' by
 itself is a useful command to run in a nightly cron job.
 
+Reindexing is incremental: cindex records the size and modification
+time of every file it indexes and only rereads the files that have
+been added or changed since, dropping the ones that have been deleted.
+
 The -list flag causes cindex to list the paths it has indexed and
 exit.
 
+The -check flag causes cindex to check the index for damage and exit.
+It reads the whole index, verifying its checksum and the structure of
+its file list and posting lists, and reports the first damage it finds
+in each shard. If the index is sound, cindex prints statistics: the
+number of files and their total size, the size of the index, the
+trigrams listed for the most files and those with the largest posting
+lists, the number of files in each language, and the number of files
+under each indexed path. With -verbose, it also prints every posting
+list's trigram, file count, and size.
+
 By default cindex adds the named paths to the index but preserves
 information about other paths that might already be indexed (the ones
 printed by cindex -list). The -reset flag causes cindex to delete the
 existing index before indexing the new paths. With no path arguments,
 cindex -reset removes the index.
+
+The -rm flag causes cindex to remove the named files and directory
+trees from the index instead of adding them. Removing is quick: the
+files are only marked as deleted, and the space they occupy in the
+index is reclaimed the next time cindex updates it. A removed path
+that is still on disk under an indexed path is added back by the next
+cindex run; remove the indexed path itself to stop that.
+
+The -watch flag causes cindex to keep running after it has updated the
+index, watching the indexed paths for changes and folding them into the
+index as they happen, so that the index never falls far behind. Changes
+are collected until none have arrived for the duration given by
+-watchdelay, so that a burst of saves causes a single update.
+Watching is only supported on Linux.
+
+Only one cindex at a time writes the index: cindex locks the file named
+like the index with the suffix .lock, and a second cindex waits for the
+first to finish. A watching cindex holds the lock only while it updates
+the index. Cindex never changes an index file in place; it writes new
+files and renames them into place, so csearch can search while cindex
+runs and sees either the old index or the new one.
+
+Cindex skips files and directories whose names begin with a period,
+#, or ~, or end in ~. It also honors the .gitignore, .hgignore, and
+.csearchignore files it finds in the indexed trees and in their
+parent directories up to the root of the repository. The
+.csearchignore files use the .gitignore syntax.
+
+The -exclude flag skips the files and directories matching the given
+glob, and the -include flag restricts the index to the files matching
+the given glob. Both use the .gitignore syntax, but the globs are not
+anchored: 'gen/*.go' matches a.go in any directory named gen. Both
+flags can be repeated. The index records the flags, so that later
+runs without -include or -exclude flags select files the same way;
+pass -exclude= to drop the recorded globs. Changing the globs
+rechecks all the indexed paths.
+
+Cindex indexes only files that look like text: valid UTF-8 no longer
+than -maxfilelen bytes (default 1 GB), without lines longer than
+-maxlinelen bytes (default 2000), and with at most -maxtrigrams
+distinct trigrams (default 20000). Raising the limits admits files
+such as minified JavaScript or generated code. Like the globs, the
+limits are recorded in the index and reused by later runs; changing
+them rebuilds the index. The -skipped flag causes cindex to print the
+name of each file it leaves out for failing these tests, and why.
+
+Along with the trigrams, cindex records the language of each file,
+judged by its name or else its #! line, for csearch -lang, and the
+declarations in Go files, for csearch -sym.
+
+The -p flag sets the number of files cindex reads and tokenizes in
+parallel. It defaults to the number of CPUs, but at most 8, because
+each one takes 64 MB of memory for its trigram set: -p 64 needs 4 GB
+before cindex reads a single file.
+
+Cindex indexes the files inside zip and tar archives, with names like
+deps.tar.gz!/src/foo.go, rather than the archives themselves; csearch
+reads them back out of the archives. Archives are recognized by the
+extensions .zip, .tar, .tar.gz, and .tgz. The -include and -exclude
+globs apply to the members as if the archive were a directory holding
+them, and an archive is reread only when it changes.
+
+Cindex splits a large index into shards, ordinary index files named
+like the index with a numeric suffix, and turns the index file into a
+short manifest listing them. The
+-shardsize flag sets the size of a shard (default 1 GB): cindex starts
+a new shard whenever the files it is indexing add up to that many bytes,
+and it folds an update into an existing shard only if the result stays
+under that size. Csearch searches the shards in parallel; the results
+are the same as from a single index file.
+
+The -upgrade flag causes cindex to rewrite an index written by an older
+version of cindex in the current format and exit. Csearch reads the
+older formats too, but only the current one, which uses 64-bit offsets,
+carries a checksum for detecting damage.
+
+The -git flag causes cindex to index the files in a commit of the git
+repository in dir, reading them from the repository's objects instead
+of from the work tree. The -rev flag names the commit as a branch,
+tag, or commit hash; it defaults to HEAD. The files are indexed under
+names of the form dir@rev:path, which csearch also reads from the
+repository, and dir@rev: is listed among the indexed paths, so that a
+later cindex run indexes whatever commit rev names by then. Files in a
+commit are selected by the -include and -exclude globs but not by
+ignore files. Commits are not watched.
 `
 
 func usage() {
@@ -56,24 +163,73 @@ func usage() {
 
 var (
 	listFlag    = flag.Bool("list", false, "list indexed paths and exit")
+	checkFlag   = flag.Bool("check", false, "check the index for damage, print statistics, and exit")
 	resetFlag   = flag.Bool("reset", false, "discard existing index")
+	upgradeFlag = flag.Bool("upgrade", false, "rewrite an old index in the current format and exit")
+	rmFlag      = flag.Bool("rm", false, "remove the named paths from the index")
+	watchFlag   = flag.Bool("watch", false, "keep watching the indexed paths for changes")
+	watchDelay  = flag.Duration("watchdelay", 2*time.Second, "with -watch, wait for changes to settle this long before updating")
 	verboseFlag = flag.Bool("verbose", false, "print extra information")
+	workersFlag = flag.Int("p", index.DefaultWorkers(), "number of files to read in parallel, each using 64 MB")
 	cpuProfile  = flag.String("cpuprofile", "", "write cpu profile to this file")
+	shardSize   = flag.Int64("shardsize", 1<<30, "split the index into shards of about `n` bytes")
+
+	maxFileLen  = flag.Int64("maxfilelen", index.DefaultLimits.MaxFileLen, "skip files longer than `n` bytes")
+	maxLineLen  = flag.Int("maxlinelen", index.DefaultLimits.MaxLineLen, "skip files with lines longer than `n` bytes")
+	maxTrigrams = flag.Int("maxtrigrams", index.DefaultLimits.MaxTextTrigrams, "skip files with more than `n` distinct trigrams")
+	skippedFlag = flag.Bool("skipped", false, "print the files skipped as not text, and why")
+
+	gitFlag = flag.String("git", "", "index a commit of the git repository in `dir`")
+	revFlag = flag.String("rev", "HEAD", "with -git, the `revision` to index")
+
+	includeFlag globList
+	excludeFlag globList
+
+	// src holds the files to index: local files,
+	// files in git commits, and archive members.
+	src = &archive.Source{Base: source.Stack(source.Local, new(git.Source))}
+
+	// rules are the file selection rules in effect,
+	// from the flags or else from the index.
+	rules []string
+
+	// limits are the text detection limits in effect,
+	// from the flags or else from the index.
+	limits index.Limits
 )
 
+func init() {
+	flag.Var(&includeFlag, "include", "index only the files matching `glob`")
+	flag.Var(&excludeFlag, "exclude", "do not index the files matching `glob`")
+}
+
 func main() {
 	flag.Usage = usage
 	flag.Parse()
 	args := flag.Args()
 
 	if *listFlag {
-		ix := index.Open(index.File())
-		for _, arg := range ix.Paths() {
+		_, ixs := openIndex(index.File())
+		for _, arg := range indexPaths(ixs) {
 			fmt.Printf("%s\n", arg)
 		}
 		return
 	}
 
+	if *checkFlag {
+		check(index.File())
+		return
+	}
+
+	// Only one cindex at a time may write the index.
+	lock := lockIndex(index.File())
+	defer lock.Unlock()
+
+	if *upgradeFlag {
+		upgrade(index.File())
+		return
+	}
+
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
 		if err != nil {
@@ -84,15 +240,31 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	if *gitFlag != "" {
+		dir, err := filepath.Abs(*gitFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !git.IsRepo(dir) {
+			log.Fatalf("%s: not a git repository", *gitFlag)
+		}
+		if *revFlag == "" || strings.ContainsAny(*revFlag, ":@") {
+			log.Fatalf("invalid revision %q", *revFlag)
+		}
+		args = append(args, git.Name(dir, *revFlag, ""))
+	}
+
+	if *rmFlag && len(args) == 0 {
+		usage()
+	}
 	if *resetFlag && len(args) == 0 {
-		os.Remove(index.File())
+		removeIndex(index.File())
 		return
 	}
 	if len(args) == 0 {
-		ix := index.Open(index.File())
-		for _, arg := range ix.Paths() {
-			args = append(args, arg)
-		}
+		_, ixs := openIndex(index.File())
+		args = indexPaths(ixs)
+		closeIndex(ixs)
 	}
 
 	// Translate paths to absolute paths so that we can
@@ -113,49 +285,271 @@ func main() {
 	}
 
 	master := index.File()
+	rules = filterRules(includeFlag.globs, excludeFlag.globs)
+	limits = index.DefaultLimits
+	setLimits(&limits)
+	if _, err := os.Stat(master); err == nil && !*rmFlag {
+		_, ixs := openIndex(master)
+		if !includeFlag.set && !excludeFlag.set {
+			rules = indexFilters(ixs)
+		}
+		limits = indexLimits(ixs)
+		setLimits(&limits)
+		if !*resetFlag && (!sameRules(rules, indexFilters(ixs)) || limits != indexLimits(ixs)) {
+			// New rules or limits apply to all the indexed paths.
+			all := make(map[string]bool)
+			for _, p := range append(indexPaths(ixs), args...) {
+				all[p] = true
+			}
+			args = collapse(all)
+			if limits != indexLimits(ixs) {
+				// Files indexed under the old limits must be read again.
+				log.Printf("limits changed, rebuilding index")
+				*resetFlag = true
+			}
+		}
+		closeIndex(ixs)
+	}
+
+	if *rmFlag {
+		shards, err := index.Shards(master)
+		if err != nil {
+			log.Fatal(err)
+		}
+		n := 0
+		for _, shard := range shards {
+			n += index.Delete(shard+"~", shard, args)
+			os.Rename(shard+"~", shard)
+		}
+		log.Printf("removed %d files", n)
+		return
+	}
+
 	if _, err := os.Stat(master); err != nil {
 		// Does not exist.
 		*resetFlag = true
 	}
-	file := master
-	if !*resetFlag {
-		file += "~"
+	update(master, args, args, *resetFlag)
+	if *watchFlag {
+		var roots []string
+		for _, arg := range args {
+			if !isGit(arg) {
+				roots = append(roots, arg)
+			}
+		}
+		// While watching, hold the lock only during updates.
+		lock.Unlock()
+		watch(master, roots)
+	}
+	log.Printf("done")
+}
+
+// setLimits sets the fields of l for which flags were given.
+func setLimits(l *index.Limits) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "maxfilelen":
+			l.MaxFileLen = *maxFileLen
+		case "maxlinelen":
+			l.MaxLineLen = *maxLineLen
+		case "maxtrigrams":
+			l.MaxTextTrigrams = *maxTrigrams
+		}
+	})
+}
+
+// skip reports whether the file or directory with the given
+// base name is a temporary or "hidden" one that is not indexed.
+func skip(elem string) bool {
+	return elem[0] == '.' || elem[0] == '#' || elem[0] == '~' || elem[len(elem)-1] == '~'
+}
+
+// update brings the index in master up to date with the file trees
+// rooted at args, which lie within the indexed paths roots.  If reset
+// is set, it discards the existing index; otherwise it only reads the
+// files that have been added or changed since they were last indexed.
+func update(master string, roots, args []string, reset bool) {
+	// The index can be split into shards: kept[i] records
+	// the files of old[i], from the file oldFiles[i], to keep.
+	var oldFiles, stale []string
+	var old []*index.Index
+	var kept [][]bool
+	if !reset {
+		oldFiles, old = openIndex(master)
+		for _, ix := range old {
+			kept = append(kept, make([]bool, ix.NumFiles()))
+		}
+	} else if _, err := os.Stat(master); err == nil {
+		stale, _ = index.Shards(master)
+	}
+	lookup := func(path string, info os.FileInfo) bool {
+		for i, ix := range old {
+			if id, ok := ix.Lookup(path); ok && ix.Unchanged(id, info) {
+				kept[i][id] = true
+				return true
+			}
+		}
+		return false
 	}
 
-	ix := index.Create(file)
-	ix.Verbose = *verboseFlag
-	ix.AddPaths(args)
+	// Collect the files to index, skipping the ones
+	// that are unchanged since they were last indexed.
+	var files []string
+	size := make(map[string]int64)
+	f := newFilter(rules)
+	// Archives are kept whole if unchanged, which is right
+	// only if the selection rules are unchanged too.
+	whole := old
+	if old != nil && !sameRules(indexFilters(old), rules) {
+		whole = nil
+	}
+	// Files in git commits and archives have no ignore files;
+	// inside selects them as if they were in directories.
+	inside := newFilter(rules)
+	inside.noIgnore = true
 	for _, arg := range args {
 		log.Printf("index %s", arg)
-		filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
-			if _, elem := filepath.Split(path); elem != "" {
-				// Skip various temporary or "hidden" files or directories.
-				if elem[0] == '.' || elem[0] == '#' || elem[0] == '~' || elem[len(elem)-1] == '~' {
-					if info.IsDir() {
-						return filepath.SkipDir
-					}
-					return nil
+		gitDir, _, _, inGit := git.SplitName(arg)
+		gitRoot := ""
+		if inGit {
+			gitRoot = arg[:strings.LastIndex(arg, ":")+1]
+		}
+		skip := func(path string, isDir bool) bool {
+			if file, member, ok := archive.SplitName(path); ok {
+				return inside.skipInside(file, member, isDir)
+			}
+			if inGit {
+				rel := strings.TrimPrefix(path, gitRoot)
+				return rel != "" && inside.skipInside(gitDir, rel, isDir)
+			}
+			return f.skip(path, isDir)
+		}
+		src.List(arg, func(path string, info os.FileInfo, err error) error {
+			if skip(path, info != nil && info.IsDir()) {
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
 				}
+				return nil
 			}
 			if err != nil {
-				log.Printf("%s: %s", path, err)
+				// Vanishing files are routine while watching.
+				if !*watchFlag || !os.IsNotExist(err) {
+					log.Printf("%s: %s", path, err)
+				}
 				return nil
 			}
-			if info != nil && info.Mode()&os.ModeType == 0 {
-				ix.AddFile(path)
+			if info.IsDir() && whole != nil && archive.Is(path) && keepArchive(whole, path, info, kept) {
+				return filepath.SkipDir
+			}
+			if info.Mode()&os.ModeType == 0 {
+				if lookup(path, info) {
+					return nil
+				}
+				files = append(files, path)
+				size[path] = info.Size()
 			}
 			return nil
 		})
 	}
-	log.Printf("flush index")
-	ix.Flush()
+	sort.Strings(files)
+
+	// Files under the indexed paths that were not kept
+	// have been changed or deleted.
+	remove := make([][]string, len(old))
+	if old != nil {
+		n := 0
+		for _, arg := range args {
+			for i, ix := range old {
+				for _, id := range ix.FilesUnder(arg) {
+					if !kept[i][id] {
+						kept[i][id] = true // do not remove twice
+						remove[i] = append(remove[i], ix.Name(id))
+						n++
+					}
+				}
+			}
+		}
+		if len(files) == 0 && n == 0 && covered(indexPaths(old), args) && sameRules(indexFilters(old), rules) {
+			log.Printf("index up to date")
+			closeIndex(old)
+			return
+		}
+		if *verboseFlag {
+			log.Printf("%d changed or added, %d changed or removed", len(files), n)
+		}
+	}
 
-	if !*resetFlag {
-		log.Printf("merge %s %s", master, file)
-		index.Merge(file+"~", master, file)
-		os.Remove(file)
-		os.Rename(file+"~", master)
+	create := func(file string, names []string) {
+		ix := index.Create(file)
+		ix.Verbose = *verboseFlag
+		ix.Source = src
+		ix.AddPaths(roots)
+		ix.SetFilters(rules)
+		ix.Limits = limits
+		if *skippedFlag {
+			ix.SkipFunc = func(name, reason string) {
+				fmt.Printf("%s: %s\n", name, reason)
+			}
+		}
+		ix.Workers = *workersFlag
+		ix.AddFiles(names)
+		log.Printf("flush index")
+		ix.Flush()
 	}
-	log.Printf("done")
-	return
+	writeIndex(master, oldFiles, old, remove, splitFiles(files, size, *shardSize), create)
+	for _, file := range stale {
+		if file != master {
+			os.Remove(file)
+		}
+	}
+}
+
+// isGit reports whether the indexed path arg names
+// the tree of a git commit, as in repo@rev:.
+func isGit(arg string) bool {
+	_, _, path, ok := git.SplitName(arg)
+	return ok && path == ""
+}
+
+// keepArchive reports whether the members of the archive file,
+// whose information is info, are unchanged since they were indexed
+// in the shards in old, and if so marks them in kept.  The members
+// record the modification time of the archive.
+func keepArchive(old []*index.Index, file string, info os.FileInfo, kept [][]bool) bool {
+	ids := make([][]uint32, len(old))
+	n := 0
+	for i, ix := range old {
+		ids[i] = ix.FilesUnder(file)
+		n += len(ids[i])
+		for _, id := range ids[i] {
+			if _, t, ok := ix.Stat(id); !ok || !t.Equal(info.ModTime()) {
+				return false
+			}
+		}
+	}
+	if n == 0 {
+		return false
+	}
+	for i := range old {
+		for _, id := range ids[i] {
+			kept[i][id] = true
+		}
+	}
+	return true
+}
+
+// covered reports whether every path in args is
+// already covered by one of the indexed paths.
+func covered(paths, args []string) bool {
+	for _, arg := range args {
+		if !index.Under(arg, paths) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameRules reports whether the file selection rules x and y are the same.
+func sameRules(x, y []string) bool {
+	return strings.Join(x, "\x00") == strings.Join(y, "\x00")
 }
@@ -0,0 +1,200 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mars9/kanabe/codesearch/index"
+)
+
+// TestUpdateWhileSearching runs cindex's update over and over, adding
+// and changing files and switching between a single index file and a
+// manifest with shards, while readers open the index in a loop.  The
+// readers must never find the index missing or see it shrink.
+func TestUpdateWhileSearching(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tree := filepath.Join(dir, "src")
+	master := filepath.Join(dir, "index")
+	if err := os.Mkdir(tree, 0777); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, text string) {
+		if err := ioutil.WriteFile(filepath.Join(tree, name), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(n int64) { *shardSize = n }(*shardSize)
+	rules = nil
+	limits = index.DefaultLimits
+
+	write("file0", "file number 0\n")
+	update(master, []string{tree}, []string{tree}, true)
+	if files, err := index.Shards(master); err != nil || len(files) != 1 || files[0] != master {
+		t.Fatalf("Shards after first update = %v, %v, want single index file", files, err)
+	}
+
+	const readers = 4
+	const rounds = 10
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := 0
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_, ixs, err := index.OpenShards(master)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n := 0
+				for _, ix := range ixs {
+					n += len(ix.PostingQuery(&index.Query{Op: index.QAll}))
+					ix.Close()
+				}
+				if n < last {
+					t.Errorf("reader saw %d files after %d", n, last)
+					return
+				}
+				last = n
+			}
+		}()
+	}
+
+	// OpenShards fails if it cannot stat the index file,
+	// however briefly it is missing.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := os.Stat(master); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// Each round rebuilds the index as a single file and then, with
+	// tiny shards, adds a file, which makes it a manifest and shards.
+	for i := 1; i <= rounds; i++ {
+		*shardSize = 1 << 30
+		update(master, []string{tree}, []string{tree}, true)
+		write(fmt.Sprintf("file%d", i), fmt.Sprintf("file number %d\n", i))
+		if i%2 == 0 {
+			// A changed file makes update rewrite the old
+			// index instead of keeping it as a shard.
+			write("file0", fmt.Sprintf("file number 0, version %d\n", i))
+		}
+		*shardSize = 1
+		l := lockIndex(master)
+		update(master, []string{tree}, []string{tree}, false)
+		l.Unlock()
+	}
+	close(done)
+	wg.Wait()
+
+	files, ixs, err := index.OpenShards(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Errorf("index has %d shards, want several", len(files))
+	}
+	n := 0
+	for _, ix := range ixs {
+		n += len(ix.PostingQuery(&index.Query{Op: index.QAll}))
+		ix.Close()
+	}
+	if n != rounds+1 {
+		t.Errorf("index has %d files, want %d", n, rounds+1)
+	}
+}
+
+func TestCovered(t *testing.T) {
+	paths := []string{"/a/foo", "/r/repo@master:", "/z/x.tar"}
+	for _, tt := range []struct {
+		arg string
+		ok  bool
+	}{
+		{"/a/foo", true},
+		{"/a/foo/bar", true},
+		{"/a/foobar", false},
+		{"/a/fo", false},
+		{"/r/repo@master:src/x.go", true},
+		{"/z/x.tar!/y.go", true},
+		{"/z/x.tarball", false},
+	} {
+		if ok := covered(paths, []string{tt.arg}); ok != tt.ok {
+			t.Errorf("covered(%q, %q) = %v, want %v", paths, tt.arg, ok, tt.ok)
+		}
+	}
+}
+
+// TestUpdateRoots checks that updating changed files inside an indexed
+// tree, as -watch does, keeps the tree as the only indexed path.
+func TestUpdateRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tree := filepath.Join(dir, "src")
+	master := filepath.Join(dir, "index")
+	if err := os.Mkdir(tree, 0777); err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(n int64) { *shardSize = n }(*shardSize)
+	rules = nil
+	limits = index.DefaultLimits
+
+	// With tiny shards, each update writes the changed file to a new
+	// shard, which records its own paths.
+	*shardSize = 1
+	file := filepath.Join(tree, "a")
+	for i, text := range []string{"one\n", "two\n", "three\n"} {
+		if err := ioutil.WriteFile(file, []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			update(master, []string{tree}, []string{tree}, true)
+		} else {
+			update(master, []string{tree}, []string{file}, false)
+		}
+	}
+	files, ixs := openIndex(master)
+	defer closeIndex(ixs)
+	for i, ix := range ixs {
+		if paths := ix.Paths(); len(paths) != 1 || paths[0] != tree {
+			t.Errorf("%s: indexed paths = %q, want only %q", files[i], paths, tree)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Selecting the files to index.
+//
+// Besides the temporary and hidden files that skip reports,
+// cindex leaves out the files matched by the -exclude flags and by
+// the .gitignore, .hgignore and .csearchignore files in the indexed
+// trees, and, if there are -include flags, the files they do not match.
+//
+// The ignore files in a directory apply to the tree below it.
+// Cindex reads those in the directory of each file it considers
+// and in the parent directories up to the root of the repository,
+// identified by a .git or .hg directory, or of the file system.
+// Rules in deeper ignore files take precedence, as in git.
+//
+// The .gitignore and .csearchignore files use git's pattern syntax,
+// as do the -include and -exclude flags, except that the patterns
+// given as flags are never anchored: they match at any depth.
+// The .hgignore files use Mercurial's syntax: regular expressions
+// by default, or globs after a "syntax: glob" line.
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mars9/kanabe/codesearch/archive"
+)
+
+// ignoreFiles lists the names of the files holding ignore rules.
+var ignoreFiles = []string{".gitignore", ".hgignore", ".csearchignore"}
+
+// A pattern is a compiled ignore rule.
+type pattern struct {
+	re      *regexp.Regexp // matches slash-separated paths relative to dir
+	dir     string         // directory holding the rule's ignore file, or ""
+	negate  bool           // the rule re-includes what it matches
+	dirOnly bool           // the rule matches only directories
+}
+
+// match reports whether p matches path.
+func (p *pattern) match(path string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.dir != "" {
+		if !inside(path, p.dir) || path == p.dir {
+			return false
+		}
+		path = path[len(p.dir)+1:]
+	}
+	return p.re.MatchString(filepath.ToSlash(path))
+}
+
+// A filter decides which files and directories to leave out of the index.
+type filter struct {
+	include  []*pattern
+	exclude  []*pattern
+	dirs     map[string][]*pattern // ignore rules that apply in a directory
+	noIgnore bool                  // do not read ignore files
+	skipped  map[string]bool       // skipInside results for directories
+}
+
+// newFilter returns a filter applying rules, a list of
+// "include glob" and "exclude glob" strings as recorded
+// in the index by filterRules.
+func newFilter(rules []string) *filter {
+	f := &filter{dirs: make(map[string][]*pattern), skipped: make(map[string]bool)}
+	for _, r := range rules {
+		i := strings.Index(r, " ")
+		if i < 0 {
+			log.Printf("invalid filter rule %q", r)
+			continue
+		}
+		p := parseGitPattern(r[i+1:], "")
+		if p == nil {
+			log.Printf("invalid filter rule %q", r)
+			continue
+		}
+		switch r[:i] {
+		case "include":
+			f.include = append(f.include, p)
+		case "exclude":
+			f.exclude = append(f.exclude, p)
+		default:
+			log.Printf("invalid filter rule %q", r)
+		}
+	}
+	return f
+}
+
+// filterRules returns the rules for the given -include
+// and -exclude globs, in the form newFilter expects.
+func filterRules(include, exclude []string) []string {
+	var rules []string
+	for _, g := range include {
+		rules = append(rules, "include "+g)
+	}
+	for _, g := range exclude {
+		rules = append(rules, "exclude "+g)
+	}
+	return rules
+}
+
+// skip reports whether the file or directory named by path
+// should be left out of the index.
+func (f *filter) skip(path string, isDir bool) bool {
+	if _, elem := filepath.Split(path); elem != "" && skip(elem) {
+		return true
+	}
+	for _, p := range f.exclude {
+		if p.match(path, isDir) {
+			return true
+		}
+	}
+	if !f.noIgnore {
+		ignored := false
+		for _, p := range f.rules(filepath.Dir(path)) {
+			if p.match(path, isDir) {
+				ignored = !p.negate
+			}
+		}
+		if ignored {
+			return true
+		}
+	}
+	// Archives are expanded, so the includes apply to their members.
+	if !isDir && len(f.include) > 0 && !archive.Is(path) {
+		for _, p := range f.include {
+			if p.match(path, false) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// skipInside reports whether the file or directory with the
+// slash-separated path rel in root, a git commit or an archive,
+// should be left out of the index, because of its name or that of a
+// directory holding it, as though it were root/rel.
+func (f *filter) skipInside(root, rel string, isDir bool) bool {
+	for i := 0; i < len(rel); i++ {
+		if rel[i] != '/' {
+			continue
+		}
+		dir := filepath.Join(root, filepath.FromSlash(rel[:i]))
+		s, ok := f.skipped[dir]
+		if !ok {
+			s = f.skip(dir, true)
+			f.skipped[dir] = s
+		}
+		if s {
+			return true
+		}
+	}
+	return f.skip(filepath.Join(root, filepath.FromSlash(rel)), isDir)
+}
+
+// rules returns the ignore rules that apply in dir,
+// outermost first.
+func (f *filter) rules(dir string) []*pattern {
+	if r, ok := f.dirs[dir]; ok {
+		return r
+	}
+	var r []*pattern
+	if parent := filepath.Dir(dir); parent != dir && !isRepo(dir) {
+		r = append(r, f.rules(parent)...)
+	}
+	for _, name := range ignoreFiles {
+		r = append(r, readIgnore(filepath.Join(dir, name))...)
+	}
+	f.dirs[dir] = r
+	return r
+}
+
+// isRepo reports whether dir is the root of a git or Mercurial repository.
+func isRepo(dir string) bool {
+	for _, vcs := range []string{".git", ".hg"} {
+		if _, err := os.Stat(filepath.Join(dir, vcs)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isIgnoreFile reports whether name is the name of an ignore file.
+func isIgnoreFile(name string) bool {
+	for _, n := range ignoreFiles {
+		if name == n {
+			return true
+		}
+	}
+	return false
+}
+
+// readIgnore returns the rules in the ignore file named by file.
+func readIgnore(file string) []*pattern {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+	dir := filepath.Dir(file)
+	hg := filepath.Base(file) == ".hgignore"
+	syntax := "regexp"
+	var pats []*pattern
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		line := s.Text()
+		var p *pattern
+		if hg {
+			line = hgComment(line)
+			if strings.HasPrefix(line, "syntax:") {
+				syntax = strings.TrimSpace(line[len("syntax:"):])
+				continue
+			}
+			p = parseHgPattern(line, syntax, dir)
+		} else {
+			p = parseGitPattern(line, dir)
+		}
+		if p != nil {
+			pats = append(pats, p)
+		}
+	}
+	if err := s.Err(); err != nil {
+		log.Printf("%s: %v", file, err)
+	}
+	return pats
+}
+
+// parseGitPattern parses a line of a .gitignore file in dir.
+// If dir is "", the pattern is unanchored.
+// It returns nil for blank lines, comments and invalid patterns.
+func parseGitPattern(line, dir string) *pattern {
+	if !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	p := &pattern{dir: dir}
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	anchored := dir != "" && strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if strings.HasPrefix(line, "**/") {
+		anchored = false
+		line = line[len("**/"):]
+	}
+	if line == "" {
+		return nil
+	}
+	re, err := globRegexp(line, anchored)
+	if err != nil {
+		return nil
+	}
+	p.re = re
+	return p
+}
+
+// hgComment removes the comment, if any, from a line of a .hgignore
+// file and returns the rest, without surrounding white space.
+func hgComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+		} else if line[i] == '#' {
+			line = line[:i]
+			break
+		}
+	}
+	return strings.TrimSpace(strings.Replace(line, `\#`, "#", -1))
+}
+
+// parseHgPattern parses a line of a .hgignore file in dir,
+// using syntax unless the line has a syntax prefix.
+func parseHgPattern(line, syntax, dir string) *pattern {
+	if line == "" {
+		return nil
+	}
+	for _, s := range []string{"re", "regexp", "glob", "relglob", "relre", "path"} {
+		if strings.HasPrefix(line, s+":") {
+			syntax = s
+			line = line[len(s)+1:]
+			break
+		}
+	}
+	var re *regexp.Regexp
+	var err error
+	switch syntax {
+	case "re", "regexp", "relre":
+		re, err = regexp.Compile(line)
+	case "glob", "relglob":
+		re, err = globRegexp(line, false)
+	case "path":
+		re, err = regexp.Compile("^" + regexp.QuoteMeta(strings.Trim(line, "/")) + "(?:/|$)")
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return &pattern{re: re, dir: dir}
+}
+
+// globRegexp returns a regular expression matching the
+// slash-separated paths that glob matches.  An anchored glob
+// must match the whole path; an unanchored one can match
+// any trailing sequence of path elements.
+func globRegexp(glob string, anchored bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := strings.Index(glob[i+1:], "]")
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += j + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// A globList is a flag.Value that collects
+// the globs given in repeated flags.
+type globList struct {
+	globs []string
+	set   bool // the flag appeared on the command line
+}
+
+func (l *globList) String() string {
+	return strings.Join(l.globs, ",")
+}
+
+func (l *globList) Set(s string) error {
+	l.set = true
+	if s != "" {
+		l.globs = append(l.globs, s)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mars9/kanabe/codesearch/index"
+)
+
+// openIndex opens the shards of the index in master
+// and returns their file names and the open indexes.
+func openIndex(master string) ([]string, []*index.Index) {
+	files, ixs, err := index.OpenShards(master)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return files, ixs
+}
+
+// lockIndex acquires the lock on the index in master, waiting
+// for another cindex to finish with the index if necessary.
+// It returns the held lock.
+func lockIndex(master string) *index.Lock {
+	l, err := index.LockIndex(master, false)
+	if err == index.ErrLocked {
+		log.Printf("waiting for another cindex to finish with %s", master)
+		l, err = index.LockIndex(master, true)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return l
+}
+
+// closeIndex closes the shards returned by openIndex.
+func closeIndex(ixs []*index.Index) {
+	for _, ix := range ixs {
+		ix.Close()
+	}
+}
+
+// indexPaths returns the paths indexed in any of the shards.
+func indexPaths(ixs []*index.Index) []string {
+	all := make(map[string]bool)
+	for _, ix := range ixs {
+		for _, p := range ix.Paths() {
+			all[p] = true
+		}
+	}
+	return collapse(all)
+}
+
+// The file selection rules and limits of a sharded index are those of
+// its last shard, which is the one that cindex wrote most recently.
+
+// indexFilters returns the file selection rules recorded in the shards.
+func indexFilters(ixs []*index.Index) []string {
+	return ixs[len(ixs)-1].Filters()
+}
+
+// indexLimits returns the limits recorded in the shards.
+func indexLimits(ixs []*index.Index) index.Limits {
+	return ixs[len(ixs)-1].Limits()
+}
+
+// splitFiles splits files into groups holding at most max bytes
+// each, as given by size, unless a single file is larger.
+// It returns at least one group, even if it is empty.
+func splitFiles(files []string, size map[string]int64, max int64) [][]string {
+	groups := [][]string{nil}
+	var n int64
+	for _, file := range files {
+		g := len(groups) - 1
+		if n > 0 && n+size[file] > max {
+			groups = append(groups, nil)
+			g++
+			n = 0
+		}
+		groups[g] = append(groups[g], file)
+		n += size[file]
+	}
+	return groups
+}
+
+// newShard returns an unused file name for a shard of the index in master.
+func newShard(master string) string {
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("%s.%d", master, i)
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+	}
+}
+
+// fileSize returns the size of the named file.
+func fileSize(name string) int64 {
+	fi, err := os.Stat(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// writeIndex writes the index in master anew.  It combines the shards
+// in files, which were open as old, without the files listed for each
+// shard in remove, and new shards holding the added and changed files
+// in groups, which it writes by calling create.  To keep small updates
+// from piling up shards, writeIndex merges the last new shard into the
+// smallest old one if the two fit into -shardsize bytes together, and
+// it writes an old shard that loses files anew.
+func writeIndex(master string, files []string, old []*index.Index, remove [][]string, groups [][]string, create func(file string, names []string)) {
+	var added []string
+	for _, g := range groups {
+		file := newShard(master)
+		create(file, g)
+		added = append(added, file)
+	}
+	last := added[len(added)-1]
+	target := -1
+	if len(files) > 0 {
+		sizes := make([]int64, len(files))
+		for i, file := range files {
+			sizes[i] = fileSize(file)
+			if target < 0 || sizes[i] < sizes[target] {
+				target = i
+			}
+		}
+		if sizes[target]+fileSize(last) > *shardSize {
+			target = -1
+		}
+	}
+	closeIndex(old)
+
+	// Update uses an empty index to rewrite a shard
+	// with the current paths, rules, and limits.
+	empty := ""
+	defer func() {
+		if empty != "" {
+			os.Remove(empty)
+		}
+	}()
+	var shards []string
+	for i, file := range files {
+		switch {
+		case i == target:
+			continue
+		case len(remove[i]) > 0:
+			if empty == "" {
+				empty = newShard(master)
+				create(empty, nil)
+			}
+			out := newShard(master)
+			index.Update(out, file, empty, remove[i])
+			shards = append(shards, out)
+		default:
+			shards = append(shards, file)
+		}
+	}
+	shards = append(shards, added[:len(added)-1]...)
+	if target >= 0 {
+		out := newShard(master)
+		log.Printf("merge %s %s", files[target], last)
+		index.Update(out, files[target], last, remove[target])
+		os.Remove(last)
+		last = out
+	}
+	shards = append(shards, last)
+
+	if len(shards) == 1 {
+		if err := os.Rename(shards[0], master); err != nil {
+			log.Fatal(err)
+		}
+		shards[0] = master
+	} else {
+		for i, s := range shards {
+			if s == master {
+				// The unsharded index becomes a shard.  It stays
+				// in master too until the manifest replaces it,
+				// so that csearch always finds an index there.
+				shards[i] = newShard(master)
+				if err := linkFile(master, shards[i]); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		if err := index.WriteManifest(master, shards); err != nil {
+			log.Fatal(err)
+		}
+		if *verboseFlag {
+			log.Printf("index has %d shards", len(shards))
+		}
+	}
+
+	// Remove the shards that were replaced.
+	keep := make(map[string]bool)
+	for _, s := range shards {
+		keep[s] = true
+	}
+	for _, file := range files {
+		if !keep[file] && file != master {
+			os.Remove(file)
+		}
+	}
+}
+
+// linkFile makes dst another name for the file src,
+// or, if the file system cannot, a copy of it.
+func linkFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+"~")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Sync()
+	}
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(w.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(w.Name())
+	}
+	return err
+}
+
+// upgrade rewrites the shards of the index in master
+// that are in an older format in the current one.
+func upgrade(master string) {
+	files, ixs := openIndex(master)
+	for i, file := range files {
+		v := ixs[i].Version()
+		ixs[i].Close()
+		if v >= index.FormatVersion {
+			if *verboseFlag {
+				log.Printf("%s is up to date", file)
+			}
+			continue
+		}
+		index.Upgrade(file+"~", file)
+		if err := os.Rename(file+"~", file); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("upgraded %s from version %d", file, v)
+	}
+}
+
+// removeIndex removes the index in master and its shards.
+func removeIndex(master string) {
+	if files, err := index.Shards(master); err == nil {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}
+	os.Remove(master)
+}
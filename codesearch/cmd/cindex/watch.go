@@ -0,0 +1,90 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxBatch is the longest a change waits to be indexed, in multiples of
+// -watchdelay, when changes keep arriving without pause.
+const maxBatch = 10
+
+// watch keeps the index in master up to date with the file trees
+// rooted at roots.  It does not return.
+func watch(master string, roots []string) {
+	w, err := newWatcher(roots)
+	if err != nil {
+		log.Fatalf("watch: %v", err)
+	}
+	changes := make(chan string, 256)
+	go w.run(changes)
+	log.Printf("watching for changes")
+
+	var (
+		dirty  = make(map[string]bool)
+		first  time.Time
+		flush  <-chan time.Time
+		revive = time.NewTicker(time.Minute)
+	)
+	for {
+		select {
+		case path := <-changes:
+			now := time.Now()
+			if len(dirty) == 0 {
+				first = now
+			}
+			dirty[path] = true
+			// Wait for the burst of changes to end,
+			// but do not put off the update indefinitely.
+			d := *watchDelay
+			if max := first.Add(maxBatch * *watchDelay).Sub(now); max < d {
+				d = max
+			}
+			flush = time.After(d)
+
+		case <-flush:
+			flush = nil
+			lock := lockIndex(master)
+			// Record the roots, not the changed paths, as indexed.
+			update(master, roots, collapse(dirty), false)
+			lock.Unlock()
+			dirty = make(map[string]bool)
+
+		case <-revive.C:
+			// Roots that were removed or renamed cannot be
+			// watched; pick them up again if they come back.
+			for _, root := range w.revive() {
+				go func(root string) { changes <- root }(root)
+			}
+		}
+	}
+}
+
+// collapse returns the sorted list of the paths in dirty,
+// omitting those inside the tree of another path in the list.
+func collapse(dirty map[string]bool) []string {
+	var paths []string
+	for p := range dirty {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var x []string
+	for _, p := range paths {
+		if len(x) > 0 && inside(p, x[len(x)-1]) {
+			continue
+		}
+		x = append(x, p)
+	}
+	return x
+}
+
+// inside reports whether path is dir or lies in the tree rooted at dir.
+func inside(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir) && path[len(dir)] == '/'
+}
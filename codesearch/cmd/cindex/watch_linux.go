@@ -0,0 +1,202 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF |
+	syscall.IN_DONT_FOLLOW
+
+// A watcher reports changes to the file trees rooted at
+// a list of paths, using inotify.
+type watcher struct {
+	fd     int
+	roots  []string
+	filter *filter
+
+	mu      sync.Mutex
+	path    map[int32]string // watched path, by watch descriptor
+	missing map[string]bool  // roots that cannot be watched now
+}
+
+func newWatcher(roots []string) (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &watcher{
+		fd:      fd,
+		roots:   roots,
+		filter:  newFilter(rules),
+		path:    make(map[int32]string),
+		missing: make(map[string]bool),
+	}
+	for _, root := range roots {
+		w.addTree(root)
+	}
+	return w, nil
+}
+
+// addTree watches root and, if it is a directory, all the
+// directories below it that cindex indexes, as decided by the
+// same filter that update applies.
+// The caller must hold w.mu or be the only user of w.
+func (w *watcher) addTree(root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				w.missing[root] = true
+			}
+			return nil
+		}
+		if w.filter.skip(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || path == root {
+			wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+			if err != nil {
+				log.Printf("watch %s: %v", path, err)
+				return nil
+			}
+			w.path[int32(wd)] = path
+		}
+		return nil
+	})
+}
+
+// forget stops watching dir and the directories below it.
+// The caller must hold w.mu.
+func (w *watcher) forget(dir string) {
+	for wd, path := range w.path {
+		if inside(path, dir) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.path, wd)
+		}
+	}
+	for _, root := range w.roots {
+		if root == dir {
+			w.missing[root] = true
+		}
+	}
+}
+
+// prune stops watching the directories below dir
+// that the filter now leaves out of the index.
+// The caller must hold w.mu.
+func (w *watcher) prune(dir string) {
+	for _, path := range w.path {
+		if path != dir && inside(path, dir) && w.filter.skip(path, true) {
+			w.forget(path)
+		}
+	}
+}
+
+// revive starts watching the missing roots that exist again
+// and returns their names.
+func (w *watcher) revive() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var back []string
+	for root := range w.missing {
+		if _, err := os.Stat(root); err == nil {
+			delete(w.missing, root)
+			w.addTree(root)
+			back = append(back, root)
+		}
+	}
+	return back
+}
+
+// run reads inotify events and sends the names of the
+// changed files and directories to changes.
+func (w *watcher) run(changes chan<- string) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			log.Fatalf("reading inotify events: %v", err)
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[off:off+int(ev.Len)], "\x00"))
+			off += int(ev.Len)
+			for _, path := range w.event(ev.Wd, ev.Mask, name) {
+				changes <- path
+			}
+		}
+	}
+}
+
+// event handles a single inotify event and returns
+// the paths that it reports changed.
+func (w *watcher) event(wd int32, mask uint32, name string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// Events were lost: look at everything.
+		log.Printf("inotify queue overflow, rescanning")
+		return w.roots
+	}
+	dir, ok := w.path[wd]
+	if !ok {
+		return nil
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.path, wd)
+		return nil
+	}
+	if mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+		// The directory is gone, or it is known by a new name
+		// under which it will be added again if it is still
+		// inside one of the roots.  Either way, the watches
+		// below it refer to stale names.
+		w.forget(dir)
+		return []string{dir}
+	}
+	if name == "" {
+		// A change to a watched root that is a file.
+		return []string{dir}
+	}
+	if isIgnoreFile(name) {
+		// The rules changed: look at the directory again,
+		// stop watching the directories that are now ignored,
+		// and watch those that are no longer ignored.
+		w.filter = newFilter(rules)
+		w.prune(dir)
+		w.addTree(dir)
+		return []string{dir}
+	}
+	path := filepath.Join(dir, name)
+	if w.filter.skip(path, mask&syscall.IN_ISDIR != 0) {
+		return nil
+	}
+	if mask&syscall.IN_ISDIR != 0 {
+		switch {
+		case mask&syscall.IN_MOVED_FROM != 0:
+			w.forget(path)
+		case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+			w.addTree(path)
+		}
+	}
+	return []string{path}
+}
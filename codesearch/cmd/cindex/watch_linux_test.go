@@ -0,0 +1,83 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestWatchFilter checks that the watcher leaves out the directories
+// that indexing does, by name, by -exclude glob, and by ignore file,
+// including directories created or ignored after it starts.
+func TestWatchFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{".git", "src/pkg", "src/gen", "node_modules/x", "vendor/y", ".hidden"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("node_modules/\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(r []string) { rules = r }(rules)
+	rules = filterRules(nil, []string{"vendor"})
+	w, err := newWatcher([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(w.fd)
+	watched := func() []string {
+		var list []string
+		for _, path := range w.path {
+			list = append(list, strings.TrimPrefix(path, dir))
+		}
+		sort.Strings(list)
+		return list
+	}
+	wdOf := func(path string) int32 {
+		for wd, p := range w.path {
+			if p == path {
+				return wd
+			}
+		}
+		t.Fatalf("%s is not watched", path)
+		return 0
+	}
+	if got, want := watched(), []string{"", "/src", "/src/gen", "/src/pkg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("watching %q, want %q", got, want)
+	}
+
+	// New directories are filtered like the others.
+	for _, d := range []string{"src/vendor", "src/new"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0777); err != nil {
+			t.Fatal(err)
+		}
+		w.event(wdOf(filepath.Join(dir, "src")), syscall.IN_CREATE|syscall.IN_ISDIR, filepath.Base(d))
+	}
+	if got, want := watched(), []string{"", "/src", "/src/gen", "/src/new", "/src/pkg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after mkdir, watching %q, want %q", got, want)
+	}
+
+	// A directory that an ignore file comes to ignore is no longer watched.
+	if err := ioutil.WriteFile(filepath.Join(dir, "src", ".gitignore"), []byte("gen\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	w.event(wdOf(filepath.Join(dir, "src")), syscall.IN_CLOSE_WRITE, ".gitignore")
+	if got, want := watched(), []string{"", "/src", "/src/new", "/src/pkg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after .gitignore, watching %q, want %q", got, want)
+	}
+}
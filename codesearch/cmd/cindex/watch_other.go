@@ -0,0 +1,22 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+type watcher struct{}
+
+func newWatcher(roots []string) (*watcher, error) {
+	return nil, errors.New("not supported on " + runtime.GOOS)
+}
+
+func (w *watcher) run(changes chan<- string) {}
+
+func (w *watcher) revive() []string { return nil }
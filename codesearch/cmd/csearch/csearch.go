@@ -10,23 +10,109 @@ import (
 	"log"
 	"os"
 	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/mars9/kanabe/codesearch/archive"
+	"github.com/mars9/kanabe/codesearch/git"
 	"github.com/mars9/kanabe/codesearch/index"
+	"github.com/mars9/kanabe/codesearch/query"
 	"github.com/mars9/kanabe/codesearch/regexp"
+	"github.com/mars9/kanabe/codesearch/source"
 )
 
-var usageMessage = `Usage: csearch [-c] [-f fileregexp] [-h] [-i] [-l] [-n] regexp
+var usageMessage = `Usage: csearch [-A n] [-B n] [-C n] [-F] [-c] [-color when] [-f fileregexp] [-h] [-i] [-index file]
+	[-json] [-l] [-lang list] [-n] [-p n] [-path glob] [-rank n] [-w] regexp
+       csearch [flags] -q query
+       csearch [flags] [-e pattern]... [-patterns file]
+       csearch [flags] -sym name
 
 Csearch behaves like grep over all indexed files, searching for
-regexp, an RE2 (nearly PCRE) regular expression.
+regexp, an RE2 (nearly PCRE) regular expression. Several arguments
+are joined into one regexp with spaces.
 
-The -c, -h, -i, -l, and -n flags are as in grep, although note that as
-per Go's flag parsing convention, they cannot be combined: the option
-pair -i -n cannot be abbreviated to -in.
+The -q flag makes the arguments a query instead, which can combine
+several regular expressions, each of which must match some line of a
+file, with the operators AND, OR, and NOT and with parentheses, all
+written as separate words. Adjacent terms without an operator must both
+match. A term file:regexp requires the file name to match regexp, and
+a term case:yes, case:no, or case:auto makes the regular expressions
+case-sensitive, case-insensitive, or case-sensitive only when they
+contain upper case, overriding -i. Double quotes group words into a
+single term. For example,
+
+	csearch -q 'Lock AND Unlock NOT defer file:\.go$ case:yes'
+
+prints the lines matching Lock or Unlock in the Go files that contain
+both but do not contain defer. Without -q, none of these words is
+special: 'csearch file:' searches for the text file:.
+
+The -A, -B, -C, -c, -h, -i, -l, and -n flags are as in grep, although
+note that as per Go's flag parsing convention, they cannot be combined:
+the option pair -i -n cannot be abbreviated to -in.
+
+The -F, -w, and -e flags are as in grep: -F searches for a fixed string
+rather than a regular expression, -w matches only whole words, and each
+-e gives a pattern to search for in place of the regexp; a line matches
+if any of them does. The -patterns flag, grep's -f, reads the patterns
+from a file, one per line, ignoring blank lines. With any of these flags
+the patterns are plain regular expressions or strings; -q does not apply.
+Searches for fixed strings, and for regexps that amount to a few fixed
+strings, narrow down the candidate files more precisely and run faster
+than others.
+
+The -p flag sets the number of candidate files searched in parallel;
+it defaults to the number of CPUs. The output is the same regardless.
+
+The -color flag highlights matches, file names, and line numbers.
+When may be always, never, or auto, the default, which highlights
+only when standard output is a terminal. As in grep, the colors can
+be changed with the GREP_COLORS environment variable.
+
+The -json flag prints one JSON object per line instead of plain text:
+a "match" object for each matching line, holding the file name, line
+number, byte offsets of the match within the line, and the line text,
+followed by a "summary" object counting the candidate files proposed
+by the index, the files searched, and the matching lines. With -l and
+-c, "file" and "count" objects take the place of match objects.
+Context lines are not printed in JSON mode.
 
 The -f flag restricts the search to files whose names match the RE2
 regular expression fileregexp.
 
+The -lang flag restricts the search to files in the languages in the
+comma-separated list, such as go,proto; the flag can be repeated to
+add more languages. Cindex classifies each file it
+indexes by its name and, failing that, by its #! line; run csearch
+-lang help for the list of languages.
+
+The -path flag restricts the search to files whose names match glob.
+The glob is matched element by element, as by Go's path.Match, except
+that ** matches any number of elements. A glob beginning with a slash
+matches whole names; any other matches at any depth, so that 'pkg/**'
+selects the trees below every directory named pkg. The flag can be
+repeated to select the files matching any of the globs. Unlike -f,
+-lang and -path are resolved against the index, before csearch reads
+the names of the files they leave out.
+
+The -rank flag orders the output by relevance: csearch searches all the
+candidate files before printing anything and then prints the results for
+the n most relevant matching files first, best first, followed by the
+rest in the usual order. A file ranks higher for having more matching
+lines, more of them per kilobyte, and above all a match on a line that
+looks like a definition, such as one beginning with func, type, class,
+or def. It ranks lower the deeper its name is in the directory tree,
+and much lower inside a vendor, testdata, third_party, or node_modules
+directory. Without -rank, files are printed in order of name.
+
+The -sym flag finds the declarations of the Go function, method, type,
+constant, or variable called name instead of every line mentioning it.
+A name like Type.Method finds only the methods of that type. Cindex
+records the declarations in the Go files it indexes; for indexes written
+before it did so, csearch finds them by parsing the candidate files,
+which is slower. Run 'cindex -reset' to rebuild such an index.
+
 Csearch relies on the existence of an up-to-date index created ahead
 of time. To build or rebuild the index that csearch uses, run:
 
@@ -37,8 +123,17 @@ included in the index. If no index exists, this command creates one.
 If an index already exists, cindex overwrites it. Run cindex -help for
 more.
 
+Files indexed from git commits, as by 'cindex -git', are read from the
+repository's objects rather than from the work tree, and files indexed
+from inside archives, named like deps.tar.gz!/src/foo.go, are read
+from the archives.
+
 Csearch uses the index stored in $CSEARCHINDEX or, if that variable is
-unset or empty, $HOME/.csearchindex.
+unset or empty, $HOME/.csearchindex. $CSEARCHINDEX can also list several
+index files, separated by colons (semicolons on Windows), as can repeated
+-index flags, which override it. Csearch then searches them all, so that
+each project can keep its own index, and reports a file covered by more
+than one of them only once.
 `
 
 func usage() {
@@ -52,22 +147,42 @@ var (
 	verboseFlag = flag.Bool("verbose", false, "print extra information")
 	bruteFlag   = flag.Bool("brute", false, "brute force - search all files in index")
 	cpuProfile  = flag.String("cpuprofile", "", "write cpu profile to this file")
+	symFlag     = flag.Bool("sym", false, "find declarations of the Go symbol named by the argument")
+	queryFlag   = flag.Bool("q", false, "the arguments are a query with AND, OR, NOT, file:, and case:")
+
+	indexFlag stringList
+	pathFlag  stringList
+	langFlag  stringList
 
 	matches bool
 )
 
+func init() {
+	flag.Var(&indexFlag, "index", "search the index `file`; repeat to search several")
+	flag.Var(&pathFlag, "path", "search only files with names matching `glob`; repeat for several")
+	flag.Var(&langFlag, "lang", "search only files in the comma-separated `list` of languages; repeat for more")
+}
+
 func Main() {
 	g := regexp.Grep{
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
+		Source: &archive.Source{Base: source.Stack(source.Local, new(git.Source))},
 	}
+	var pats regexp.Patterns
 	g.AddFlags()
+	pats.AddFlags()
 
 	flag.Usage = usage
 	flag.Parse()
 	args := flag.Args()
 
-	if len(args) != 1 {
+	if len(langFlag) == 1 && langFlag[0] == "help" {
+		fmt.Println(strings.Join(index.Languages(), " "))
+		os.Exit(0)
+	}
+	if len(args) == 0 && !pats.Listed() || pats.Listed() && len(args) > 0 ||
+		*symFlag && (len(args) != 1 || pats.Used() || *queryFlag) || *queryFlag && pats.Used() {
 		usage()
 	}
 
@@ -81,15 +196,18 @@ func Main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	pat := "(?m)" + args[0]
-	if *iFlag {
-		pat = "(?i)" + pat
+	var langs []string
+	for _, list := range langFlag {
+		for _, l := range strings.Split(list, ",") {
+			if l != "" {
+				langs = append(langs, l)
+			}
+		}
 	}
-	re, err := regexp.Compile(pat)
+	ff, err := index.NewFileFilter(langs, pathFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
-	g.Regexp = re
 	var fre *regexp.Regexp
 	if *fFlag != "" {
 		fre, err = regexp.Compile(*fFlag)
@@ -97,46 +215,133 @@ func Main() {
 			log.Fatal(err)
 		}
 	}
-	q := index.RegexpQuery(re.Syntax)
-	if *verboseFlag {
-		log.Printf("query: %s\n", q)
+	files := indexFlag
+	if len(files) == 0 {
+		files = index.Files()
 	}
 
-	ix := index.Open(index.File())
-	ix.Verbose = *verboseFlag
-	var post []uint32
-	if *bruteFlag {
-		post = ix.PostingQuery(&index.Query{Op: index.QAll})
+	var names []string
+	var candidates int
+	if *symFlag {
+		// Print the declaring lines, highlighting the name.
+		sym := args[0]
+		if !isSymbol(sym) {
+			log.Fatalf("-sym: %q is not a Go name or Type.Method", sym)
+		}
+		re, err := regexp.Compile(`(?m)\b` + sym[strings.LastIndex(sym, ".")+1:] + `\b`)
+		if err != nil {
+			log.Fatal(err)
+		}
+		g.Regexp = re
+		names, g.Lines, candidates = symSearch(files, sym, re, ff, fre, g.Source)
 	} else {
-		post = ix.PostingQuery(q)
+		var qry *query.Query
+		if *queryFlag {
+			qry, err = query.Parse(strings.Join(args, " "), *iFlag)
+		} else {
+			// Without -e or -patterns, the arguments are one pattern.
+			var expr string
+			expr, _, err = pats.Expr([]string{strings.Join(args, " ")})
+			if err != nil {
+				log.Fatal(err)
+			}
+			qry, err = query.ParseRegexp(expr, *iFlag)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		g.Regexp = qry.Regexp()
+		if !qry.IsRegexp() {
+			g.Select = qry
+		}
+		names, candidates = search(files, qry, ff, fre)
 	}
+	g.Candidates = candidates
+	g.Files(names)
+	g.Done()
+
+	matches = g.Match
+}
+
+// search returns the sorted names of the files in the index files
+// that may match qry, that ff selects, and whose names match fre,
+// if not nil, and the number of files that the index says may match
+// qry.  A file covered by several indexes counts once.  The shards of
+// sharded indexes are searched in parallel.
+func search(files []string, qry *query.Query, ff *index.FileFilter, fre *regexp.Regexp) (names []string, candidates int) {
+	q := qry.Index()
 	if *verboseFlag {
-		log.Printf("post query identified %d possible files\n", len(post))
+		log.Printf("query: %s\n", q)
+	}
+	if *bruteFlag {
+		q = &index.Query{Op: index.QAll}
+	}
+	var shards []string
+	var ixs []*index.Index
+	for _, file := range files {
+		s, x, err := index.OpenShards(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		shards = append(shards, s...)
+		ixs = append(ixs, x...)
 	}
 
-	if fre != nil {
-		fnames := make([]uint32, 0, len(post))
+	found := make([][]string, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard string) {
+			defer wg.Done()
+			ix := ixs[i]
+			ix.Verbose = *verboseFlag
+			post := ix.PostingQuery(q)
+			if *verboseFlag {
+				log.Printf("%s: post query identified %d possible files\n", shard, len(post))
+			}
+			post = ix.FilterFiles(post, ff)
+			found[i] = make([]string, len(post))
+			for j, fileid := range post {
+				found[i][j] = ix.Name(fileid)
+			}
+			ix.Close()
+		}(i, shard)
+	}
+	wg.Wait()
 
-		for _, fileid := range post {
-			name := ix.Name(fileid)
-			if fre.MatchString(name, true, true) < 0 {
+	seen := make(map[string]bool)
+	for _, list := range found {
+		for _, name := range list {
+			if seen[name] {
 				continue
 			}
-			fnames = append(fnames, fileid)
-		}
-
-		if *verboseFlag {
-			log.Printf("filename regexp matched %d files\n", len(fnames))
+			seen[name] = true
+			if fre != nil && fre.MatchString(name, true, true) < 0 || !qry.MaySelect(name) {
+				continue
+			}
+			names = append(names, name)
 		}
-		post = fnames
 	}
-
-	for _, fileid := range post {
-		name := ix.Name(fileid)
-		g.File(name)
+	if len(shards) > 1 {
+		sort.Strings(names)
+	}
+	if *verboseFlag && fre != nil {
+		log.Printf("filename regexp matched %d files\n", len(names))
 	}
+	return names, len(seen)
+}
 
-	matches = g.Match
+// A stringList is a flag.Value that collects
+// the strings given in repeated flags.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
 
 func main() {
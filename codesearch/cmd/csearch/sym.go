@@ -0,0 +1,129 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/token"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/mars9/kanabe/codesearch/index"
+	"github.com/mars9/kanabe/codesearch/regexp"
+	"github.com/mars9/kanabe/codesearch/source"
+)
+
+// isSymbol reports whether sym is a Go identifier
+// or a pair of them, Type.Method.
+func isSymbol(sym string) bool {
+	typ, name := "", sym
+	if i := strings.Index(sym, "."); i >= 0 {
+		typ, name = sym[:i], sym[i+1:]
+		if !token.IsIdentifier(typ) {
+			return false
+		}
+	}
+	return token.IsIdentifier(name)
+}
+
+// symSearch returns the sorted names of the files in the index files
+// that declare sym, that ff selects, and whose names match fre, if not
+// nil, the lines of the declarations in each file, and the number of
+// files the indexes proposed.  Indexes that record the declarations of their
+// Go files answer from those records; for the others, symSearch
+// parses the Go files that may match re, read from src.
+func symSearch(files []string, sym string, re *regexp.Regexp, ff *index.FileFilter, fre *regexp.Regexp, src source.Source) (names []string, lines map[string][]int, candidates int) {
+	lines = make(map[string][]int)
+	seen := make(map[string]bool)
+	var parse []string
+	for _, file := range files {
+		shards, ixs, err := index.OpenShards(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i, ix := range ixs {
+			ix.Verbose = *verboseFlag
+			if ix.HasSymbols() && !*bruteFlag {
+				syms := ix.Symbols(sym)
+				if *verboseFlag {
+					log.Printf("%s: symbol table lists %d declarations\n", shards[i], len(syms))
+				}
+				var ids []uint32
+				for _, s := range syms {
+					ids = append(ids, s.FileID)
+				}
+				selected := make(map[uint32]bool)
+				for _, id := range ix.FilterFiles(ids, ff) {
+					selected[id] = true
+				}
+				// A file that an earlier index covered is done,
+				// but this index may list several declarations in it.
+				claimed := make(map[string]bool)
+				for _, s := range syms {
+					if !selected[s.FileID] {
+						continue
+					}
+					name := ix.Name(s.FileID)
+					if seen[name] && !claimed[name] {
+						continue
+					}
+					seen[name] = true
+					claimed[name] = true
+					if fre == nil || fre.MatchString(name, true, true) >= 0 {
+						lines[name] = append(lines[name], s.Line)
+					}
+				}
+			} else {
+				q := index.RegexpQuery(re.Syntax)
+				if *bruteFlag {
+					q = &index.Query{Op: index.QAll}
+				}
+				post := ix.PostingQuery(q)
+				if *verboseFlag {
+					log.Printf("%s: no symbol table, post query identified %d possible files\n", shards[i], len(post))
+				}
+				post = ix.FilterFiles(post, ff)
+				for _, fileid := range post {
+					name := ix.Name(fileid)
+					if !strings.HasSuffix(name, ".go") || seen[name] {
+						continue
+					}
+					seen[name] = true
+					if fre == nil || fre.MatchString(name, true, true) >= 0 {
+						parse = append(parse, name)
+					}
+				}
+			}
+			ix.Close()
+		}
+	}
+
+	for _, name := range parse {
+		f, err := src.Open(name)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			continue
+		}
+		for _, s := range index.ParseSymbols(name, data) {
+			if s.Matches(sym) {
+				lines[name] = append(lines[name], s.Line)
+			}
+		}
+	}
+
+	for name, l := range lines {
+		sort.Ints(l)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, lines, len(seen)
+}
@@ -0,0 +1,53 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mars9/kanabe/codesearch/index"
+	"github.com/mars9/kanabe/codesearch/regexp"
+	"github.com/mars9/kanabe/codesearch/source"
+)
+
+// TestSymSearchOverlap checks that a file that two indexes cover
+// is reported once, from the first index.
+func TestSymSearchOverlap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csearch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "p.go")
+	src := "package p\n\nfunc F() {}\n\ntype T int\n\nfunc (T) F() {}\n"
+	if err := ioutil.WriteFile(file, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, name := range []string{"index1", "index2"} {
+		ixfile := filepath.Join(dir, name)
+		ix := index.Create(ixfile)
+		ix.AddPaths([]string{dir})
+		ix.AddFile(file)
+		ix.Flush()
+		files = append(files, ixfile)
+	}
+
+	re, err := regexp.Compile(`\bF\b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, lines, _ := symSearch(files, "F", re, nil, nil, source.Local)
+	if want := []string{file}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %v, want %v", names, want)
+	}
+	if want := []int{3, 7}; !reflect.DeepEqual(lines[file], want) {
+		t.Errorf("lines = %v, want %v", lines[file], want)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mars9/kanabe/codesearch/index"
+)
+
+var usageMessage = `Usage: csearchd [-http addr] [-index file] [-maxresults n] [-poll d] [-timeout d]
+
+Csearchd serves searches over the files in an index, so that many users
+can share one index built by cindex. It answers HTTP requests like
+
+	/api/search?q=regexp&f=fileregexp&i=1&max=100&context=2
+
+with a JSON object listing the matching lines. The q parameter is the
+RE2 regular expression to search for and is required. The others are
+optional: f restricts the search to files whose names match the
+regular expression fileregexp, i=1 makes the search case-insensitive,
+max limits the number of matching lines returned, and context sets the
+number of lines of context to return around each match.
+
+A minimal HTML interface to the same searches is served at /.
+
+The -http flag sets the address to listen on (default :8080).
+
+The -index flag names the index file; it defaults to the first file
+in $CSEARCHINDEX or, if that variable is unset or empty, to
+$HOME/.csearchindex. Csearchd checks every -poll interval (default 5s)
+whether cindex has replaced the file, or one of the shards of a sharded
+index, and if so switches to the new index. Searches already running
+finish using the old one.
+
+The -timeout flag (default 10s) limits the time spent on a single
+search, and the -maxresults flag (default 1000) limits the number of
+matching lines it can return. A search that hits either limit returns
+the results found so far and says which limit it hit.
+`
+
+func usage() {
+	fmt.Fprint(os.Stderr, usageMessage)
+	os.Exit(2)
+}
+
+var (
+	httpFlag       = flag.String("http", ":8080", "serve HTTP on `addr`")
+	indexFlag      = flag.String("index", "", "search the index `file`")
+	pollFlag       = flag.Duration("poll", 5*time.Second, "check for a new index every `d`")
+	timeoutFlag    = flag.Duration("timeout", 10*time.Second, "stop searches after `d`")
+	maxResultsFlag = flag.Int("maxresults", 1000, "return at most `n` matching lines per search")
+)
+
+// maxContext is the most context lines a search can ask for.
+const maxContext = 20
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 {
+		usage()
+	}
+
+	file := *indexFlag
+	if file == "" {
+		file = index.File()
+	}
+	s := newServer(file)
+	go s.poll(*pollFlag)
+
+	http.HandleFunc("/", s.serveUI)
+	http.HandleFunc("/api/search", s.serveSearch)
+	log.Printf("serving %s on %s", file, *httpFlag)
+	log.Fatal(http.ListenAndServe(*httpFlag, nil))
+}
+
+// A server serves searches over the index in a file.
+type server struct {
+	file string
+
+	mu  sync.Mutex
+	cur *loaded // current index
+}
+
+// A loaded is an open index.
+type loaded struct {
+	ixs  []*index.Index // the index's shards
+	fis  []os.FileInfo  // files the index was read from: the index file and its shards
+	refs sync.WaitGroup // searches using ixs
+}
+
+func newServer(file string) *server {
+	s := &server{file: file}
+	s.cur = load(file)
+	if s.cur == nil {
+		log.Fatalf("cannot open index %s", file)
+	}
+	return s
+}
+
+// load opens the index in file, or returns nil if it cannot.
+func load(file string) *loaded {
+	shards, err := index.Shards(file)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	// Stat the files before opening them, so that
+	// changed notices a replacement made meanwhile.
+	fis, err := stat(file, shards)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	_, ixs, err := index.OpenShards(file)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	return &loaded{ixs: ixs, fis: fis}
+}
+
+// stat returns the information for the index file and its shards.
+func stat(file string, shards []string) ([]os.FileInfo, error) {
+	var fis []os.FileInfo
+	for _, name := range append([]string{file}, shards...) {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
+
+// changed reports whether the files of l have been replaced.
+func (l *loaded) changed(file string) bool {
+	shards, err := index.Shards(file)
+	if err != nil {
+		return false
+	}
+	fis, err := stat(file, shards)
+	if err != nil || len(fis) != len(l.fis) {
+		return err == nil
+	}
+	for i, fi := range fis {
+		old := l.fis[i]
+		if !os.SameFile(fi, old) || !fi.ModTime().Equal(old.ModTime()) || fi.Size() != old.Size() {
+			return true
+		}
+	}
+	return false
+}
+
+// numFiles returns the number of live files in l.
+func (l *loaded) numFiles() int {
+	n := 0
+	for _, ix := range l.ixs {
+		n += ix.NumFiles() - ix.NumDeleted()
+	}
+	return n
+}
+
+// acquire returns the current index, which the caller must release.
+func (s *server) acquire() *loaded {
+	s.mu.Lock()
+	l := s.cur
+	l.refs.Add(1)
+	s.mu.Unlock()
+	return l
+}
+
+func (l *loaded) release() {
+	l.refs.Done()
+}
+
+// poll checks every d whether the index file or one of its shards has
+// been replaced and, if so, loads the new index.  The old index is
+// closed once the searches using it have finished.
+func (s *server) poll(d time.Duration) {
+	for range time.Tick(d) {
+		s.mu.Lock()
+		old := s.cur
+		s.mu.Unlock()
+		if !old.changed(s.file) {
+			continue
+		}
+		l := load(s.file)
+		if l == nil {
+			continue
+		}
+		s.mu.Lock()
+		s.cur = l
+		s.mu.Unlock()
+		log.Printf("reloaded %s: %d files", s.file, l.numFiles())
+		go func() {
+			old.refs.Wait()
+			for _, ix := range old.ixs {
+				if err := ix.Close(); err != nil {
+					log.Print(err)
+				}
+			}
+		}()
+	}
+}
+
+// parseRequest returns the search described by the
+// query parameters of r.
+func parseRequest(r *http.Request) (*request, error) {
+	q := r.FormValue("q")
+	if q == "" {
+		return nil, fmt.Errorf("missing query parameter q")
+	}
+	req := &request{
+		Pattern:     q,
+		FilePattern: r.FormValue("f"),
+		Fold:        r.FormValue("i") == "1" || r.FormValue("i") == "true",
+		Max:         *maxResultsFlag,
+	}
+	if v := r.FormValue("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid max %q", v)
+		}
+		if n < req.Max {
+			req.Max = n
+		}
+	}
+	if v := r.FormValue("context"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid context %q", v)
+		}
+		if n > maxContext {
+			n = maxContext
+		}
+		req.Context = n
+	}
+	return req, nil
+}
+
+func (s *server) serveSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	req, err := parseRequest(r)
+	var res *result
+	if err == nil {
+		res, err = s.search(r, req)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// search runs req against the current index.
+func (s *server) search(r *http.Request, req *request) (*result, error) {
+	l := s.acquire()
+	defer l.release()
+	deadline := time.Now().Add(*timeoutFlag)
+	return req.run(l.ixs, deadline, r.Context().Done())
+}
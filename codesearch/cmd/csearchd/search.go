@@ -0,0 +1,254 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/mars9/kanabe/codesearch/archive"
+	"github.com/mars9/kanabe/codesearch/git"
+	"github.com/mars9/kanabe/codesearch/index"
+	"github.com/mars9/kanabe/codesearch/regexp"
+	"github.com/mars9/kanabe/codesearch/source"
+)
+
+// A request is a search to run.
+type request struct {
+	Pattern     string // regexp to search for
+	FilePattern string // regexp that file names must match, if not empty
+	Fold        bool   // case-insensitive search
+	Max         int    // maximum number of matches
+	Context     int    // lines of context around each match
+}
+
+// A result is the answer to a request.
+type result struct {
+	Matches    []*match `json:"matches"`
+	Candidates int      `json:"candidates"` // files the index proposed
+	Files      int      `json:"files"`      // files searched
+	Truncated  bool     `json:"truncated"`  // stopped at the result limit
+	TimedOut   bool     `json:"timeout"`    // stopped at the time limit
+	Elapsed    float64  `json:"elapsed"`    // seconds
+}
+
+// A match is a matching line.
+type match struct {
+	File   string   `json:"file"`
+	Line   int      `json:"line"`
+	Start  int      `json:"start"` // byte offset of the match within Text
+	End    int      `json:"end"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"` // context lines before Text
+	After  []string `json:"after,omitempty"`  // context lines after Text
+}
+
+// run runs req against the index made of the shards ixs.  It stops
+// early, returning the matches found so far, when the deadline passes
+// or done is closed, whether it is querying the index or searching
+// a file.
+func (req *request) run(ixs []*index.Index, deadline time.Time, done <-chan struct{}) (*result, error) {
+	start := time.Now()
+	pat := "(?m)" + req.Pattern
+	if req.Fold {
+		pat = "(?i)" + pat
+	}
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		return nil, err
+	}
+	var fre *regexp.Regexp
+	if req.FilePattern != "" {
+		fre, err = regexp.Compile(req.FilePattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Stop is closed when the deadline passes or done is closed.
+	stop := make(chan struct{})
+	if isDone(done) || !time.Now().Before(deadline) {
+		close(stop)
+	} else {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			t := time.NewTimer(time.Until(deadline))
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-done:
+			case <-finished:
+			}
+			close(stop)
+		}()
+	}
+
+	res := &result{Matches: []*match{}}
+	q := index.RegexpQuery(re.Syntax)
+	var names []string
+	for _, ix := range ixs {
+		post, ok := ix.PostingQueryDone(q, stop)
+		if !ok {
+			res.TimedOut = true
+			res.Elapsed = time.Since(start).Seconds()
+			return res, nil
+		}
+		for _, fileid := range post {
+			names = append(names, ix.Name(fileid))
+		}
+	}
+	if len(ixs) > 1 {
+		sort.Strings(names)
+	}
+	res.Candidates = len(names)
+	for _, name := range names {
+		if isDone(stop) {
+			res.TimedOut = true
+			break
+		}
+		if fre != nil && fre.MatchString(name, true, true) < 0 {
+			continue
+		}
+		data, err := readFile(name)
+		if err != nil {
+			continue
+		}
+		res.Files++
+		if !req.searchFile(res, re, name, data, stop) {
+			break
+		}
+	}
+	res.Elapsed = time.Since(start).Seconds()
+	return res, nil
+}
+
+// src holds the indexed files: local files,
+// files in git commits, and archive members.
+var src = &archive.Source{Base: source.Stack(source.Local, new(git.Source))}
+
+// readFile returns the contents of the named file.
+func readFile(name string) ([]byte, error) {
+	f, err := src.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// searchChunk is how much of a file searchFile
+// searches between checks for the time limit.
+const searchChunk = 1 << 20
+
+// searchFile adds the lines of data that match re to res.  It reports
+// whether the search should go on, which it should not if res is full
+// or stop is closed; it then sets res.Truncated or res.TimedOut.
+func (req *request) searchFile(res *result, re *regexp.Regexp, name string, data []byte, stop <-chan struct{}) bool {
+	lineno := 1
+	counted := 0 // lineno is the number of the line at data[counted]
+	for start := 0; start < len(data); {
+		if isDone(stop) {
+			res.TimedOut = true
+			return false
+		}
+		// Search a chunk of whole lines at a time.
+		end := len(data)
+		if end-start > searchChunk {
+			end = start + searchChunk
+			if i := bytes.IndexByte(data[end:], '\n'); i >= 0 {
+				end += i + 1
+			} else {
+				end = len(data)
+			}
+		}
+		m := re.Match(data[start:end], start == 0, end == len(data))
+		if m < 0 {
+			start = end
+			continue
+		}
+		m += start
+		lineStart := bytes.LastIndexByte(data[start:m], '\n') + 1 + start
+		lineEnd := m + 1
+		if lineEnd > len(data) {
+			lineEnd = len(data)
+		}
+		lineno += bytes.Count(data[counted:lineStart], nl)
+		if len(res.Matches) >= req.Max {
+			res.Truncated = true
+			return false
+		}
+		text := bytes.TrimSuffix(data[lineStart:lineEnd], nl)
+		mt := &match{
+			File: name,
+			Line: lineno,
+			End:  len(text),
+			Text: string(text),
+		}
+		if loc := re.FindIndex(text); loc != nil {
+			mt.Start, mt.End = loc[0], loc[1]
+		}
+		if req.Context > 0 {
+			mt.Before = linesBefore(data[:lineStart], req.Context)
+			mt.After = linesAfter(data[lineEnd:], req.Context)
+		}
+		res.Matches = append(res.Matches, mt)
+		lineno++
+		start = lineEnd
+		counted = lineEnd
+	}
+	return true
+}
+
+var nl = []byte{'\n'}
+
+// linesBefore returns the last n lines of text,
+// which ends in a newline if it is not empty.
+func linesBefore(text []byte, n int) []string {
+	i := len(text) - 1
+	for ; n > 0 && i >= 0; n-- {
+		i = bytes.LastIndexByte(text[:i], '\n')
+	}
+	return lines(text[i+1:])
+}
+
+// linesAfter returns the first n lines of text.
+func linesAfter(text []byte, n int) []string {
+	i := 0
+	for ; n > 0 && i < len(text); n-- {
+		j := bytes.IndexByte(text[i:], '\n')
+		if j < 0 {
+			i = len(text)
+			break
+		}
+		i += j + 1
+	}
+	return lines(text[:i])
+}
+
+// lines splits text into lines, without their newlines.
+func lines(text []byte) []string {
+	var x []string
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, '\n')
+		if i < 0 {
+			i = len(text) - 1
+		}
+		x = append(x, string(bytes.TrimSuffix(text[:i+1], nl)))
+		text = text[i+1:]
+	}
+	return x
+}
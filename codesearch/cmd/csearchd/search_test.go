@@ -0,0 +1,99 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mars9/kanabe/codesearch/index"
+	"github.com/mars9/kanabe/codesearch/regexp"
+)
+
+// bigFile returns a file of many lines with a match in the last one.
+func bigFile() []byte {
+	var b bytes.Buffer
+	for b.Len() < 8*searchChunk {
+		b.WriteString("nothing to see on this line\n")
+	}
+	b.WriteString("needle\n")
+	return b.Bytes()
+}
+
+func TestSearchFile(t *testing.T) {
+	data := bigFile()
+	re, err := regexp.Compile("(?m)needle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &request{Max: 10}
+	res := &result{}
+	if !req.searchFile(res, re, "big", data, nil) {
+		t.Fatalf("searchFile stopped: %+v", res)
+	}
+	want := bytes.Count(data, nl)
+	if len(res.Matches) != 1 || res.Matches[0].Line != want || res.Matches[0].Text != "needle" {
+		t.Fatalf("matches = %+v, want needle at line %d", res.Matches, want)
+	}
+
+	// Once stopped, searchFile gives up within the file.
+	stop := make(chan struct{})
+	close(stop)
+	res = &result{}
+	if req.searchFile(res, re, "big", data, stop) || !res.TimedOut || len(res.Matches) != 0 {
+		t.Errorf("stopped searchFile = %+v, want timeout and no matches", res)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csearchd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "big")
+	if err := ioutil.WriteFile(file, bigFile(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	ixfile := filepath.Join(dir, "index")
+	w := index.Create(ixfile)
+	w.Limits.MaxFileLen = 1 << 30
+	w.AddPaths([]string{dir})
+	w.AddFile(file)
+	w.Flush()
+	ix := index.Open(ixfile)
+	defer ix.Close()
+
+	req := &request{Pattern: "needle", Max: 10}
+	res, err := req.run([]*index.Index{ix}, time.Now().Add(time.Hour), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Matches) != 1 || res.TimedOut {
+		t.Fatalf("run = %+v, want one match", res)
+	}
+
+	// A time limit that has passed stops the search at once.
+	res, err = req.run([]*index.Index{ix}, time.Now(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.TimedOut || len(res.Matches) != 0 {
+		t.Errorf("run after deadline = %+v, want timeout and no matches", res)
+	}
+
+	// A tiny one stops it in the index or in the file.
+	res, err = req.run([]*index.Index{ix}, time.Now().Add(time.Microsecond), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Matches) != 0 && !res.TimedOut {
+		t.Errorf("run with tiny timeout = %+v, want timeout", res)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// serveUI serves the HTML search form and, if the request
+// includes a query, the results.
+func (s *server) serveUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	page := struct {
+		Q, F   string
+		Fold   bool
+		Error  string
+		Result *result
+	}{
+		Q:    r.FormValue("q"),
+		F:    r.FormValue("f"),
+		Fold: r.FormValue("i") == "1",
+	}
+	if page.Q != "" {
+		req, err := parseRequest(r)
+		if err == nil {
+			page.Result, err = s.search(r, req)
+		}
+		if err != nil {
+			page.Error = err.Error()
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := uiTemplate.Execute(w, &page); err != nil {
+		log.Print(err)
+	}
+}
+
+var uiTemplate = template.Must(template.New("ui").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{if .Q}}{{.Q}} - {{end}}Code Search</title>
+<style>
+body { font-family: sans-serif; }
+pre { margin: 0; }
+.file { margin-top: 1em; font-weight: bold; }
+b { background: #ff8; }
+</style>
+</head>
+<body>
+<form action="/">
+<input name="q" size="60" value="{{.Q}}" placeholder="regexp" autofocus>
+<input name="f" size="30" value="{{.F}}" placeholder="file regexp">
+<label><input type="checkbox" name="i" value="1"{{if .Fold}} checked{{end}}> ignore case</label>
+<input type="submit" value="Search">
+</form>
+{{with .Error}}<p>{{.}}</p>{{end}}
+{{with .Result}}
+<p>{{len .Matches}} matching lines in {{.Files}} of {{.Candidates}} candidate files
+({{printf "%.3f" .Elapsed}}s){{if .Truncated}}; too many results, list truncated{{end}}{{if .TimedOut}}; search timed out{{end}}.</p>
+{{$file := ""}}
+{{range .Matches}}
+{{if ne .File $file}}{{$file = .File}}<div class="file">{{.File}}</div>{{end}}
+<pre>{{.Line}}: {{slice .Text 0 .Start}}<b>{{slice .Text .Start .End}}</b>{{slice .Text .End (len .Text)}}</pre>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,278 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitCmd runs git with args in dir and returns its output.
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=gopher", "GIT_AUTHOR_EMAIL=gopher@example.com",
+		"GIT_COMMITTER_NAME=gopher", "GIT_COMMITTER_EMAIL=gopher@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// makeRepo creates a repository with a few commits
+// and returns its directory.
+func makeRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "git-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitCmd(t, dir, "init", "-q")
+	write := func(name, data string) {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0777)
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Large, similar files so that git gc stores deltas.
+	var big bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&big, "line %d of a file big enough to be worth deltifying\n", i)
+	}
+	write("a.go", "package a\n")
+	write("dir/b.txt", big.String())
+	write("dir/sub/c.txt", "hello world\n")
+	gitCmd(t, dir, "add", ".")
+	gitCmd(t, dir, "commit", "-q", "-m", "first")
+	gitCmd(t, dir, "tag", "-a", "-m", "version 1", "v1")
+
+	write("a.go", "package a\n\nfunc A() {}\n")
+	write("dir/b.txt", big.String()+"one more line\n")
+	write("run.sh", "#!/bin/sh\necho hi\n")
+	os.Chmod(filepath.Join(dir, "run.sh"), 0777)
+	if err := os.Symlink("a.go", filepath.Join(dir, "link.go")); err != nil {
+		t.Fatal(err)
+	}
+	gitCmd(t, dir, "add", ".")
+	gitCmd(t, dir, "commit", "-q", "-m", "second")
+	return dir
+}
+
+// checkRepo compares what Repo reads with what git reports.
+func checkRepo(t *testing.T, dir string) {
+	r, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, rev := range []string{"HEAD", "master", "v1", "HEAD~1"} {
+		want := strings.TrimSpace(gitCmd(t, dir, "rev-parse", rev+"^{commit}"))
+		if rev == "HEAD~1" {
+			// Not supported; use the abbreviated name instead.
+			rev = want[:8]
+		}
+		if rev == "master" {
+			rev = strings.TrimSpace(gitCmd(t, dir, "symbolic-ref", "--short", "HEAD"))
+		}
+		h, err := r.Resolve(rev)
+		if err != nil {
+			t.Errorf("Resolve(%q): %v", rev, err)
+			continue
+		}
+		if h.String() != want {
+			t.Errorf("Resolve(%q) = %s, want %s", rev, h, want)
+		}
+
+		files, err := r.Files(h)
+		if err != nil {
+			t.Errorf("Files(%s): %v", rev, err)
+			continue
+		}
+		var got []string
+		for _, f := range files {
+			got = append(got, fmt.Sprintf("%o blob %s\t%s", f.Mode, f.Hash, f.Path))
+		}
+		var wantFiles []string
+		for _, line := range strings.Split(strings.TrimSpace(gitCmd(t, dir, "ls-tree", "-r", want)), "\n") {
+			if strings.HasPrefix(line, "100") {
+				wantFiles = append(wantFiles, strings.TrimPrefix(line, "0"))
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(wantFiles, "\n") {
+			t.Errorf("Files(%s):\n%s\nwant:\n%s", rev, strings.Join(got, "\n"), strings.Join(wantFiles, "\n"))
+		}
+		for _, f := range files {
+			data, err := r.ReadFile(h, f.Path)
+			if err != nil {
+				t.Errorf("ReadFile(%s, %s): %v", rev, f.Path, err)
+				continue
+			}
+			if want := gitCmd(t, dir, "show", want+":"+f.Path); string(data) != want {
+				t.Errorf("ReadFile(%s, %s) = %q, want %q", rev, f.Path, data, want)
+			}
+			if size, err := r.Size(f.Hash); err != nil || size != int64(len(data)) {
+				t.Errorf("Size(%s) = %d, %v, want %d", f.Path, size, err, len(data))
+			}
+		}
+	}
+	h, _ := r.Resolve("HEAD")
+	for _, path := range []string{"missing.go", "dir", "dir/sub/c.txt/x", "link.go"} {
+		if _, err := r.ReadFile(h, path); err == nil {
+			t.Errorf("ReadFile(HEAD, %s) succeeded", path)
+		}
+	}
+	if _, err := r.Resolve("nosuchref"); err == nil {
+		t.Errorf("Resolve(nosuchref) succeeded")
+	}
+}
+
+func TestLoose(t *testing.T) {
+	dir := makeRepo(t)
+	defer os.RemoveAll(dir)
+	checkRepo(t, dir)
+}
+
+func TestPacked(t *testing.T) {
+	dir := makeRepo(t)
+	defer os.RemoveAll(dir)
+	gitCmd(t, dir, "gc", "-q", "--aggressive")
+	if m, _ := filepath.Glob(filepath.Join(dir, ".git/objects/pack/*.pack")); len(m) == 0 {
+		t.Fatal("git gc made no pack")
+	}
+	if !strings.Contains(gitCmd(t, dir, "count-objects", "-v"), "count: 0") {
+		t.Fatal("git gc left loose objects")
+	}
+	checkRepo(t, dir)
+}
+
+func TestName(t *testing.T) {
+	dir := makeRepo(t)
+	defer os.RemoveAll(dir)
+
+	name := Name(dir, "v1", "dir/sub/c.txt")
+	d, rev, path, ok := SplitName(name)
+	if !ok || d != dir || rev != "v1" || path != "dir/sub/c.txt" {
+		t.Errorf("SplitName(%q) = %q, %q, %q, %v", name, d, rev, path, ok)
+	}
+	var src Source
+	f, err := src.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(f)
+	if string(data) != "hello world\n" {
+		t.Errorf("Open(%q) read %q", name, data)
+	}
+	fi, err := f.(*file).Stat()
+	want := strings.TrimSpace(gitCmd(t, dir, "log", "-1", "--format=%ct", "v1"))
+	if err != nil || fi.Size() != 12 || fmt.Sprint(fi.ModTime().Unix()) != want {
+		t.Errorf("Stat = %d, %v, %v; want 12, %s", fi.Size(), fi.ModTime().Unix(), err, want)
+	}
+	for _, name := range []string{"missing.go", "link.go", "a.go/x"} {
+		if _, err := src.Open(Name(dir, "HEAD", name)); !os.IsNotExist(err) {
+			t.Errorf("Open(%s): %v, want not exist", name, err)
+		}
+	}
+	if _, err := src.Open(filepath.Join(dir, "a.go")); !os.IsNotExist(err) {
+		t.Errorf("Open(work tree file): %v, want not exist", err)
+	}
+	if fi, err := src.Stat(Name(dir, "HEAD", "dir/sub")); err != nil || !fi.IsDir() {
+		t.Errorf("Stat(dir/sub) = %v, %v", fi, err)
+	}
+
+	// List walks the tree like filepath.Walk.
+	var list []string
+	src.List(Name(dir, "HEAD", ""), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			t.Errorf("List: %s: %v", path, err)
+			return nil
+		}
+		path = strings.TrimPrefix(path, Name(dir, "HEAD", ""))
+		list = append(list, fmt.Sprintf("%s %d %v", path, fi.Size(), fi.IsDir()))
+		if path == "dir/sub" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	wantList := []string{
+		" 0 true",
+		"a.go 23 false",
+		"dir 0 true",
+		"dir/b.txt 52904 false",
+		"dir/sub 0 true",
+		"run.sh 18 false",
+	}
+	if strings.Join(list, "\n") != strings.Join(wantList, "\n") {
+		t.Errorf("List:\n%s\nwant:\n%s", strings.Join(list, "\n"), strings.Join(wantList, "\n"))
+	}
+}
+
+func TestDelta(t *testing.T) {
+	base := []byte("hello, world")
+	// Source size 12, target size 11: copy "hello" (offset 0,
+	// size 5), insert " big", copy " w" (offset 6, size 2).
+	delta := []byte{12, 11, 0x90, 5, 4, ' ', 'b', 'i', 'g', 0x91, 6, 2}
+	got, err := applyDelta(base, delta)
+	if err != nil || string(got) != "hello big w" {
+		t.Errorf("applyDelta = %q, %v", got, err)
+	}
+	if _, err := applyDelta(base, []byte{11, 5, 0x90, 5}); err == nil {
+		t.Errorf("applyDelta with wrong base size succeeded")
+	}
+	if _, err := applyDelta(base, []byte{12, 5, 0x91, 10, 5}); err == nil {
+		t.Errorf("applyDelta copying past base succeeded")
+	}
+	if _, err := applyDelta(base, []byte{12, 5, 0x90, 6}); err == nil {
+		t.Errorf("applyDelta writing past result size succeeded")
+	}
+	// A hostile result size must not be allocated.
+	if _, err := applyDelta(base, []byte{12, 0xff, 0xff, 0xff, 0xff, 0x0f, 0x90, 5}); err == nil {
+		t.Errorf("applyDelta with huge result size succeeded")
+	}
+	if _, err := applyDelta(base, []byte{12, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}); err == nil {
+		t.Errorf("applyDelta with overlong result size succeeded")
+	}
+}
+
+func TestInflateSize(t *testing.T) {
+	f, err := ioutil.TempFile("", "git-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	z.Write([]byte("hello"))
+	z.Close()
+	f.Write(buf.Bytes())
+	p := &pack{name: f.Name(), f: f, length: int64(buf.Len())}
+
+	if data, err := p.inflate(0, 5); err != nil || string(data) != "hello" {
+		t.Errorf("inflate(0, 5) = %q, %v", data, err)
+	}
+	for _, size := range []int64{-1, 1 << 40} {
+		if _, err := p.inflate(0, size); err == nil {
+			t.Errorf("inflate(0, %d) succeeded", size)
+		}
+	}
+	if _, err := p.inflate(int64(buf.Len()), 5); err == nil {
+		t.Errorf("inflate past end of pack succeeded")
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Code search refers to a file in a commit by a name of the form
+// repo@rev:path, where repo is the directory of the repository, rev
+// the revision as given to Resolve, and path the slash-separated path
+// of the file in the commit's tree.  The name repo@rev: stands for
+// the whole tree.
+
+// Name returns the name of the file with the given path
+// in revision rev of the repository in dir.
+func Name(dir, rev, path string) string {
+	return dir + "@" + rev + ":" + path
+}
+
+// SplitName splits a name returned by Name into its parts.
+// It reports whether name is such a name, which requires
+// that dir be a git repository.
+func SplitName(name string) (dir, rev, path string, ok bool) {
+	for i := 0; ; {
+		j := strings.Index(name[i:], "@")
+		if j < 0 {
+			return "", "", "", false
+		}
+		i += j
+		k := strings.Index(name[i:], ":")
+		if k < 0 {
+			return "", "", "", false
+		}
+		dir, rev, path = name[:i], name[i+1:i+k], name[i+k+1:]
+		if dir != "" && rev != "" && IsRepo(dir) {
+			return dir, rev, path, true
+		}
+		i++
+	}
+}
+
+// A Source is a source.Source holding the files in git commits,
+// under names of the form returned by Name.  Its zero value is ready
+// to use.  It keeps the repositories it reads open, but it resolves
+// the revision anew for each call.
+//
+// The files in a commit have the commit time as their modification
+// time, so that an unchanged time means an unchanged commit.
+type Source struct {
+	mu    sync.Mutex
+	repos map[string]*Repo
+}
+
+// repo returns the cached repository for dir,
+// opening it again if reopen is set.
+func (s *Source) repo(dir string, reopen bool) (*Repo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.repos == nil {
+		s.repos = make(map[string]*Repo)
+	}
+	r := s.repos[dir]
+	if r == nil || reopen {
+		// Do not close an old r: other goroutines may be using it.
+		var err error
+		if r, err = Open(dir); err != nil {
+			return nil, err
+		}
+		s.repos[dir] = r
+	}
+	return r, nil
+}
+
+// do calls fn with the repository, commit and path for name.
+func (s *Source) do(op, name string, fn func(r *Repo, commit Hash, mtime time.Time, path string) error) error {
+	dir, rev, path, ok := SplitName(name)
+	if !ok {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	var err error
+	for i := 0; i < 2; i++ {
+		// The first failure might be due to a repack
+		// since the repository was opened: retry once.
+		var r *Repo
+		var commit Hash
+		var mtime time.Time
+		if r, err = s.repo(dir, i > 0); err != nil {
+			continue
+		}
+		if commit, err = r.Resolve(rev); err != nil {
+			continue
+		}
+		if mtime, err = r.CommitTime(commit); err != nil {
+			continue
+		}
+		if err = fn(r, commit, mtime, path); err == nil || os.IsNotExist(err) {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		err = &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// Open opens the named file for reading.  The returned
+// reader has a Stat method.
+func (s *Source) Open(name string) (io.ReadCloser, error) {
+	var f *file
+	err := s.do("open", name, func(r *Repo, commit Hash, mtime time.Time, p string) error {
+		data, err := r.ReadFile(commit, p)
+		if err != nil {
+			return err
+		}
+		f = &file{bytes.NewReader(data), fileInfo{path.Base(p), int64(len(data)), mtime, false}}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stat returns information about the named file or directory.
+func (s *Source) Stat(name string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := s.do("stat", name, func(r *Repo, commit Hash, mtime time.Time, p string) error {
+		e, err := r.lookup(commit, p)
+		if err != nil {
+			return err
+		}
+		fi, err = r.info(e, path.Base(p), mtime)
+		return err
+	})
+	return fi, err
+}
+
+// info returns the information for the tree entry e.
+func (r *Repo) info(e treeEntry, name string, mtime time.Time) (os.FileInfo, error) {
+	switch {
+	case e.mode == 040000:
+		return &fileInfo{name, 0, mtime, true}, nil
+	case e.mode&0170000 == 0100000:
+		size, err := r.Size(e.hash)
+		if err != nil {
+			return nil, err
+		}
+		return &fileInfo{name, size, mtime, false}, nil
+	}
+	// Symbolic links and submodules.
+	return nil, os.ErrNotExist
+}
+
+// List calls fn for the directories and regular files in the tree named
+// by root, which can be a whole commit, named by Name(dir, rev, "").
+func (s *Source) List(root string, fn filepath.WalkFunc) error {
+	var walkErr error
+	err := s.do("list", root, func(r *Repo, commit Hash, mtime time.Time, p string) error {
+		e, err := r.lookup(commit, p)
+		if err != nil {
+			return err
+		}
+		fi, err := r.info(e, path.Base(p), mtime)
+		if err != nil {
+			return err
+		}
+		// Errors from fn end the walk but must not cause a retry.
+		walkErr = r.walkTree(root, e, fi, mtime, fn)
+		return nil
+	})
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	return walkErr
+}
+
+// walkTree calls fn for name, whose tree entry is e and
+// information fi, and for the tree below it, as filepath.Walk does.
+func (r *Repo) walkTree(name string, e treeEntry, fi os.FileInfo, mtime time.Time, fn filepath.WalkFunc) error {
+	err := fn(name, fi, nil)
+	if !fi.IsDir() || err != nil {
+		if err == filepath.SkipDir && fi.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	entries, err := r.readTree(e.hash)
+	if err != nil {
+		return fn(name, fi, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	sep := "/"
+	if strings.HasSuffix(name, ":") {
+		sep = ""
+	}
+	for _, x := range entries {
+		xfi, err := r.info(x, x.name, mtime)
+		if err == os.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			if err := fn(name+sep+x.name, nil, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := r.walkTree(name+sep+x.name, x, xfi, mtime, fn); err != nil {
+			if err == filepath.SkipDir && !xfi.IsDir() {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// A file is a file opened by Source.Open.
+type file struct {
+	*bytes.Reader
+	info fileInfo
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	return &f.info, nil
+}
+
+// A fileInfo implements os.FileInfo for a file or directory in a commit.
+type fileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	isDir bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.isDir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
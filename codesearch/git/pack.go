@@ -0,0 +1,469 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package git
+
+// Pack files.
+//
+// A pack file holds a sequence of zlib-compressed objects, each
+// preceded by a header giving its type and uncompressed size.  Objects
+// can be stored as deltas against a base object, named either by its
+// offset earlier in the pack (OFS_DELTA) or by its hash (REF_DELTA).
+// The accompanying index file maps object names to pack offsets:
+//
+//	"\377tOc" [4]
+//	version [4], = 2
+//	fanout [256*4]: number of objects whose first byte is <= i
+//	names [n*20]: sorted object names
+//	crc32s [n*4]
+//	offsets [n*4]: pack offsets, or, with the high bit set,
+//		indexes into the large offset table
+//	large offsets [m*8]
+//
+// Version 1 index files have no header and hold, after the fanout
+// table, entries of the form offset[4] name[20].
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// A pack is an open pack file and its index.
+type pack struct {
+	name    string
+	f       *os.File
+	idx     []byte
+	version int
+	n       int   // number of objects
+	length  int64 // size of the pack file
+}
+
+const (
+	objCommit   = 1
+	objTree     = 2
+	objBlob     = 3
+	objTag      = 4
+	objOfsDelta = 6
+	objRefDelta = 7
+)
+
+var typeNames = [...]string{
+	objCommit: Commit,
+	objTree:   Tree,
+	objBlob:   Blob,
+	objTag:    Tag,
+}
+
+// openPack opens the pack file with the given index file.
+func openPack(idxFile string) (*pack, error) {
+	idx, err := ioutil.ReadFile(idxFile)
+	if err != nil {
+		return nil, err
+	}
+	p := &pack{name: strings.TrimSuffix(idxFile, ".idx") + ".pack", idx: idx, version: 1}
+	fanout := idx
+	if len(idx) >= 8 && string(idx[:4]) == "\377tOc" {
+		p.version = int(binary.BigEndian.Uint32(idx[4:]))
+		if p.version != 2 {
+			return nil, fmt.Errorf("%s: unsupported version %d", idxFile, p.version)
+		}
+		fanout = idx[8:]
+	}
+	if len(fanout) < 256*4 {
+		return nil, fmt.Errorf("%s: malformed pack index", idxFile)
+	}
+	p.n = int(binary.BigEndian.Uint32(fanout[255*4:]))
+	need := 256*4 + p.n*24
+	if p.version == 2 {
+		need = 8 + 256*4 + p.n*28
+	}
+	if len(idx) < need {
+		return nil, fmt.Errorf("%s: malformed pack index", idxFile)
+	}
+	p.f, err = os.Open(p.name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := p.f.Stat()
+	if err != nil {
+		p.f.Close()
+		return nil, err
+	}
+	p.length = fi.Size()
+	return p, nil
+}
+
+func (p *pack) close() error {
+	return p.f.Close()
+}
+
+// fanout returns entry i of the fanout table.
+func (p *pack) fanout(i int) int {
+	off := 4 * i
+	if p.version == 2 {
+		off += 8
+	}
+	return int(binary.BigEndian.Uint32(p.idx[off:]))
+}
+
+// hash returns the name of the i'th object in the index.
+func (p *pack) hash(i int) []byte {
+	if p.version == 2 {
+		off := 8 + 256*4 + i*20
+		return p.idx[off : off+20]
+	}
+	off := 256*4 + i*24 + 4
+	return p.idx[off : off+20]
+}
+
+// offset returns the pack offset of the i'th object in the index.
+func (p *pack) offset(i int) int64 {
+	if p.version == 1 {
+		return int64(binary.BigEndian.Uint32(p.idx[256*4+i*24:]))
+	}
+	base := 8 + 256*4 + p.n*24
+	off := binary.BigEndian.Uint32(p.idx[base+i*4:])
+	if off&0x80000000 == 0 {
+		return int64(off)
+	}
+	large := base + p.n*4 + int(off&0x7fffffff)*8
+	if large+8 > len(p.idx) {
+		return -1
+	}
+	return int64(binary.BigEndian.Uint64(p.idx[large:]))
+}
+
+// find returns the pack offset of the object h.
+func (p *pack) find(h Hash) (int64, bool) {
+	lo := 0
+	if h[0] > 0 {
+		lo = p.fanout(int(h[0]) - 1)
+	}
+	hi := p.fanout(int(h[0]))
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		switch c := bytes.Compare(p.hash(m), h[:]); {
+		case c == 0:
+			return p.offset(m), true
+		case c < 0:
+			lo = m + 1
+		default:
+			hi = m
+		}
+	}
+	return 0, false
+}
+
+// withPrefix returns the names of the objects in p
+// that begin with the given hexadecimal prefix.
+func (p *pack) withPrefix(prefix string) []Hash {
+	b, err := hex.DecodeString(prefix[:2])
+	if err != nil {
+		return nil
+	}
+	lo := 0
+	if b[0] > 0 {
+		lo = p.fanout(int(b[0]) - 1)
+	}
+	hi := p.fanout(int(b[0]))
+	var x []Hash
+	for i := lo; i < hi; i++ {
+		var h Hash
+		copy(h[:], p.hash(i))
+		if strings.HasPrefix(h.String(), prefix) {
+			x = append(x, h)
+		}
+	}
+	return x
+}
+
+// A cacheKey identifies an object in a pack.
+type cacheKey struct {
+	p   *pack
+	off int64
+}
+
+// maxCache is the most data the object cache holds.
+const maxCache = 32 << 20
+
+// unpack returns the type and contents of the object at offset off in p.
+func (r *Repo) unpack(p *pack, off int64) (typ string, data []byte, err error) {
+	t, data, err := r.unpackAt(p, off, 0)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: offset %d: %v", p.name, off, err)
+	}
+	return typeNames[t], data, nil
+}
+
+func (r *Repo) unpackAt(p *pack, off int64, depth int) (typ int, data []byte, err error) {
+	if depth > 100 {
+		return 0, nil, fmt.Errorf("delta chain too long")
+	}
+	hdr, err := p.header(off)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var baseType int
+	var base []byte
+	switch hdr.typ {
+	case objCommit, objTree, objBlob, objTag:
+		data, err = p.inflate(hdr.data, hdr.size)
+		return hdr.typ, data, err
+
+	case objOfsDelta:
+		baseType, base, err = r.cachedUnpack(p, hdr.baseOff, depth)
+
+	case objRefDelta:
+		if baseOff, ok := p.find(hdr.baseHash); ok {
+			baseType, base, err = r.cachedUnpack(p, baseOff, depth)
+		} else {
+			var t string
+			t, base, err = r.Object(hdr.baseHash)
+			for bt, name := range typeNames {
+				if name == t && t != "" {
+					baseType = bt
+				}
+			}
+		}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	delta, err := p.inflate(hdr.data, hdr.size)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err = applyDelta(base, delta)
+	return baseType, data, err
+}
+
+// An objHeader is the header of an object in a pack.
+type objHeader struct {
+	typ      int
+	size     int64 // size of the object, or of the delta
+	data     int64 // offset of the compressed data
+	baseOff  int64 // delta base, for objOfsDelta
+	baseHash Hash  // delta base, for objRefDelta
+}
+
+// header returns the header of the object at offset off in p.
+func (p *pack) header(off int64) (objHeader, error) {
+	var h objHeader
+	var buf [32]byte
+	n, err := p.f.ReadAt(buf[:], off)
+	if n == 0 {
+		return h, err
+	}
+	h.typ = int(buf[0]>>4) & 7
+	h.size = int64(buf[0] & 15)
+	i := 1
+	for shift := uint(4); buf[i-1]&0x80 != 0; shift += 7 {
+		if i >= n || shift > 56 {
+			return h, fmt.Errorf("malformed object header")
+		}
+		h.size |= int64(buf[i]&0x7f) << shift
+		i++
+	}
+	switch h.typ {
+	case objCommit, objTree, objBlob, objTag:
+		// ok
+
+	case objOfsDelta:
+		// Offset encoding: each continuation adds 1 before shifting.
+		if i >= n {
+			return h, fmt.Errorf("malformed delta header")
+		}
+		c := buf[i]
+		i++
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if i >= n {
+				return h, fmt.Errorf("malformed delta header")
+			}
+			c = buf[i]
+			i++
+			rel = (rel+1)<<7 | int64(c&0x7f)
+		}
+		h.baseOff = off - rel
+		if h.baseOff <= 0 || h.baseOff >= off {
+			return h, fmt.Errorf("invalid delta base offset")
+		}
+
+	case objRefDelta:
+		if i+20 > n {
+			return h, fmt.Errorf("malformed delta header")
+		}
+		copy(h.baseHash[:], buf[i:i+20])
+		i += 20
+
+	default:
+		return h, fmt.Errorf("unknown object type %d", h.typ)
+	}
+	h.data = off + int64(i)
+	return h, nil
+}
+
+// size returns the size of the object at offset off in p.
+// For a delta, that is the result size recorded in the delta.
+func (p *pack) size(off int64) (int64, error) {
+	h, err := p.header(off)
+	if err != nil {
+		return 0, err
+	}
+	if h.typ != objOfsDelta && h.typ != objRefDelta {
+		return h.size, nil
+	}
+	z, err := zlib.NewReader(io.NewSectionReader(p.f, h.data, p.length-h.data))
+	if err != nil {
+		return 0, err
+	}
+	defer z.Close()
+	// Two varints: the base size and the result size.
+	var buf [20]byte
+	n, _ := io.ReadFull(z, buf[:])
+	b := buf[:n]
+	var size int64
+	for v := 0; v < 2; v++ {
+		size = 0
+		for shift := uint(0); ; shift += 7 {
+			if len(b) == 0 || shift > 56 {
+				return 0, fmt.Errorf("malformed delta")
+			}
+			c := b[0]
+			b = b[1:]
+			size |= int64(c&0x7f) << shift
+			if c&0x80 == 0 {
+				break
+			}
+		}
+	}
+	return size, nil
+}
+
+// cachedUnpack is unpackAt for delta bases, which are often shared.
+func (r *Repo) cachedUnpack(p *pack, off int64, depth int) (int, []byte, error) {
+	key := cacheKey{p, off}
+	r.mu.Lock()
+	data, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok {
+		return int(data[0]), data[1:], nil
+	}
+	typ, data, err := r.unpackAt(p, off, depth+1)
+	if err != nil {
+		return 0, nil, err
+	}
+	r.mu.Lock()
+	if r.size+len(data) > maxCache || r.cache == nil {
+		r.cache = make(map[cacheKey][]byte)
+		r.size = 0
+	}
+	r.cache[key] = append([]byte{byte(typ)}, data...)
+	r.size += len(data) + 1
+	r.mu.Unlock()
+	return typ, data, nil
+}
+
+// maxRatio is the most that zlib can compress data by.
+const maxRatio = 1032
+
+// inflate returns the size bytes of data that are
+// zlib-compressed at offset off in the pack file.
+func (p *pack) inflate(off, size int64) ([]byte, error) {
+	// A size that the rest of the pack cannot hold is corrupt;
+	// do not allocate it.
+	if size < 0 || off >= p.length || size/maxRatio > p.length-off {
+		return nil, fmt.Errorf("%s: object at offset %d has impossible size %d", p.name, off, size)
+	}
+	z, err := zlib.NewReader(io.NewSectionReader(p.f, off, p.length-off))
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(z, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// applyDelta returns the result of applying delta to base.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	errBad := fmt.Errorf("malformed delta")
+	// varint returns -1 for a truncated or oversized varint.
+	varint := func() int {
+		n, shift := 0, uint(0)
+		for {
+			if len(delta) == 0 || shift > 28 {
+				return -1
+			}
+			c := delta[0]
+			delta = delta[1:]
+			n |= int(c&0x7f) << shift
+			shift += 7
+			if c&0x80 == 0 {
+				return n
+			}
+		}
+	}
+	if varint() != len(base) {
+		return nil, errBad
+	}
+	// Each byte of delta yields at most 0x10000 bytes of result,
+	// which bounds a plausible result size.
+	size := varint()
+	if size < 0 || size/0x10000 > len(delta) {
+		return nil, errBad
+	}
+	out := make([]byte, 0, size)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		if op&0x80 == 0 {
+			// Insert the next op bytes.
+			if op == 0 || int(op) > len(delta) || len(out)+int(op) > cap(out) {
+				return nil, errBad
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+			continue
+		}
+		// Copy from base: the low 4 bits say which offset bytes
+		// are present, the next 3 which size bytes.
+		var off, n int
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+			if len(delta) == 0 {
+				return nil, errBad
+			}
+			if i < 4 {
+				off |= int(delta[0]) << (8 * i)
+			} else {
+				n |= int(delta[0]) << (8 * (i - 4))
+			}
+			delta = delta[1:]
+		}
+		if n == 0 {
+			n = 0x10000
+		}
+		if off+n > len(base) || len(out)+n > cap(out) {
+			return nil, errBad
+		}
+		out = append(out, base[off:off+n]...)
+	}
+	if len(out) != cap(out) {
+		return nil, errBad
+	}
+	return out, nil
+}
@@ -0,0 +1,555 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package git reads files from the object store of a git repository,
+// so that code search can index and search a commit without
+// checking it out.
+//
+// It understands loose objects and pack files, but not the
+// newer formats such as reftables or SHA-256 repositories.
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Hash is the SHA-1 name of a git object.
+type Hash [20]byte
+
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// ParseHash parses a 40-digit hexadecimal object name.
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	if len(s) != 2*len(h) {
+		return h, fmt.Errorf("invalid object name %q", s)
+	}
+	if _, err := hex.Decode(h[:], []byte(s)); err != nil {
+		return h, fmt.Errorf("invalid object name %q", s)
+	}
+	return h, nil
+}
+
+// Object types.
+const (
+	Commit = "commit"
+	Tree   = "tree"
+	Blob   = "blob"
+	Tag    = "tag"
+)
+
+// A Repo is a git repository opened for reading.
+// It is safe for concurrent use by multiple goroutines.
+type Repo struct {
+	gitDir    string // holds HEAD
+	commonDir string // holds objects and refs; same as gitDir except in worktrees
+
+	packs []*pack
+
+	mu    sync.Mutex
+	cache map[cacheKey][]byte // recently unpacked objects, for delta bases
+	size  int                 // total size of cache
+}
+
+// Open opens the git repository in dir, which can be the top
+// of a work tree, its .git directory, or a bare repository.
+func Open(dir string) (*Repo, error) {
+	gitDir, err := findGitDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &Repo{gitDir: gitDir, commonDir: gitDir}
+	if b, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		c := strings.TrimSpace(string(b))
+		if !filepath.IsAbs(c) {
+			c = filepath.Join(gitDir, c)
+		}
+		r.commonDir = c
+	}
+	idx, _ := filepath.Glob(filepath.Join(r.commonDir, "objects", "pack", "pack-*.idx"))
+	sort.Strings(idx)
+	for _, name := range idx {
+		p, err := openPack(name)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.packs = append(r.packs, p)
+	}
+	return r, nil
+}
+
+// findGitDir returns the git directory for dir.
+func findGitDir(dir string) (string, error) {
+	dotgit := filepath.Join(dir, ".git")
+	if fi, err := os.Stat(dotgit); err == nil {
+		if fi.IsDir() {
+			return dotgit, nil
+		}
+		// A file pointing at the real git directory,
+		// as in linked work trees and submodules.
+		b, err := ioutil.ReadFile(dotgit)
+		if err != nil {
+			return "", err
+		}
+		s := strings.TrimSpace(string(b))
+		if !strings.HasPrefix(s, "gitdir: ") {
+			return "", fmt.Errorf("%s: invalid .git file", dotgit)
+		}
+		s = strings.TrimPrefix(s, "gitdir: ")
+		if !filepath.IsAbs(s) {
+			s = filepath.Join(dir, s)
+		}
+		return s, nil
+	}
+	if isGitDir(dir) {
+		return dir, nil
+	}
+	return "", fmt.Errorf("%s: not a git repository", dir)
+}
+
+// isGitDir reports whether dir looks like a git directory.
+func isGitDir(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(dir, "objects"))
+	if err != nil {
+		// Linked work trees keep their objects elsewhere.
+		_, err = os.Stat(filepath.Join(dir, "commondir"))
+		return err == nil
+	}
+	return fi.IsDir()
+}
+
+// IsRepo reports whether dir is a git repository that Open can open.
+func IsRepo(dir string) bool {
+	_, err := findGitDir(dir)
+	return err == nil
+}
+
+// Close releases the files held open by r.
+func (r *Repo) Close() error {
+	var err error
+	for _, p := range r.packs {
+		if err1 := p.close(); err == nil {
+			err = err1
+		}
+	}
+	r.packs = nil
+	return err
+}
+
+// Resolve returns the commit named by rev, which can be a full or
+// abbreviated object name, a reference name like "HEAD", "main",
+// "v1.0" or "refs/heads/main", or an annotated tag.
+func (r *Repo) Resolve(rev string) (Hash, error) {
+	h, err := r.resolveName(rev)
+	if err != nil {
+		return h, err
+	}
+	// Peel annotated tags.
+	for {
+		typ, data, err := r.Object(h)
+		if err != nil {
+			return h, err
+		}
+		switch typ {
+		case Commit:
+			return h, nil
+		case Tag:
+			if h, err = header(data, "object"); err != nil {
+				return h, err
+			}
+		default:
+			return h, fmt.Errorf("%s: %s is a %s, not a commit", rev, h, typ)
+		}
+	}
+}
+
+// resolveName returns the object named by rev.
+func (r *Repo) resolveName(rev string) (Hash, error) {
+	if h, err := ParseHash(rev); err == nil {
+		return h, nil
+	}
+	// The search order of git rev-parse.
+	for _, ref := range []string{
+		rev,
+		"refs/" + rev,
+		"refs/tags/" + rev,
+		"refs/heads/" + rev,
+		"refs/remotes/" + rev,
+		"refs/remotes/" + rev + "/HEAD",
+	} {
+		if h, ok := r.ref(ref, 0); ok {
+			return h, nil
+		}
+	}
+	if h, ok := r.abbrev(rev); ok {
+		return h, nil
+	}
+	return Hash{}, fmt.Errorf("unknown revision %q", rev)
+}
+
+// ref returns the object that the reference ref points at,
+// following symbolic references up to a small depth.
+func (r *Repo) ref(ref string, depth int) (Hash, bool) {
+	if depth > 5 || strings.Contains(ref, "..") {
+		return Hash{}, false
+	}
+	dir := r.commonDir
+	if !strings.HasPrefix(ref, "refs/") {
+		dir = r.gitDir // HEAD and other per-worktree refs
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(ref))); err == nil {
+		s := strings.TrimSpace(string(b))
+		if strings.HasPrefix(s, "ref: ") {
+			return r.ref(strings.TrimPrefix(s, "ref: "), depth+1)
+		}
+		h, err := ParseHash(s)
+		return h, err == nil
+	}
+	return r.packedRef(ref)
+}
+
+// packedRef looks up ref in the packed-refs file.
+func (r *Repo) packedRef(ref string) (Hash, bool) {
+	f, err := os.Open(filepath.Join(r.commonDir, "packed-refs"))
+	if err != nil {
+		return Hash{}, false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+			continue
+		}
+		if i := strings.Index(line, " "); i >= 0 && line[i+1:] == ref {
+			h, err := ParseHash(line[:i])
+			return h, err == nil
+		}
+	}
+	return Hash{}, false
+}
+
+// abbrev returns the single object whose name begins with the
+// hexadecimal prefix, if there is one.
+func (r *Repo) abbrev(prefix string) (Hash, bool) {
+	if len(prefix) < 4 || len(prefix) >= 40 {
+		return Hash{}, false
+	}
+	if _, err := strconv.ParseUint(prefix[:4], 16, 16); err != nil {
+		return Hash{}, false
+	}
+	prefix = strings.ToLower(prefix)
+	found := make(map[Hash]bool)
+	names, _ := ioutil.ReadDir(filepath.Join(r.commonDir, "objects", prefix[:2]))
+	for _, fi := range names {
+		if s := prefix[:2] + fi.Name(); strings.HasPrefix(s, prefix) {
+			if h, err := ParseHash(s); err == nil {
+				found[h] = true
+			}
+		}
+	}
+	for _, p := range r.packs {
+		for _, h := range p.withPrefix(prefix) {
+			found[h] = true
+		}
+	}
+	if len(found) != 1 {
+		return Hash{}, false
+	}
+	for h := range found {
+		return h, true
+	}
+	panic("unreachable")
+}
+
+// CommitTime returns the committer time of commit.
+func (r *Repo) CommitTime(commit Hash) (time.Time, error) {
+	typ, data, err := r.Object(commit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if typ != Commit {
+		return time.Time{}, fmt.Errorf("%s is a %s, not a commit", commit, typ)
+	}
+	// committer Name <email> 1234567890 -0700
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break
+		}
+		if !strings.HasPrefix(line, "committer ") {
+			continue
+		}
+		f := strings.Fields(line[strings.LastIndex(line, ">")+1:])
+		if len(f) == 2 {
+			if sec, err := strconv.ParseInt(f[0], 10, 64); err == nil {
+				return time.Unix(sec, 0), nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s: malformed committer", commit)
+}
+
+// header returns the object named in the commit or tag header
+// line beginning with key.
+func header(data []byte, key string) (Hash, error) {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i <= 0 {
+			break
+		}
+		line := string(data[:i])
+		if strings.HasPrefix(line, key+" ") {
+			return ParseHash(line[len(key)+1:])
+		}
+		data = data[i+1:]
+	}
+	return Hash{}, fmt.Errorf("missing %s header", key)
+}
+
+// ErrNotFound is returned for objects that are not in the repository.
+var ErrNotFound = errors.New("object not found")
+
+// Object returns the type and contents of the object h.
+func (r *Repo) Object(h Hash) (typ string, data []byte, err error) {
+	for _, p := range r.packs {
+		if off, ok := p.find(h); ok {
+			return r.unpack(p, off)
+		}
+	}
+	return r.loose(h)
+}
+
+// Size returns the size of the object h.
+func (r *Repo) Size(h Hash) (int64, error) {
+	for _, p := range r.packs {
+		if off, ok := p.find(h); ok {
+			size, err := p.size(off)
+			if err != nil {
+				return 0, fmt.Errorf("%s: offset %d: %v", p.name, off, err)
+			}
+			return size, nil
+		}
+	}
+	s := h.String()
+	f, err := os.Open(filepath.Join(r.commonDir, "objects", s[:2], s[2:]))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("%s: %v", h, ErrNotFound)
+		}
+		return 0, err
+	}
+	defer f.Close()
+	z, err := zlib.NewReader(f)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", h, err)
+	}
+	defer z.Close()
+	// The header is "type size\x00".
+	var buf [32]byte
+	n, _ := io.ReadFull(z, buf[:])
+	b := buf[:n]
+	i := bytes.IndexByte(b, 0)
+	j := bytes.IndexByte(b, ' ')
+	if i < 0 || j < 0 || j > i {
+		return 0, fmt.Errorf("%s: malformed object", h)
+	}
+	size, err := strconv.ParseInt(string(b[j+1:i]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: malformed object", h)
+	}
+	return size, nil
+}
+
+// loose reads the loose object h.
+func (r *Repo) loose(h Hash) (typ string, data []byte, err error) {
+	s := h.String()
+	f, err := os.Open(filepath.Join(r.commonDir, "objects", s[:2], s[2:]))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("%s: %v", h, ErrNotFound)
+		}
+		return "", nil, err
+	}
+	defer f.Close()
+	z, err := zlib.NewReader(f)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", h, err)
+	}
+	defer z.Close()
+	b, err := ioutil.ReadAll(z)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", h, err)
+	}
+	i := bytes.IndexByte(b, 0)
+	j := bytes.IndexByte(b, ' ')
+	if i < 0 || j < 0 || j > i {
+		return "", nil, fmt.Errorf("%s: malformed object", h)
+	}
+	n, err := strconv.Atoi(string(b[j+1 : i]))
+	if err != nil || n != len(b)-i-1 {
+		return "", nil, fmt.Errorf("%s: malformed object", h)
+	}
+	return string(b[:j]), b[i+1:], nil
+}
+
+// A File is a file in a commit's tree.
+type File struct {
+	Path string // slash-separated path from the top of the tree
+	Hash Hash   // blob holding the contents
+	Mode uint32 // git file mode: 0100644 or 0100755
+}
+
+// Files returns the regular files in the tree of commit, sorted by path.
+// It omits symbolic links and submodules.
+func (r *Repo) Files(commit Hash) ([]File, error) {
+	tree, err := r.tree(commit)
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	if err := r.walk(tree, "", &files); err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// tree returns the root tree of commit.
+func (r *Repo) tree(commit Hash) (Hash, error) {
+	typ, data, err := r.Object(commit)
+	if err != nil {
+		return Hash{}, err
+	}
+	if typ != Commit {
+		return Hash{}, fmt.Errorf("%s is a %s, not a commit", commit, typ)
+	}
+	return header(data, "tree")
+}
+
+// walk appends the files in tree to files, prefixing their names with dir.
+func (r *Repo) walk(tree Hash, dir string, files *[]File) error {
+	entries, err := r.readTree(tree)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		switch {
+		case e.mode == 040000:
+			if err := r.walk(e.hash, dir+e.name+"/", files); err != nil {
+				return err
+			}
+		case e.mode&0170000 == 0100000:
+			*files = append(*files, File{dir + e.name, e.hash, e.mode})
+		}
+	}
+	return nil
+}
+
+// A treeEntry is an entry in a tree object.
+type treeEntry struct {
+	mode uint32
+	name string
+	hash Hash
+}
+
+// readTree returns the entries of the tree object h.
+func (r *Repo) readTree(h Hash) ([]treeEntry, error) {
+	typ, data, err := r.Object(h)
+	if err != nil {
+		return nil, err
+	}
+	if typ != Tree {
+		return nil, fmt.Errorf("%s is a %s, not a tree", h, typ)
+	}
+	var entries []treeEntry
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+1+len(Hash{}) {
+			return nil, fmt.Errorf("%s: malformed tree", h)
+		}
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed tree", h)
+		}
+		e := treeEntry{mode: uint32(mode), name: string(data[sp+1 : nul])}
+		copy(e.hash[:], data[nul+1:])
+		entries = append(entries, e)
+		data = data[nul+1+len(Hash{}):]
+	}
+	return entries, nil
+}
+
+// ReadFile returns the contents of the file with the given
+// slash-separated path in the tree of commit.
+func (r *Repo) ReadFile(commit Hash, path string) ([]byte, error) {
+	e, err := r.lookup(commit, path)
+	if err != nil {
+		return nil, err
+	}
+	if e.mode&0170000 != 0100000 {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	typ, data, err := r.Object(e.hash)
+	if err != nil {
+		return nil, err
+	}
+	if typ != Blob {
+		return nil, fmt.Errorf("%s is a %s, not a blob", e.hash, typ)
+	}
+	return data, nil
+}
+
+// lookup returns the tree entry for the file or directory with the
+// given slash-separated path in the tree of commit.  The path ""
+// names the root of the tree.
+func (r *Repo) lookup(commit Hash, path string) (treeEntry, error) {
+	h, err := r.tree(commit)
+	if err != nil {
+		return treeEntry{}, err
+	}
+	e := treeEntry{mode: 040000, hash: h}
+	if path == "" {
+		return e, nil
+	}
+	notExist := &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+Elems:
+	for _, elem := range strings.Split(path, "/") {
+		if e.mode != 040000 {
+			return treeEntry{}, notExist
+		}
+		entries, err := r.readTree(e.hash)
+		if err != nil {
+			return treeEntry{}, err
+		}
+		for _, x := range entries {
+			if x.name == elem {
+				e = x
+				continue Elems
+			}
+		}
+		return treeEntry{}, notExist
+	}
+	return e, nil
+}
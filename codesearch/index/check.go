@@ -0,0 +1,224 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+// Checking and inspecting indexes.
+//
+// Open and the methods of Index check only as much of the index as they
+// read, and they exit the program when they find damage.  Check instead
+// reads the whole index and returns the first damage it finds as an
+// error.  While it runs, Index.corrupt panics with a checkError, which
+// Check recovers, so that the usual accessors serve for checking too.
+// OpenShards opens indexes the same way.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// A checkError is the panic value of Index.corrupt during Check.
+type checkError string
+
+// catch, when deferred, recovers a checkError panic
+// and sets *err to describe the damage to file.
+func catch(file string, err *error) {
+	if e := recover(); e != nil {
+		ce, ok := e.(checkError)
+		if !ok {
+			panic(e)
+		}
+		*err = fmt.Errorf("%s: %s", file, string(ce))
+	}
+}
+
+// Check checks the structure of the index in file: the header and
+// trailer, the checksum, the order of the path and name lists and
+// their agreement with the name index, the posting lists and their
+// agreement with the posting list index, and the symbol and language
+// tables.  It returns nil if the index is sound or an error describing
+// the first damage found.
+func Check(file string) (err error) {
+	ix := &Index{name: file, data: mmap(file), checking: true}
+	defer ix.Close()
+	defer catch(file, &err)
+	ix.init()
+	if err := ix.Verify(); err != nil {
+		return err
+	}
+	ix.checkPaths()
+	ix.checkNames()
+	ix.checkPosting()
+	ix.checkSymbols()
+	for id := 0; id < ix.numName; id++ {
+		ix.Lang(uint32(id)) // checks the language code
+	}
+	return nil
+}
+
+// checkPaths checks that the path list is sorted and
+// ends where the name list begins.
+func (ix *Index) checkPaths() {
+	off := ix.pathData
+	var last []byte
+	for {
+		s := ix.str(off)
+		off += int64(len(s) + 1)
+		if len(s) == 0 {
+			break
+		}
+		if last != nil && bytes.Compare(s, last) <= 0 {
+			ix.corrupt("path %q follows %q", s, last)
+		}
+		last = s
+	}
+	if off != ix.nameData {
+		ix.corrupt("path list ends at offset %d, name list begins at %d", off, ix.nameData)
+	}
+}
+
+// checkNames checks that the name list is sorted, that the name index
+// points at each name in turn, and that the name list ends where the
+// posting lists begin.
+func (ix *Index) checkNames() {
+	off := ix.nameData
+	var last []byte
+	for i := 0; i <= ix.numName; i++ {
+		if x := ix.offset(ix.nameIndex + ix.offSize*int64(i)); ix.nameData+x != off {
+			ix.corrupt("name index entry %d is %d, want %d", i, x, off-ix.nameData)
+		}
+		s := ix.str(off)
+		off += int64(len(s) + 1)
+		if i == ix.numName {
+			if len(s) != 0 {
+				ix.corrupt("name list has more than %d names", ix.numName)
+			}
+			break
+		}
+		if len(s) == 0 {
+			ix.corrupt("name of file %d is empty", i)
+		}
+		if last != nil && bytes.Compare(s, last) < 0 {
+			ix.corrupt("name %q of file %d follows %q", s, i, last)
+		}
+		last = s
+	}
+	if off != ix.postData {
+		ix.corrupt("name list ends at offset %d, posting lists begin at %d", off, ix.postData)
+	}
+}
+
+// checkPosting checks that the posting list index is sorted by trigram
+// and describes each posting list in turn, that each posting list holds
+// increasing file IDs in range, and that the posting lists end with the
+// terminating list for trigram "\xff\xff\xff".
+func (ix *Index) checkPosting() {
+	if ix.numPost == 0 {
+		ix.corrupt("posting list index is empty")
+	}
+	var off int64
+	for i := 0; i < ix.numPost; i++ {
+		t, count, offset := ix.listAt(i)
+		if i > 0 {
+			if last, _, _ := ix.listAt(i - 1); t <= last {
+				ix.corrupt("posting list index entry %d for trigram %q follows %q", i, trigramString(t), trigramString(last))
+			}
+		}
+		if offset != off {
+			ix.corrupt("posting list index entry %d for trigram %q has offset %d, want %d", i, trigramString(t), offset, off)
+		}
+		if s := ix.slice(ix.postData+off, 3); string(s) != trigramString(t) {
+			ix.corrupt("posting list at offset %d is for trigram %q, index says %q", off, s, trigramString(t))
+		}
+		if t == 1<<24-1 {
+			if i != ix.numPost-1 || count != 0 {
+				ix.corrupt("misplaced terminating posting list")
+			}
+		} else if count == 0 {
+			ix.corrupt("empty posting list for trigram %q", trigramString(t))
+		}
+		r := postReader{
+			ix:      ix,
+			trigram: t,
+			count:   int(count),
+			fileid:  ^uint32(0),
+			d:       ix.slice(ix.postData+off+3, -1),
+		}
+		for last := -1; r.next(); last = int(r.fileid) {
+			if int(r.fileid) <= last || r.fileid >= uint32(ix.numName) {
+				ix.corrupt("posting list for trigram %q lists file %d of %d after file %d", trigramString(t), r.fileid, ix.numName, last)
+			}
+		}
+		// r.d now begins with the terminating zero delta.
+		off = int64(len(ix.data.d)) - int64(len(r.d)) + 1 - ix.postData
+	}
+	if t, _, _ := ix.listAt(ix.numPost - 1); t != 1<<24-1 {
+		ix.corrupt("posting lists are not terminated")
+	}
+	end := ix.nameIndex
+	for i := 0; i < ix.numSect; i++ {
+		if o := ix.offset(ix.sectIndex + int64(i)*ix.sectEntrySize + 4); o < end {
+			end = o
+		}
+	}
+	if ix.postData+off != end {
+		ix.corrupt("posting lists end at offset %d, next data begins at %d", ix.postData+off, end)
+	}
+}
+
+// A ListInfo describes a posting list.
+type ListInfo struct {
+	Trigram string // the trigram
+	Count   int    // number of files listed, including deleted ones
+	Size    int64  // size of the encoded list in bytes
+}
+
+// Lists returns descriptions of the posting lists in ix, in trigram
+// order.  It omits the list that terminates the posting lists.
+func (ix *Index) Lists() []ListInfo {
+	var x []ListInfo
+	for i := 0; i+1 < ix.numPost; i++ {
+		t, count, offset := ix.listAt(i)
+		_, _, next := ix.listAt(i + 1)
+		x = append(x, ListInfo{trigramString(t), int(count), next - offset})
+	}
+	return x
+}
+
+// checkSymbols checks that the symbol table is sorted, that its
+// index lists the offset of each entry, and that it lists only files
+// in the index.
+func (ix *Index) checkSymbols() {
+	syms, _ := ix.allSymbols()
+	d, x, indexed := ix.symbolIndex()
+	if indexed && len(x)/4 != len(syms) {
+		ix.corrupt("symbol index lists %d entries, symbol table has %d", len(x)/4, len(syms))
+	}
+	off := 0
+	for i := range syms {
+		s := &syms[i]
+		if s.Name == "" || s.FileID >= uint32(ix.numName) || s.Line <= 0 {
+			ix.corrupt("bad symbol table entry %q in file %d, line %d", s.Name, s.FileID, s.Line)
+		}
+		if indexed {
+			if o := binary.BigEndian.Uint32(x[4*i:]); int(o) != off {
+				ix.corrupt("symbol index lists entry %d at offset %d, not %d", i, o, off)
+			}
+			_, n := ix.symbolAt(d[off:])
+			off += n
+		}
+		if i > 0 {
+			p := &syms[i-1]
+			bad := symbolLess(s, p)
+			if !indexed {
+				// Older indexes sort by name alone.
+				bad = p.Name > s.Name || p.Name == s.Name && (p.FileID > s.FileID || p.FileID == s.FileID && p.Line > s.Line)
+			}
+			if bad {
+				ix.corrupt("symbol table entry %q follows %q", s.Name, p.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// damage returns index with the bytes at off replaced by s.
+func damage(index string, off int, s string) string {
+	return index[:off] + s + index[off+len(s):]
+}
+
+var checkTests = []struct {
+	index string
+	err   string // "" for no error
+}{
+	{trivialIndex, ""},
+	{trivialIndexV2, ""},
+	{trivialIndexV1, ""},
+	{trivialIndex[:len(trivialIndex)-1], "no trailer"},
+	{damage(trivialIndex, 16+1+38, "\nb"), "checksum mismatch"},
+	{damage(trivialIndexV2, 0, "csearch index 9"), "unsupported index format"},
+	{damage(trivialIndexV2, 16+1+7, "zz"), `name "file1" of file 2 follows "zz"`},
+	{damage(trivialIndexV2, 16+1+38+3, "\x7f"), "lists file 126 of 6"},
+	{damage(trivialIndexV2, 16+1+38+5+3, "\x00"), "bad posting list"},
+	{damage(trivialIndexV2, 16+1+38+5+3+2, "\x01"), "unterminated posting list"},
+	{damage(trivialIndexV2, 16+1+38+5, "xy"), `is for trigram "xyb", index says "\nab"`},
+	{damage(trivialIndexV1, 16+1+38+62+3, "\x08"), "name index entry 0 is 8, want 0"},
+}
+
+func TestCheck(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	f.Close()
+	defer os.Remove(f.Name())
+	for i, tt := range checkTests {
+		ioutil.WriteFile(f.Name(), []byte(tt.index), 0666)
+		err := Check(f.Name())
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("#%d: Check: %v", i, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("#%d: Check succeeded, want error %q", i, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("#%d: Check: %v, want error %q", i, err, tt.err)
+		}
+	}
+}
+
+func TestLists(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	f.WriteString(trivialIndex)
+	f.Close()
+	ix := Open(f.Name())
+	defer ix.Close()
+	l := ix.Lists()
+	if len(l) != 11 {
+		t.Fatalf("Lists() returned %d lists, want 11", len(l))
+	}
+	if l[0] != (ListInfo{"\na\n", 1, 5}) || l[5] != (ListInfo{"abc", 2, 6}) || l[10] != (ListInfo{"zw\n", 1, 5}) {
+		t.Errorf("Lists() = %v", l)
+	}
+}
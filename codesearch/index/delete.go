@@ -0,0 +1,175 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+// Deleting files from an index.
+//
+// Deleting a file does not touch the posting lists.  Instead, the
+// file's ID is added to the "dele" section, and readers filter
+// deleted IDs out of every posting list they return.  The next Merge
+// or Update drops the deleted files for good.
+//
+// Writing the new index copies the name list and posting lists
+// verbatim; only the path list, the sections and the trailer change.
+// The name index and posting list index hold offsets relative to the
+// start of the name list and posting lists, so they stay valid too,
+// although they are rewritten if the index is in an older format
+// with 4-byte offsets.
+
+import (
+	"sort"
+	"strings"
+)
+
+// Delete creates a new index in the file dst that is a copy of the
+// index src in which the named files, and the files in the named
+// directory trees, are marked deleted.  Indexed paths that are deleted
+// in their entirety are dropped from the path list.
+// Delete returns the number of files it deleted.
+func Delete(dst, src string, paths []string) int {
+	ix := Open(src)
+	defer ix.Close()
+
+	deleted := append([]uint32(nil), ix.deleted...)
+	n := len(deleted)
+	for _, path := range paths {
+		deleted = append(deleted, ix.FilesUnder(path)...)
+	}
+	deleted = uniq(deleted)
+	n = len(deleted) - n
+
+	var keep []string
+	for _, p := range ix.Paths() {
+		if !Under(p, paths) {
+			keep = append(keep, p)
+		}
+	}
+
+	ix.rewrite(dst, keep, deleted)
+	return n
+}
+
+// FilesUnder returns the IDs of the live files named path
+// or contained in the directory tree named path.
+func (ix *Index) FilesUnder(path string) []uint32 {
+	i := sort.Search(ix.numName, func(i int) bool {
+		return string(ix.NameBytes(uint32(i))) >= path
+	})
+	var x []uint32
+	for ; i < ix.numName; i++ {
+		name := ix.Name(uint32(i))
+		if !strings.HasPrefix(name, path) {
+			break
+		}
+		if Under(name, []string{path}) && !ix.Deleted(uint32(i)) {
+			x = append(x, uint32(i))
+		}
+	}
+	return x
+}
+
+// Under reports whether name is one of paths or is
+// contained in the directory tree named by one of them.
+// A path ending in a colon, like repo@rev: for a git commit,
+// names the tree of all the names it prefixes, and an archive
+// contains its members, named archive!/member.
+func Under(name string, paths []string) bool {
+	for _, p := range paths {
+		if name == p || strings.HasPrefix(name, p) && (strings.HasSuffix(p, "/") || strings.HasSuffix(p, ":") || name[len(p)] == '/' || strings.HasPrefix(name[len(p):], "!/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// uniq sorts x and removes duplicates, reusing x's storage.
+func uniq(x []uint32) []uint32 {
+	sort.Slice(x, func(i, j int) bool { return x[i] < x[j] })
+	w := 0
+	for i, v := range x {
+		if i == 0 || v != x[w-1] {
+			x[w] = v
+			w++
+		}
+	}
+	return x[:w]
+}
+
+// rewrite writes to dst a copy of ix with the given path list and
+// list of deleted file IDs.
+func (ix *Index) rewrite(dst string, paths []string, deleted []uint32) {
+	// The posting lists end where the first section
+	// or, if there are none, the name index begins.
+	postEnd := ix.nameIndex
+	var tags []string
+	for i := 0; i < ix.numSect; i++ {
+		tag := string(ix.slice(ix.sectIndex+int64(i)*ix.sectEntrySize, 4))
+		off, _, _ := ix.section(tag)
+		if off < postEnd {
+			postEnd = off
+		}
+		if tag != "dele" {
+			tags = append(tags, tag)
+		}
+	}
+
+	out := bufCreate(dst)
+	out.writeString(magic)
+	pathData := out.offset()
+	for _, p := range paths {
+		out.writeString(p)
+		out.writeString("\x00")
+	}
+	out.writeString("\x00")
+
+	nameData := out.offset()
+	out.write(ix.slice(ix.nameData, int(ix.postData-ix.nameData)))
+	postData := out.offset()
+	out.write(ix.slice(ix.postData, int(postEnd-ix.postData)))
+
+	var sect sectionWriter
+	for _, tag := range tags {
+		off, size, _ := ix.section(tag)
+		sect.add(out, tag, ix.slice(off, int(size)))
+	}
+	if len(deleted) > 0 {
+		d := make([]byte, 0, 4*len(deleted))
+		for _, id := range deleted {
+			d = append(d, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+		}
+		sect.add(out, "dele", d)
+	}
+
+	nameIndex := out.offset()
+	postIndex := int64(0)
+	if ix.version == FormatVersion {
+		out.write(ix.slice(ix.nameIndex, int(ix.postIndex-ix.nameIndex)))
+		postIndex = out.offset()
+		out.write(ix.slice(ix.postIndex, int(ix.sectIndex-ix.postIndex)))
+	} else {
+		for i := 0; i <= ix.numName; i++ {
+			out.writeUint64(uint64(ix.offset(ix.nameIndex + int64(i)*ix.offSize)))
+		}
+		postIndex = out.offset()
+		for i := 0; i < ix.numPost; i++ {
+			t, count, offset := ix.listAt(i)
+			out.writeTrigram(t)
+			out.writeUint32(count)
+			out.writeUint64(uint64(offset))
+		}
+	}
+	sectIndex := out.offset()
+	sect.writeIndex(out)
+	writeTrailer(out, [6]int64{pathData, nameData, postData, nameIndex, postIndex, sectIndex})
+	out.close()
+}
+
+// Upgrade creates a new index in the file dst that is a copy
+// of the index src in the current format, FormatVersion.
+func Upgrade(dst, src string) {
+	ix := Open(src)
+	defer ix.Close()
+	ix.rewrite(dst, ix.Paths(), ix.deleted)
+}
@@ -0,0 +1,116 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDelete(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	f4, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+	defer os.Remove(f4.Name())
+
+	out1 := f1.Name()
+	out2 := f2.Name()
+	out3 := f3.Name()
+	out4 := f4.Name()
+
+	buildIndex(out1, mergePaths1, mergeFiles1)
+	if n := Delete(out2, out1, []string{"/a/y", "/c", "/b/x"}); n != 3 {
+		t.Errorf("Delete deleted %d files, want 3", n)
+	}
+
+	if err := Check(out2); err != nil {
+		t.Errorf("Check(index after Delete): %v", err)
+	}
+
+	ix := Open(out2)
+	if p := ix.Paths(); !reflect.DeepEqual(p, []string{"/a", "/b"}) {
+		t.Errorf("Paths() = %v, want [/a /b]", p)
+	}
+	if n := ix.NumDeleted(); n != 3 {
+		t.Errorf("NumDeleted() = %d, want 3", n)
+	}
+	if _, ok := ix.Lookup("/a/y"); ok {
+		t.Errorf("Lookup(/a/y) found deleted file")
+	}
+	if id, ok := ix.Lookup("/b/xx"); !ok || id != 2 {
+		t.Errorf("Lookup(/b/xx) = %d, %v, want 2, true", id, ok)
+	}
+
+	check := func(ix *Index, trig string, l ...uint32) {
+		l1 := ix.PostingList(tri(trig[0], trig[1], trig[2]))
+		if !equalList(l1, l) {
+			t.Errorf("PostingList(%s) = %v, want %v", trig, l1, l)
+		}
+	}
+	check(ix, "wor", 0)
+	check(ix, "now", 2)
+	check(ix, "all", 3)
+	check(ix, "giv")
+	if l := ix.PostingQuery(&Query{Op: QAll}); !equalList(l, []uint32{0, 2, 3}) {
+		t.Errorf("PostingQuery(QAll) = %v, want [0 2 3]", l)
+	}
+
+	// Deleting again accumulates.
+	if n := Delete(out3, out2, []string{"/a"}); n != 1 {
+		t.Errorf("Delete deleted %d files, want 1", n)
+	}
+	ix = Open(out3)
+	check(ix, "wor")
+	check(ix, "now", 2)
+
+	// Merging compacts.
+	buildIndex(out4, mergePaths2, mergeFiles2)
+	Merge(out1, out3, out4)
+	ix = Open(out1)
+	want := []string{"/b/www", "/b/xx", "/b/yy", "/cc"}
+	if ix.NumFiles() != len(want) || ix.NumDeleted() != 0 {
+		t.Errorf("NumFiles(), NumDeleted() = %d, %d, want %d, 0", ix.NumFiles(), ix.NumDeleted(), len(want))
+	}
+	for i, s := range want {
+		if n := ix.Name(uint32(i)); n != s {
+			t.Errorf("Name(%d) = %s, want %s", i, n, s)
+		}
+	}
+	check(ix, "now", 1, 2)
+	check(ix, "pot", 2, 3)
+}
+
+var underTests = []struct {
+	name string
+	path string
+	ok   bool
+}{
+	{"/a/b", "/a", true},
+	{"/a", "/a", true},
+	{"/ab", "/a", false},
+	{"/a/b", "/a/", true},
+	{"/r@HEAD:x/y.go", "/r@HEAD:", true},
+	{"/r@HEAD:x/y.go", "/r@HEAD:x", true},
+	{"/r@HEAD:x/y.go", "/r", false},
+	{"/r@HEADS:x", "/r@HEAD", false},
+	{"/d/a.zip!/x/y.go", "/d/a.zip", true},
+	{"/d/a.zip!/x/y.go", "/d", true},
+	{"/d/a.zip!/x/y.go", "/d/a.zip!/x", true},
+	{"/d/a.zip!x", "/d/a.zip", false},
+}
+
+func TestUnder(t *testing.T) {
+	for _, tt := range underTests {
+		if ok := Under(tt.name, []string{tt.path}); ok != tt.ok {
+			t.Errorf("Under(%q, %q) = %v, want %v", tt.name, tt.path, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A FileFilter selects files by language and by name, so that a search
+// can drop the files it does not want before reading their names from
+// the index, let alone opening them.
+type FileFilter struct {
+	langs map[string]bool // languages to select; nil means any
+	globs []*glob         // globs to select; nil means any
+}
+
+// A glob is a compiled file name glob.
+type glob struct {
+	elems  []string // slash-separated elements; unanchored globs begin with **
+	prefix string   // literal prefix of the names a rooted glob matches
+	all    bool     // the glob matches every name with the prefix
+}
+
+// NewFileFilter returns a FileFilter that selects the files in any of
+// the given languages, as named by Languages, and with names matching
+// any of the given globs.  An empty list selects files regardless.
+//
+// The globs use the syntax of path.Match, applied to each slash-separated
+// element, with the addition that an element ** matches any number of
+// elements.  A glob beginning with a slash matches whole file names;
+// any other glob matches the trailing elements of a name, at any depth,
+// so that pkg/** selects the trees below every directory named pkg.
+func NewFileFilter(langs, globs []string) (*FileFilter, error) {
+	f := new(FileFilter)
+	if len(langs) > 0 {
+		known := make(map[string]bool)
+		for _, l := range Languages() {
+			known[l] = true
+		}
+		f.langs = make(map[string]bool)
+		for _, l := range langs {
+			if !known[l] {
+				return nil, fmt.Errorf("unknown language %q", l)
+			}
+			f.langs[l] = true
+		}
+	}
+	for _, s := range globs {
+		g, err := compileGlob(s)
+		if err != nil {
+			return nil, err
+		}
+		f.globs = append(f.globs, g)
+	}
+	return f, nil
+}
+
+// compileGlob compiles the glob s.
+func compileGlob(s string) (*glob, error) {
+	s = filepath.ToSlash(s)
+	g := new(glob)
+	rooted := strings.HasPrefix(s, "/")
+	elems := strings.Split(strings.Trim(s, "/"), "/")
+	for _, e := range elems {
+		if e == "" {
+			return nil, fmt.Errorf("invalid glob %q: empty element", s)
+		}
+		if _, err := path.Match(e, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", s, err)
+		}
+	}
+	if !rooted {
+		g.elems = append([]string{"**"}, elems...)
+		return g, nil
+	}
+	g.elems = elems
+	// The literal elements before the first one with
+	// a wildcard form a prefix that file IDs can be
+	// looked up by, as the names are sorted.
+	g.prefix = "/"
+	i := 0
+	for ; i < len(elems) && !hasMeta(elems[i]); i++ {
+		g.prefix += elems[i] + "/"
+	}
+	g.all = i == len(elems)-1 && elems[i] == "**"
+	return g, nil
+}
+
+// hasMeta reports whether the glob element e has wildcards.
+func hasMeta(e string) bool {
+	return strings.ContainsAny(e, `*?[\`)
+}
+
+// match reports whether g matches the file name.
+func (g *glob) match(name string) bool {
+	return matchElems(g.elems, strings.Split(strings.TrimPrefix(filepath.ToSlash(name), "/"), "/"))
+}
+
+// matchElems reports whether the glob elements pat
+// match the name elements name.
+func matchElems(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// FilterFiles returns the files in the list of file IDs
+// that f selects, reusing the list's storage.
+// A nil FileFilter selects all files.
+func (ix *Index) FilterFiles(list []uint32, f *FileFilter) []uint32 {
+	if f == nil || f.langs == nil && f.globs == nil {
+		return list
+	}
+
+	// Decide on languages by their codes, if recorded.
+	var wantCode []bool
+	if f.langs != nil && ix.langNames != nil {
+		wantCode = make([]bool, len(ix.langNames))
+		for i, l := range ix.langNames {
+			wantCode[i] = f.langs[l]
+		}
+	}
+
+	// Find the ranges of file IDs with the rooted globs' prefixes.
+	type idRange struct{ lo, hi uint32 }
+	ranges := make([]idRange, len(f.globs))
+	for i, g := range f.globs {
+		if g.prefix == "" {
+			continue
+		}
+		prefix := filepath.FromSlash(g.prefix)
+		lo := sort.Search(ix.numName, func(i int) bool {
+			return string(ix.NameBytes(uint32(i))) >= prefix
+		})
+		hi := lo + sort.Search(ix.numName-lo, func(i int) bool {
+			return !strings.HasPrefix(string(ix.NameBytes(uint32(lo+i))), prefix)
+		})
+		ranges[i] = idRange{uint32(lo), uint32(hi)}
+	}
+
+	out := list[:0]
+	for _, id := range list {
+		if f.langs != nil {
+			if wantCode != nil {
+				c := int(ix.langCodes[id])
+				if c >= len(wantCode) || !wantCode[c] {
+					continue
+				}
+			} else if !f.langs[ix.Lang(id)] {
+				continue
+			}
+		}
+		if f.globs != nil {
+			var name string
+			ok := false
+			for i, g := range f.globs {
+				if g.prefix != "" {
+					if id < ranges[i].lo || id >= ranges[i].hi {
+						continue
+					}
+					if g.all {
+						ok = true
+						break
+					}
+				}
+				if name == "" {
+					name = ix.Name(id)
+				}
+				if g.match(name) {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				continue
+			}
+		}
+		out = append(out, id)
+	}
+	return out
+}
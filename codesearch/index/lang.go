@@ -0,0 +1,259 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+// Languages.
+//
+// IndexWriter classifies each file it indexes by language, judging by
+// its name and, failing that, by the #! line at its start, and records
+// the result in the "lang" section, so that searches can be restricted
+// to files in a language without opening any.  The section begins with
+// the names of the languages used in the index, each NUL-terminated,
+// followed by an empty name, and then holds one byte per file ID: the
+// 1-based position of the file's language in the list, or 0 if the
+// file's language is unknown.  It is written only when some file's
+// language is known.
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// langExt maps file extensions to languages.
+var langExt = map[string]string{
+	".asm":   "asm",
+	".s":     "asm",
+	".S":     "asm",
+	".c":     "c",
+	".h":     "c",
+	".cc":    "cpp",
+	".cpp":   "cpp",
+	".cxx":   "cpp",
+	".hh":    "cpp",
+	".hpp":   "cpp",
+	".hxx":   "cpp",
+	".cs":    "csharp",
+	".css":   "css",
+	".ex":    "elixir",
+	".exs":   "elixir",
+	".erl":   "erlang",
+	".go":    "go",
+	".hs":    "haskell",
+	".htm":   "html",
+	".html":  "html",
+	".java":  "java",
+	".js":    "javascript",
+	".cjs":   "javascript",
+	".mjs":   "javascript",
+	".jsx":   "javascript",
+	".json":  "json",
+	".kt":    "kotlin",
+	".lua":   "lua",
+	".md":    "markdown",
+	".mk":    "make",
+	".m":     "objc",
+	".mm":    "objc",
+	".ml":    "ocaml",
+	".mli":   "ocaml",
+	".pl":    "perl",
+	".pm":    "perl",
+	".php":   "php",
+	".proto": "proto",
+	".py":    "python",
+	".rb":    "ruby",
+	".rs":    "rust",
+	".scala": "scala",
+	".sh":    "shell",
+	".bash":  "shell",
+	".zsh":   "shell",
+	".sql":   "sql",
+	".swift": "swift",
+	".toml":  "toml",
+	".ts":    "typescript",
+	".tsx":   "typescript",
+	".xml":   "xml",
+	".yaml":  "yaml",
+	".yml":   "yaml",
+}
+
+// langName maps whole file names to languages.
+var langName = map[string]string{
+	"Dockerfile":  "dockerfile",
+	"GNUmakefile": "make",
+	"Makefile":    "make",
+	"makefile":    "make",
+	"go.mod":      "gomod",
+}
+
+// langInterp maps the interpreters named in #! lines to languages.
+var langInterp = map[string]string{
+	"bash":   "shell",
+	"dash":   "shell",
+	"ksh":    "shell",
+	"sh":     "shell",
+	"zsh":    "shell",
+	"node":   "javascript",
+	"perl":   "perl",
+	"php":    "php",
+	"python": "python",
+	"ruby":   "ruby",
+}
+
+// Languages returns the sorted names of the languages
+// that IndexWriter can identify.
+func Languages() []string {
+	seen := make(map[string]bool)
+	for _, m := range []map[string]string{langExt, langName, langInterp} {
+		for _, l := range m {
+			seen[l] = true
+		}
+	}
+	var list []string
+	for l := range seen {
+		list = append(list, l)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Language returns the language of the file with the given name,
+// whose contents begin with head, or "" if it cannot tell.  It tries
+// the name first, so head may be nil.
+func Language(name string, head []byte) string {
+	// The base of a virtual name, like deps.tgz!/src/x.go,
+	// is that of the archive member or file in a commit.
+	name = filepath.ToSlash(name)
+	base := path.Base(name)
+	if l, ok := langName[base]; ok {
+		return l
+	}
+	if l, ok := langExt[path.Ext(base)]; ok {
+		return l
+	}
+	return interpLanguage(head)
+}
+
+// interpLanguage returns the language of the interpreter
+// named by the #! line at the start of head, or "".
+func interpLanguage(head []byte) string {
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return ""
+	}
+	line := head[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	f := strings.Fields(string(line))
+	if len(f) == 0 {
+		return ""
+	}
+	interp := path.Base(f[0])
+	if interp == "env" {
+		// #!/usr/bin/env [-S] interp
+		interp = ""
+		for _, arg := range f[1:] {
+			if !strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") {
+				interp = path.Base(arg)
+				break
+			}
+		}
+	}
+	// python3, perl5.30, and so on.
+	interp = strings.TrimRight(interp, "0123456789.")
+	return langInterp[interp]
+}
+
+// A headReader is an io.Reader that keeps a copy of
+// the first bytes read through it.
+type headReader struct {
+	r    io.Reader
+	head []byte
+}
+
+// headSize is the number of bytes a headReader keeps,
+// enough for a #! line.
+const headSize = 256
+
+func (h *headReader) Read(b []byte) (int, error) {
+	n, err := h.r.Read(b)
+	if len(h.head) < headSize {
+		m := n
+		if m > headSize-len(h.head) {
+			m = headSize - len(h.head)
+		}
+		h.head = append(h.head, b[:m]...)
+	}
+	return n, err
+}
+
+// encodeLangs returns the "lang" section recording that the file
+// with ID i is in language langs[i], or nil if all are unknown.
+func encodeLangs(langs []string) []byte {
+	var names []string
+	code := make(map[string]byte)
+	for _, l := range langs {
+		if _, ok := code[l]; !ok && l != "" && len(names) < 255 {
+			names = append(names, l)
+			code[l] = byte(len(names))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	var b []byte
+	for _, l := range names {
+		b = append(append(b, l...), 0)
+	}
+	b = append(b, 0)
+	for _, l := range langs {
+		b = append(b, code[l])
+	}
+	return b
+}
+
+// langTable returns the language list, beginning with "" for unknown,
+// and the per-file codes of the "lang" section of ix, or nils if
+// there is no such section.
+func (ix *Index) langTable() (names []string, codes []byte) {
+	d, ok := ix.sectionData("lang")
+	if !ok {
+		return nil, nil
+	}
+	names = []string{""}
+	for {
+		i := bytes.IndexByte(d, 0)
+		if i < 0 {
+			ix.corrupt("unterminated language list")
+		}
+		name := string(d[:i])
+		d = d[i+1:]
+		if name == "" {
+			break
+		}
+		names = append(names, name)
+	}
+	if len(d) != ix.numName {
+		ix.corrupt("lang section has %d codes for %d files", len(d), ix.numName)
+	}
+	return names, d
+}
+
+// Lang returns the language of the file with the given ID, or ""
+// if it is unknown.  For indexes that do not record languages,
+// Lang judges by the file's name alone.
+func (ix *Index) Lang(fileid uint32) string {
+	if ix.langNames == nil {
+		return Language(ix.Name(fileid), nil)
+	}
+	c := int(ix.langCodes[fileid])
+	if c >= len(ix.langNames) {
+		ix.corrupt("file %d has language code %d of %d", fileid, c, len(ix.langNames))
+	}
+	return ix.langNames[c]
+}
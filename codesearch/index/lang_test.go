@@ -0,0 +1,135 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+var languageTests = []struct {
+	name string
+	head string
+	lang string
+}{
+	{"/a/b.go", "", "go"},
+	{"/a/b.pb.go", "", "go"},
+	{"/a/api.proto", "", "proto"},
+	{"/a/Makefile", "", "make"},
+	{"/a/x.tar.gz!/src/lib.rs", "", "rust"},
+	{"/repo@HEAD:cmd/main.py", "", "python"},
+	{"/a/run", "#!/bin/sh\necho hi\n", "shell"},
+	{"/a/run", "#!/usr/bin/env python3\n", "python"},
+	{"/a/run", "#!/usr/bin/env -S perl -w\n", "perl"},
+	{"/a/run.go", "#!/bin/sh\n", "go"},
+	{"/a/README", "hello\n", ""},
+	{"/a/run", "#!/usr/bin/awk -f\n", ""},
+}
+
+func TestLanguage(t *testing.T) {
+	for _, tt := range languageTests {
+		if lang := Language(tt.name, []byte(tt.head)); lang != tt.lang {
+			t.Errorf("Language(%q, %q) = %q, want %q", tt.name, tt.head, lang, tt.lang)
+		}
+	}
+}
+
+var langFiles = map[string]string{
+	"/a/go/x.go":       "package x\n",
+	"/a/pkg/api.proto": "syntax = \"proto3\";\n",
+	"/a/pkg/y.go":      "package y\n",
+	"/a/pkg/z/run":     "#!/bin/bash\nexit 0\n",
+	"/a/README":        "read me\n",
+	"/b/pkg/w.go":      "package w\n",
+}
+
+func TestFilterFiles(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(out, []string{"/a", "/b"}, langFiles)
+	if err := Check(out); err != nil {
+		t.Fatal(err)
+	}
+	ix := Open(out)
+	defer ix.Close()
+
+	var langs []string
+	for id := 0; id < ix.NumFiles(); id++ {
+		langs = append(langs, ix.Name(uint32(id))+":"+ix.Lang(uint32(id)))
+	}
+	want := []string{"/a/README:", "/a/go/x.go:go", "/a/pkg/api.proto:proto", "/a/pkg/y.go:go", "/a/pkg/z/run:shell", "/b/pkg/w.go:go"}
+	if !reflect.DeepEqual(langs, want) {
+		t.Errorf("languages = %v, want %v", langs, want)
+	}
+
+	for _, tt := range []struct {
+		langs, globs []string
+		want         []string
+	}{
+		{nil, nil, []string{"/a/README", "/a/go/x.go", "/a/pkg/api.proto", "/a/pkg/y.go", "/a/pkg/z/run", "/b/pkg/w.go"}},
+		{[]string{"go", "proto"}, nil, []string{"/a/go/x.go", "/a/pkg/api.proto", "/a/pkg/y.go", "/b/pkg/w.go"}},
+		{nil, []string{"pkg/**"}, []string{"/a/pkg/api.proto", "/a/pkg/y.go", "/a/pkg/z/run", "/b/pkg/w.go"}},
+		{nil, []string{"pkg/*"}, []string{"/a/pkg/api.proto", "/a/pkg/y.go", "/b/pkg/w.go"}},
+		{nil, []string{"/a/pkg/**"}, []string{"/a/pkg/api.proto", "/a/pkg/y.go", "/a/pkg/z/run"}},
+		{nil, []string{"/a/*/*.go"}, []string{"/a/go/x.go", "/a/pkg/y.go"}},
+		{nil, []string{"*.proto", "README"}, []string{"/a/README", "/a/pkg/api.proto"}},
+		{[]string{"go"}, []string{"pkg/**"}, []string{"/a/pkg/y.go", "/b/pkg/w.go"}},
+		{[]string{"shell"}, []string{"/b/**"}, nil},
+	} {
+		ff, err := NewFileFilter(tt.langs, tt.globs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, id := range ix.FilterFiles(ix.PostingQuery(&Query{Op: QAll}), ff) {
+			names = append(names, ix.Name(id))
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("FilterFiles(%v, %v) = %v, want %v", tt.langs, tt.globs, names, tt.want)
+		}
+	}
+
+	for _, bad := range [][2][]string{
+		{{"cobol"}, nil},
+		{nil, {"a//b"}},
+		{nil, {"a/[b"}},
+	} {
+		if _, err := NewFileFilter(bad[0], bad[1]); err == nil {
+			t.Errorf("NewFileFilter(%v, %v) succeeded, want error", bad[0], bad[1])
+		}
+	}
+}
+
+func TestMergeLangs(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+
+	buildIndex(f1.Name(), []string{"/a", "/b"}, langFiles)
+	buildIndex(f2.Name(), []string{"/a/pkg"}, map[string]string{
+		"/a/pkg/y.go":  "package y\n",
+		"/a/pkg/z/run": "#!/usr/bin/perl\n",
+	})
+	Update(f3.Name(), f1.Name(), f2.Name(), []string{"/a/go/x.go"})
+	if err := Check(f3.Name()); err != nil {
+		t.Fatal(err)
+	}
+	ix := Open(f3.Name())
+	defer ix.Close()
+	var langs []string
+	for id := 0; id < ix.NumFiles(); id++ {
+		langs = append(langs, ix.Name(uint32(id))+":"+ix.Lang(uint32(id)))
+	}
+	want := []string{"/a/README:", "/a/pkg/api.proto:proto", "/a/pkg/y.go:go", "/a/pkg/z/run:perl", "/b/pkg/w.go:go"}
+	if !reflect.DeepEqual(langs, want) {
+		t.Errorf("languages after Update = %v, want %v", langs, want)
+	}
+}
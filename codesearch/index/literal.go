@@ -0,0 +1,168 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+// Literal regexps.
+//
+// Most searches are for an identifier or a handful of them.  Literals
+// recognizes the regexps that match only a small set of fixed strings,
+// for which RegexpQuery lists every trigram, and which package regexp
+// matches without its DFA.
+
+import (
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxLiterals is the size of the largest set of strings
+// that Literals expands a regexp into.
+const maxLiterals = 10000
+
+// Literals reports whether re matches exactly the strings in lits,
+// with ASCII letters in either case if fold is set, and, if word is set,
+// only where they begin and end at word boundaries (\b).  The strings
+// are sorted, and, if fold is set, in lower case.  Literals gives up,
+// returning ok false, for a regexp that can match the empty string or
+// a newline, that expands into more than maxLiterals strings, or that
+// mixes case-sensitive and case-insensitive letters.
+func Literals(re *syntax.Regexp) (lits []string, fold, word, ok bool) {
+	if re.Op == syntax.OpConcat && len(re.Sub) >= 3 &&
+		re.Sub[0].Op == syntax.OpWordBoundary && re.Sub[len(re.Sub)-1].Op == syntax.OpWordBoundary {
+		word = true
+		re = &syntax.Regexp{Op: syntax.OpConcat, Sub: re.Sub[1 : len(re.Sub)-1]}
+	}
+	var x litExpander
+	lits, ok = x.expand(re)
+	if !ok || x.folded && x.exact {
+		return nil, false, false, false
+	}
+	if x.folded {
+		for i, s := range lits {
+			lits[i] = strings.ToLower(s)
+		}
+	}
+	sort.Strings(lits)
+	out := lits[:0]
+	for i, s := range lits {
+		if s == "" || strings.Contains(s, "\n") {
+			return nil, false, false, false
+		}
+		if i == 0 || s != lits[i-1] {
+			out = append(out, s)
+		}
+	}
+	return out, x.folded, word, true
+}
+
+// A litExpander expands a regexp into the strings it matches,
+// noting whether it has letters matched in either case or in one.
+type litExpander struct {
+	folded bool // some letter matches in either case
+	exact  bool // some letter matches in one case only
+}
+
+func (x *litExpander) expand(re *syntax.Regexp) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		return []string{""}, true
+	case syntax.OpLiteral:
+		fold := re.Flags&syntax.FoldCase != 0
+		for _, r := range re.Rune {
+			if !isLetter(r) {
+				continue
+			}
+			if !fold {
+				x.exact = true
+			} else if !asciiFold(r) {
+				// Folding k and s also matches the Kelvin sign
+				// and the long s, which litMatcher cannot.
+				return nil, false
+			} else {
+				x.folded = true
+			}
+		}
+		return []string{string(re.Rune)}, true
+	case syntax.OpCharClass:
+		var list []string
+		var runes []rune
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if int(hi-lo) >= maxLiterals-len(runes) {
+				return nil, false
+			}
+			for r := lo; r <= hi; r++ {
+				runes = append(runes, r)
+			}
+		}
+		in := make(map[rune]bool)
+		for _, r := range runes {
+			in[r] = true
+		}
+		for _, r := range runes {
+			if isLetter(r) {
+				if !asciiFold(r) || !in[unicode.SimpleFold(r)] {
+					x.exact = true
+				} else {
+					x.folded = true
+				}
+			}
+			list = append(list, string(r))
+		}
+		return list, true
+	case syntax.OpCapture:
+		return x.expand(re.Sub[0])
+	case syntax.OpAlternate:
+		var list []string
+		for _, sub := range re.Sub {
+			l, ok := x.expand(sub)
+			if !ok || len(list)+len(l) > maxLiterals {
+				return nil, false
+			}
+			list = append(list, l...)
+		}
+		return list, true
+	case syntax.OpConcat:
+		list := []string{""}
+		for _, sub := range re.Sub {
+			l, ok := x.expand(sub)
+			if !ok || len(list)*len(l) > maxLiterals {
+				return nil, false
+			}
+			var next []string
+			for _, s := range list {
+				for _, t := range l {
+					next = append(next, s+t)
+				}
+			}
+			list = next
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+// isLetter reports whether r has another case.
+func isLetter(r rune) bool {
+	return unicode.SimpleFold(r) != r
+}
+
+// asciiFold reports whether r is ASCII and
+// its other case, if it has one, is ASCII too.
+func asciiFold(r rune) bool {
+	if r >= utf8.RuneSelf {
+		return false
+	}
+	r1 := unicode.SimpleFold(r)
+	if r1 >= utf8.RuneSelf {
+		return false
+	}
+	if r1 == r {
+		return true
+	}
+	return unicode.SimpleFold(r1) == r
+}
@@ -0,0 +1,57 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"reflect"
+	"regexp/syntax"
+	"testing"
+)
+
+var literalsTests = []struct {
+	re   string
+	lits []string
+	fold bool
+	word bool
+}{
+	{`hello`, []string{"hello"}, false, false},
+	{`(?i)Hello`, []string{"hello"}, true, false},
+	{`\bhello\b`, []string{"hello"}, false, true},
+	{`(?i)\b(?:foo|Bar)\b`, []string{"bar", "foo"}, true, true},
+	{`ab[cd]e|xyz|abce`, []string{"abce", "abde", "xyz"}, false, false},
+	{`a\.b\(c`, []string{"a.b(c"}, false, false},
+	{`(?i)[aA]b`, []string{"ab"}, true, false},
+	{`(?i)x1_`, []string{"x1_"}, true, false},
+	{`12\+3`, []string{"12+3"}, false, false},
+	{`héllo`, []string{"héllo"}, false, false},
+
+	// Not literals.
+	{`a+b`, nil, false, false},
+	{`^abc`, nil, false, false},
+	{`\babc`, nil, false, false},
+	{`abc\B`, nil, false, false},
+	{`a.c`, nil, false, false},
+	{`a|`, nil, false, false},
+	{`a\nb`, nil, false, false},
+	{`[^a]bc`, nil, false, false},
+	{`(?i:a)b`, nil, false, false},
+	{`a[Bb]`, nil, false, false},
+	{`(?i)kelvin`, nil, false, false},
+	{`(?i)héllo`, nil, false, false},
+	{`[a-z][a-z][a-z][a-z]`, nil, false, false},
+}
+
+func TestLiterals(t *testing.T) {
+	for _, tt := range literalsTests {
+		re, err := syntax.Parse(tt.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lits, fold, word, ok := Literals(re)
+		if ok != (tt.lits != nil) || !reflect.DeepEqual(lits, tt.lits) || fold != tt.fold || word != tt.word {
+			t.Errorf("Literals(%#q) = %q, %v, %v, %v, want %q, %v, %v", tt.re, lits, fold, word, ok, tt.lits, tt.fold, tt.word)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+// Locking.
+//
+// Programs that write an index take an advisory lock on it first, so
+// that two of them never rewrite the same index at once.  The lock is
+// held on a separate file, named like the index with the suffix .lock,
+// because writers replace the index file itself by renaming.  The lock
+// file is never removed: a writer that removed it could not tell
+// whether another writer had meanwhile locked the removed file.
+// Readers do not lock; they rely on writers replacing files atomically.
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrLocked is returned by LockIndex when another program holds the lock.
+var ErrLocked = errors.New("index is locked by another program")
+
+// A Lock is a held advisory lock on an index.
+type Lock struct {
+	f *os.File
+}
+
+// LockIndex acquires the lock on the index in file.  If another program
+// holds the lock, LockIndex waits for it to be released if wait is set and
+// otherwise returns ErrLocked.  On systems without file locking,
+// LockIndex always succeeds.
+func LockIndex(file string, wait bool) (*Lock, error) {
+	f, err := os.OpenFile(file+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, wait); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{f}, nil
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	err := unlockFile(l.f)
+	if err1 := l.f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
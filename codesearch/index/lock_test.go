@@ -0,0 +1,172 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "index")
+
+	l, err := LockIndex(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l2, err := LockIndex(file, false); err != ErrLocked {
+		if err == nil {
+			l2.Unlock()
+			l.Unlock()
+			t.Skip("no file locking on this system")
+		}
+		t.Fatalf("second LockIndex: %v, want ErrLocked", err)
+	}
+
+	locked := make(chan bool)
+	go func() {
+		l2, err := LockIndex(file, true)
+		if err != nil {
+			t.Error(err)
+		} else {
+			l2.Unlock()
+		}
+		locked <- true
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("LockIndex did not wait for lock to be released")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Unlock()
+	<-locked
+}
+
+// TestConcurrentUpdates runs writers that each add a file to a sharded
+// index, and now and then merge shards, while readers open the index
+// over and over.  The lock keeps the writers from losing each other's
+// files, and OpenShards keeps the readers from seeing a missing shard
+// or an index older than one they saw before.
+func TestConcurrentUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	master := filepath.Join(dir, "index")
+	if l, _ := LockIndex(master, false); l != nil {
+		l2, err := LockIndex(master, false)
+		l.Unlock()
+		if err == nil {
+			l2.Unlock()
+			t.Skip("no file locking on this system")
+		}
+	}
+
+	first := master + ".init"
+	buildIndex(first, nil, map[string]string{"init": "initial file\n"})
+	if err := WriteManifest(master, []string{first}); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 8
+	const readers = 4
+	var (
+		wg   sync.WaitGroup
+		done = make(chan bool)
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l, err := LockIndex(master, true)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer l.Unlock()
+			shards, err := Shards(master)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			shard := fmt.Sprintf("%s.%d", master, i)
+			buildIndex(shard, nil, map[string]string{fmt.Sprintf("file%d", i): fmt.Sprintf("file number %d\n", i)})
+			var removed []string
+			if len(shards) >= 3 {
+				// Merge the first two shards.
+				merged := fmt.Sprintf("%s.m%d", master, i)
+				Update(merged, shards[0], shards[1], nil)
+				removed = shards[:2]
+				shards = append([]string{merged}, shards[2:]...)
+			}
+			if err := WriteManifest(master, append(shards, shard)); err != nil {
+				t.Error(err)
+				return
+			}
+			for _, s := range removed {
+				os.Remove(s)
+			}
+		}(i)
+	}
+
+	var rg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		rg.Add(1)
+		go func() {
+			defer rg.Done()
+			last := 0
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_, ixs, err := OpenShards(master)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n := 0
+				for _, ix := range ixs {
+					n += len(ix.PostingQuery(&Query{Op: QAll}))
+					ix.Close()
+				}
+				if n < last {
+					t.Errorf("reader saw %d files after %d", n, last)
+					return
+				}
+				last = n
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	rg.Wait()
+
+	_, ixs, err := OpenShards(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, ix := range ixs {
+		n += ix.NumFiles()
+		ix.Close()
+	}
+	if n != writers+1 {
+		t.Errorf("index has %d files, want %d", n, writers+1)
+	}
+}
@@ -29,6 +29,15 @@ package index
 // 
 // Copy the name index and posting list index into C's index and write the trailer.
 // Rename C's index onto the new index.
+//
+// Updating an index A with a newer index B holding only added and changed
+// files works the same way, except that instead of discarding whole path
+// ranges from A, the update discards only the files that B replaces
+// and the files that the caller reports as removed.  The resulting
+// docid maps have more, shorter ranges, but the merge is otherwise identical.
+//
+// Files that A or B mark as deleted are left out of the docid maps,
+// so that C holds no deleted files.
 
 import (
 	"encoding/binary"
@@ -41,6 +50,16 @@ type idrange struct {
 	lo, hi, new uint32
 }
 
+// appendRange appends to m the mapping of id to new,
+// extending the last range in m if possible.
+func appendRange(m []idrange, id, new uint32) []idrange {
+	if n := len(m); n > 0 && m[n-1].hi == id && m[n-1].new+id-m[n-1].lo == new {
+		m[n-1].hi++
+		return m
+	}
+	return append(m, idrange{id, id + 1, new})
+}
+
 type postIndex struct {
 	tri    uint32
 	count  uint32
@@ -52,8 +71,9 @@ type postIndex struct {
 // for a path, src2 is assumed to be newer and is given preference.
 func Merge(dst, src1, src2 string) {
 	ix1 := Open(src1)
+	defer ix1.Close()
 	ix2 := Open(src2)
-	paths1 := ix1.Paths()
+	defer ix2.Close()
 	paths2 := ix2.Paths()
 
 	// Build docid maps.
@@ -102,7 +122,65 @@ func Merge(dst, src1, src2 string) {
 	if i2 < uint32(ix2.numName) {
 		panic("merge: inconsistent index")
 	}
-	numName := new
+	merge(dst, ix1, ix2, map1, map2, new)
+}
+
+// Update creates a new index in the file dst that corresponds to
+// applying the changes in the index src2 to the index src1.
+// Unlike Merge, which replaces everything src1 holds under src2's
+// paths, Update keeps the files in src1 that are neither replaced by a
+// file of the same name in src2 nor listed in remove.
+// It is meant for incremental indexing, in which src2 holds
+// only the added and changed files.
+func Update(dst, src1, src2 string, remove []string) {
+	ix1 := Open(src1)
+	defer ix1.Close()
+	ix2 := Open(src2)
+	defer ix2.Close()
+	drop := make(map[string]bool)
+	for _, name := range remove {
+		drop[name] = true
+	}
+
+	// Build docid maps by merging the sorted name lists.
+	var i1, i2, new uint32
+	var map1, map2 []idrange
+	n1 := uint32(ix1.numName)
+	n2 := uint32(ix2.numName)
+	for i1 < n1 || i2 < n2 {
+		if i1 < n1 {
+			name1 := ix1.Name(i1)
+			if drop[name1] {
+				i1++
+				continue
+			}
+			if i2 >= n2 || name1 < ix2.Name(i2) {
+				map1 = appendRange(map1, i1, new)
+				i1++
+				new++
+				continue
+			}
+			if name1 == ix2.Name(i2) {
+				// Replaced by src2.
+				i1++
+			}
+		}
+		map2 = appendRange(map2, i2, new)
+		i2++
+		new++
+	}
+	merge(dst, ix1, ix2, map1, map2, new)
+}
+
+// merge writes to dst the index that combines ix1 and ix2
+// according to the docid maps map1 and map2, which together
+// define numName files.
+func merge(dst string, ix1, ix2 *Index, map1, map2 []idrange, numName uint32) {
+	if len(ix1.deleted) > 0 || len(ix2.deleted) > 0 {
+		map1, map2, numName = compact(ix1, ix2, map1, map2)
+	}
+	paths1 := ix1.Paths()
+	paths2 := ix2.Paths()
 
 	ix3 := bufCreate(dst)
 	ix3.writeString(magic)
@@ -133,25 +211,28 @@ func Merge(dst, src1, src2 string) {
 	// Merged list of names.
 	nameData := ix3.offset()
 	nameIndexFile := bufCreate("")
-	new = 0
+	statFile := bufCreate("")
+	new := uint32(0)
 	mi1 = 0
 	mi2 = 0
 	for new < numName {
 		if mi1 < len(map1) && map1[mi1].new == new {
 			for i := map1[mi1].lo; i < map1[mi1].hi; i++ {
 				name := ix1.Name(i)
-				nameIndexFile.writeUint32(ix3.offset() - nameData)
+				nameIndexFile.writeUint64(uint64(ix3.offset() - nameData))
 				ix3.writeString(name)
 				ix3.writeString("\x00")
+				ix1.copyStat(statFile, i)
 				new++
 			}
 			mi1++
 		} else if mi2 < len(map2) && map2[mi2].new == new {
 			for i := map2[mi2].lo; i < map2[mi2].hi; i++ {
 				name := ix2.Name(i)
-				nameIndexFile.writeUint32(ix3.offset() - nameData)
+				nameIndexFile.writeUint64(uint64(ix3.offset() - nameData))
 				ix3.writeString(name)
 				ix3.writeString("\x00")
+				ix2.copyStat(statFile, i)
 				new++
 			}
 			mi2++
@@ -159,10 +240,11 @@ func Merge(dst, src1, src2 string) {
 			panic("merge: inconsistent index")
 		}
 	}
-	if new*4 != nameIndexFile.offset() {
+	if int64(new)*8 != nameIndexFile.offset() {
 		panic("merge: inconsistent index")
 	}
-	nameIndexFile.writeUint32(ix3.offset())
+	nameIndexFile.writeUint64(uint64(ix3.offset() - nameData))
+	ix3.writeString("\x00")
 
 	// Merged list of posting lists.
 	postData := ix3.offset()
@@ -210,6 +292,30 @@ func Merge(dst, src1, src2 string) {
 			w.endTrigram()
 		}
 	}
+	w.terminate()
+
+	// Sections
+	var sect sectionWriter
+	sect.copy(ix3, "stat", statFile)
+	// The file selection rules and limits are those of the newer index.
+	for _, tag := range []string{"filt", "lims"} {
+		if d, ok := ix2.sectionData(tag); ok {
+			sect.add(ix3, tag, d)
+		} else if d, ok := ix1.sectionData(tag); ok {
+			sect.add(ix3, tag, d)
+		}
+	}
+	if b := encodeLangs(mergeLangs(ix1, ix2, map1, map2, numName)); b != nil {
+		sect.add(ix3, "lang", b)
+	}
+	// The merged index records declarations only if it can record
+	// those of all its Go files.
+	if (ix1.HasSymbols() || ix2.HasSymbols()) && ix1.symbolsComplete(map1) && ix2.symbolsComplete(map2) {
+		syms := ix2.mapSymbols(ix1.mapSymbols(nil, map1), map2)
+		if len(syms) > 0 {
+			sect.addSymbols(ix3, syms)
+		}
+	}
 
 	// Name index
 	nameIndex := ix3.offset()
@@ -219,25 +325,80 @@ func Merge(dst, src1, src2 string) {
 	postIndex := ix3.offset()
 	copyFile(ix3, w.postIndexFile)
 
-	ix3.writeUint32(pathData)
-	ix3.writeUint32(nameData)
-	ix3.writeUint32(postData)
-	ix3.writeUint32(nameIndex)
-	ix3.writeUint32(postIndex)
-	ix3.writeString(trailerMagic)
-	ix3.flush()
+	// Section index
+	sectIndex := ix3.offset()
+	sect.writeIndex(ix3)
+
+	writeTrailer(ix3, [6]int64{pathData, nameData, postData, nameIndex, postIndex, sectIndex})
+	ix3.close()
 
 	os.Remove(nameIndexFile.name)
+	os.Remove(statFile.name)
 	os.Remove(w.postIndexFile.name)
 }
 
+// mergeLangs returns the languages of the numName files
+// of the merged index, indexed by new file ID.
+func mergeLangs(ix1, ix2 *Index, map1, map2 []idrange, numName uint32) []string {
+	langs := make([]string, numName)
+	for _, m := range []struct {
+		ix    *Index
+		idmap []idrange
+	}{{ix1, map1}, {ix2, map2}} {
+		for _, r := range m.idmap {
+			for id := r.lo; id < r.hi; id++ {
+				langs[r.new+id-r.lo] = m.ix.Lang(id)
+			}
+		}
+	}
+	return langs
+}
+
+// compact returns the docid maps that correspond to map1 and map2
+// but omit the deleted files of ix1 and ix2, along with the
+// new number of files.
+func compact(ix1, ix2 *Index, map1, map2 []idrange) (m1, m2 []idrange, numName uint32) {
+	var new uint32
+	i, j := 0, 0
+	for i < len(map1) || j < len(map2) {
+		if j >= len(map2) || i < len(map1) && map1[i].new < map2[j].new {
+			for id := map1[i].lo; id < map1[i].hi; id++ {
+				if !ix1.Deleted(id) {
+					m1 = appendRange(m1, id, new)
+					new++
+				}
+			}
+			i++
+		} else {
+			for id := map2[j].lo; id < map2[j].hi; id++ {
+				if !ix2.Deleted(id) {
+					m2 = appendRange(m2, id, new)
+					new++
+				}
+			}
+			j++
+		}
+	}
+	return m1, m2, new
+}
+
+// copyStat writes the stat section entry for fileid to w.
+func (ix *Index) copyStat(w *bufWriter, fileid uint32) {
+	if ix.statData == 0 {
+		w.writeUint64(0)
+		w.writeUint64(0)
+		return
+	}
+	w.write(ix.slice(ix.statData+statEntrySize*int64(fileid), statEntrySize))
+}
+
 type postMapReader struct {
 	ix      *Index
 	idmap   []idrange
 	triNum  uint32
 	trigram uint32
 	count   uint32
-	offset  uint32
+	offset  int64
 	d       []byte
 	oldid   uint32
 	fileid  uint32
@@ -263,7 +424,7 @@ func (r *postMapReader) load() {
 		r.fileid = ^uint32(0)
 		return
 	}
-	r.trigram, r.count, r.offset = r.ix.listAt(r.triNum * postEntrySize)
+	r.trigram, r.count, r.offset = r.ix.listAt(int(r.triNum))
 	if r.count == 0 {
 		r.fileid = ^uint32(0)
 		return
@@ -279,7 +440,7 @@ func (r *postMapReader) nextId() bool {
 		delta64, n := binary.Uvarint(r.d)
 		delta := uint32(delta64)
 		if n <= 0 || delta == 0 {
-			corrupt()
+			r.ix.corrupt("bad posting list for trigram %q", trigramString(r.trigram))
 		}
 		r.d = r.d[n:]
 		r.oldid += delta
@@ -305,8 +466,9 @@ type postDataWriter struct {
 	out           *bufWriter
 	postIndexFile *bufWriter
 	buf           [10]byte
-	base          uint32
-	count, offset uint32
+	base          int64
+	offset        int64
+	count         uint32
 	last          uint32
 	t             uint32
 }
@@ -340,5 +502,16 @@ func (w *postDataWriter) endTrigram() {
 	w.out.writeUvarint(0)
 	w.postIndexFile.writeTrigram(w.t)
 	w.postIndexFile.writeUint32(w.count)
-	w.postIndexFile.writeUint32(w.offset - w.base)
+	w.postIndexFile.writeUint64(uint64(w.offset - w.base))
+}
+
+// terminate writes the empty posting list for trigram 1<<24-1
+// that ends the posting lists, and its index entry.
+func (w *postDataWriter) terminate() {
+	w.trigram(1<<24 - 1)
+	w.out.writeTrigram(w.t)
+	w.out.writeUvarint(0)
+	w.postIndexFile.writeTrigram(w.t)
+	w.postIndexFile.writeUint32(0)
+	w.postIndexFile.writeUint64(uint64(w.offset - w.base))
 }
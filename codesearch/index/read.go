@@ -8,12 +8,14 @@ package index
 //
 // An index stored on disk has the format:
 //
-//	"csearch index 1\n"
+//	"csearch index 3\n"
 //	list of paths
 //	list of names
 //	list of posting lists
+//	sections
 //	name index
 //	posting list index
+//	section index
 //	trailer
 //
 // The list of paths is a sorted sequence of NUL-terminated file or directory names.
@@ -39,100 +41,331 @@ package index
 // not recorded at all.  The list of posting lists ends with an entry
 // with trigram "\xff\xff\xff" and a delta list consisting a single zero.
 //
+// The sections hold additional per-index or per-file data, each
+// identified by a 4-byte tag.  The "stat" section records for each
+// file ID in turn
+//
+//	size [8]
+//	modification time [8]
+//
+// as big-endian integers, the time in nanoseconds since the Unix epoch.
+// An all-zero entry means the file's state is unknown (for example,
+// it was added from a reader that cannot be stat'ed).
+//
+// The optional "dele" section is a sorted sequence of 4-byte big-endian
+// file IDs that have been deleted from the index.  Deleted files keep
+// their names and posting list entries, so that deleting does not
+// require rewriting the posting lists, but readers must never report them.
+// Merge drops deleted files from its output.
+//
+// The "lims" section records the Limits used to detect text files:
+//
+//	maximum file length [8]
+//	maximum line length [8]
+//	maximum number of distinct trigrams [8]
+//
+// The optional "filt" section records the rules that the indexing
+// program used to select the files to index, as a sequence of
+// NUL-terminated strings.  The index package does not interpret them.
+//
+// The optional "syms" section lists the declarations in Go files,
+// and the "symx" section indexes it; symbol.go describes them.
+//
 // The indexes enable efficient random access to the lists.  The name
-// index is a sequence of 4-byte big-endian values listing the byte
+// index is a sequence of 8-byte big-endian values listing the byte
 // offset in the name list where each name begins.  The posting list
 // index is a sequence of index entries describing each successive
 // posting list.  Each index entry has the form:
 //
 //	trigram [3]
 //	file count [4]
-//	offset [4]
+//	offset [8]
 //
+// where the offset is relative to the start of the posting lists.
 // Index entries are only written for the non-empty posting lists,
 // so finding the posting list for a specific trigram requires a
 // binary search over the posting list index.  In practice, the majority
 // of the possible trigrams are never seen, so omitting the missing
 // ones represents a significant storage savings.
 //
+// The section index is a sequence of entries, one per section:
+//
+//	tag [4]
+//	offset [8]
+//	length [8]
+//
 // The trailer has the form:
 //
-//	offset of path list [4]
-//	offset of name list [4]
-//	offset of posting lists [4]
-//	offset of name index [4]
-//	offset of posting list index [4]
+//	offset of path list [8]
+//	offset of name list [8]
+//	offset of posting lists [8]
+//	offset of name index [8]
+//	offset of posting list index [8]
+//	offset of section index [8]
+//	feature flags [8]
+//	checksum [4]
 //	"\ncsearch trailr\n"
+//
+// The feature flags mark features that change how the index must be
+// read; Open refuses an index with flags it does not know.  No flags
+// are defined yet.  The checksum is the CRC-32 (Castagnoli) of all
+// the bytes before it.  Open does not check it, because that means
+// reading the whole index; Verify does.
+//
+// Version 2 indexes ("csearch index 2\n") have the same layout but
+// 4-byte offsets and lengths throughout, and no feature flags or
+// checksum in the trailer.  Version 1 indexes ("csearch index 1\n")
+// are like version 2 but have no sections, no section index, and no
+// section index offset in the trailer.  Open reads all three versions;
+// IndexWriter, Merge, Update, and Delete always write version 3.
 
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
+	"time"
 )
 
 const (
-	magic        = "csearch index 1\n"
+	magicV1      = "csearch index 1\n"
+	magicV2      = "csearch index 2\n"
+	magic        = "csearch index 3\n"
 	trailerMagic = "\ncsearch trailr\n"
 )
 
+// FormatVersion is the version of the index format
+// that this package writes.
+const FormatVersion = 3
+
+// features are the feature flags that this package understands.
+const features = 0
+
+// castagnoli is the table for the index checksum.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 // An Index implements read-only access to a trigram index.
 type Index struct {
 	Verbose   bool
+	name      string // file name, for diagnostics
+	version   int
 	data      mmapData
-	pathData  uint32
-	nameData  uint32
-	postData  uint32
-	nameIndex uint32
-	postIndex uint32
+	pathData  int64
+	nameData  int64
+	postData  int64
+	nameIndex int64
+	postIndex int64
+	sectIndex int64
+	statData  int64
+	deleted   []uint32
+	langNames []string // languages listed in the "lang" section
+	langCodes []byte   // language of each file, if langNames != nil
 	numName   int
 	numPost   int
+	numSect   int
+	checking  bool // report damage by panicking, for Check
+
+	offSize       int64 // size of offsets in the indexes and trailer
+	postEntrySize int64
+	sectEntrySize int64
 }
 
-const postEntrySize = 3 + 4 + 4
+const statEntrySize = 8 + 8
 
+// Open opens the index in file.  If the index is damaged, Open,
+// like the methods of the Index it returns, exits the program
+// with a description of the damage.
 func Open(file string) *Index {
-	mm := mmap(file)
-	if len(mm.d) < 4*4+len(trailerMagic) || string(mm.d[len(mm.d)-len(trailerMagic):]) != trailerMagic {
-		corrupt()
-	}
-	n := uint32(len(mm.d) - len(trailerMagic) - 5*4)
-	ix := &Index{data: mm}
-	ix.pathData = ix.uint32(n)
-	ix.nameData = ix.uint32(n + 4)
-	ix.postData = ix.uint32(n + 8)
-	ix.nameIndex = ix.uint32(n + 12)
-	ix.postIndex = ix.uint32(n + 16)
-	ix.numName = int((ix.postIndex-ix.nameIndex)/4) - 1
-	ix.numPost = int((n - ix.postIndex) / postEntrySize)
+	ix := &Index{name: file, data: mmap(file)}
+	ix.init()
 	return ix
 }
 
+// init reads the trailer and the section index of ix.
+func (ix *Index) init() {
+	d := ix.data.d
+	if len(d) < len(magic)+len(trailerMagic) {
+		ix.corrupt("file is only %d bytes long", len(d))
+	}
+	if string(d[len(d)-len(trailerMagic):]) != trailerMagic {
+		ix.corrupt("no trailer at end of file, perhaps truncated")
+	}
+	n := int64(len(d) - len(trailerMagic)) // start of trailer
+	switch string(d[:len(magic)]) {
+	case magicV1:
+		ix.version, ix.offSize = 1, 4
+		n -= 5 * 4
+	case magicV2:
+		ix.version, ix.offSize = 2, 4
+		n -= 6 * 4
+	case magic:
+		ix.version, ix.offSize = 3, 8
+		n -= 6*8 + 8 + 4
+	default:
+		if strings.HasPrefix(string(d), "csearch index ") {
+			ix.unsupported("index format %q", strings.TrimSpace(string(d[:len(magic)])))
+		}
+		ix.corrupt("bad header %q", d[:len(magic)])
+	}
+	if n < int64(len(magic)) {
+		ix.corrupt("file is only %d bytes long", len(d))
+	}
+	ix.postEntrySize = 3 + 4 + ix.offSize
+	ix.sectEntrySize = 4 + 2*ix.offSize
+	ix.pathData = ix.offset(n)
+	ix.nameData = ix.offset(n + ix.offSize)
+	ix.postData = ix.offset(n + 2*ix.offSize)
+	ix.nameIndex = ix.offset(n + 3*ix.offSize)
+	ix.postIndex = ix.offset(n + 4*ix.offSize)
+	ix.sectIndex = n
+	if ix.version >= 2 {
+		ix.sectIndex = ix.offset(n + 5*ix.offSize)
+	}
+	if ix.version >= 3 {
+		if f := binary.BigEndian.Uint64(ix.slice(n+6*8, 8)); f&^features != 0 {
+			ix.unsupported("index features %#x", f&^features)
+		}
+	}
+	offs := []int64{int64(len(magic)), ix.pathData, ix.nameData, ix.postData, ix.nameIndex, ix.postIndex, ix.sectIndex, n}
+	for i := 1; i < len(offs); i++ {
+		if offs[i] < offs[i-1] {
+			ix.corrupt("trailer offsets out of order: %v", offs[1:len(offs)-1])
+		}
+	}
+	if (ix.postIndex-ix.nameIndex)%ix.offSize != 0 || ix.postIndex == ix.nameIndex {
+		ix.corrupt("name index has bad size %d", ix.postIndex-ix.nameIndex)
+	}
+	if (ix.sectIndex-ix.postIndex)%ix.postEntrySize != 0 {
+		ix.corrupt("posting list index has bad size %d", ix.sectIndex-ix.postIndex)
+	}
+	if (n-ix.sectIndex)%ix.sectEntrySize != 0 {
+		ix.corrupt("section index has bad size %d", n-ix.sectIndex)
+	}
+	ix.numName = int((ix.postIndex-ix.nameIndex)/ix.offSize) - 1
+	ix.numPost = int((ix.sectIndex - ix.postIndex) / ix.postEntrySize)
+	ix.numSect = int((n - ix.sectIndex) / ix.sectEntrySize)
+	if off, size, ok := ix.section("stat"); ok {
+		if size != statEntrySize*int64(ix.numName) {
+			ix.corrupt("stat section has %d bytes for %d files", size, ix.numName)
+		}
+		ix.statData = off
+	}
+	if off, size, ok := ix.section("dele"); ok {
+		d := ix.slice(off, int(size))
+		ix.deleted = make([]uint32, len(d)/4)
+		for i := range ix.deleted {
+			ix.deleted[i] = binary.BigEndian.Uint32(d[4*i:])
+			if i > 0 && ix.deleted[i] <= ix.deleted[i-1] || ix.deleted[i] >= uint32(ix.numName) {
+				ix.corrupt("deleted file list is out of order or out of range at entry %d", i)
+			}
+		}
+	}
+	ix.langNames, ix.langCodes = ix.langTable()
+}
+
+// Version returns the version of the index format that ix uses.
+func (ix *Index) Version() int {
+	return ix.version
+}
+
+// Verify checks the index data against the checksum in the trailer.
+// Indexes older than version 3 have no checksum; Verify accepts them.
+func (ix *Index) Verify() error {
+	if ix.version < 3 {
+		return nil
+	}
+	d := ix.data.d
+	n := len(d) - len(trailerMagic) - 4
+	want := binary.BigEndian.Uint32(d[n:])
+	if sum := crc32.Checksum(d[:n], castagnoli); sum != want {
+		return fmt.Errorf("%s: checksum mismatch: data sums to %08x, trailer records %08x", ix.name, sum, want)
+	}
+	return nil
+}
+
+// Close releases the memory and file used by ix.
+// The index and any data obtained from it, such as the slices
+// returned by NameBytes, must not be used after Close.
+func (ix *Index) Close() error {
+	return ix.data.close()
+}
+
+// section returns the offset and length of the section with the given tag.
+func (ix *Index) section(tag string) (off, size int64, ok bool) {
+	d := ix.slice(ix.sectIndex, int(ix.sectEntrySize)*ix.numSect)
+	for i := 0; i < ix.numSect; i++ {
+		e := d[int64(i)*ix.sectEntrySize:]
+		if string(e[:4]) == tag {
+			if ix.offSize == 8 {
+				off = int64(binary.BigEndian.Uint64(e[4:]))
+				size = int64(binary.BigEndian.Uint64(e[12:]))
+			} else {
+				off = int64(binary.BigEndian.Uint32(e[4:]))
+				size = int64(binary.BigEndian.Uint32(e[8:]))
+			}
+			if off < 0 || size < 0 || off+size > ix.sectIndex {
+				ix.corrupt("%s section at offset %d, length %d, is out of range", tag, off, size)
+			}
+			return off, size, true
+		}
+	}
+	return 0, 0, false
+}
+
+// sectionData returns the contents of the section with the given tag.
+func (ix *Index) sectionData(tag string) (data []byte, ok bool) {
+	off, size, ok := ix.section(tag)
+	if !ok {
+		return nil, false
+	}
+	return ix.slice(off, int(size)), true
+}
+
 // slice returns the slice of index data starting at the given byte offset.
 // If n >= 0, the slice must have length at least n and is truncated to length n.
-func (ix *Index) slice(off uint32, n int) []byte {
-	o := int(off)
-	if uint32(o) != off || n >= 0 && o+n > len(ix.data.d) {
-		corrupt()
+func (ix *Index) slice(off int64, n int) []byte {
+	size := int64(len(ix.data.d))
+	if off < 0 || off > size || n >= 0 && off+int64(n) > size {
+		if n < 0 {
+			n = 0
+		}
+		ix.corrupt("%d bytes at offset %d lie beyond the end of the %d-byte file", n, off, size)
 	}
 	if n < 0 {
-		return ix.data.d[o:]
+		return ix.data.d[off:]
 	}
-	return ix.data.d[o : o+n]
+	return ix.data.d[off : off+int64(n)]
 }
 
 // uint32 returns the uint32 value at the given offset in the index data.
-func (ix *Index) uint32(off uint32) uint32 {
+func (ix *Index) uint32(off int64) uint32 {
 	return binary.BigEndian.Uint32(ix.slice(off, 4))
 }
 
+// offset returns the offset stored at the given offset in the
+// index data, which is 4 or 8 bytes long depending on the version.
+func (ix *Index) offset(off int64) int64 {
+	if ix.offSize == 4 {
+		return int64(ix.uint32(off))
+	}
+	v := binary.BigEndian.Uint64(ix.slice(off, 8))
+	if int64(v) < 0 {
+		ix.corrupt("offset %#x at offset %d out of range", v, off)
+	}
+	return int64(v)
+}
+
 // uvarint returns the varint value at the given offset in the index data.
-func (ix *Index) uvarint(off uint32) uint32 {
+func (ix *Index) uvarint(off int64) uint32 {
 	v, n := binary.Uvarint(ix.slice(off, -1))
 	if n <= 0 {
-		corrupt()
+		ix.corrupt("bad varint at offset %d", off)
 	}
 	return uint32(v)
 }
@@ -147,22 +380,53 @@ func (ix *Index) Paths() []string {
 			break
 		}
 		x = append(x, string(s))
-		off += uint32(len(s) + 1)
+		off += int64(len(s) + 1)
+	}
+	return x
+}
+
+// Limits returns the limits used to detect the text files in the
+// index.  If the index does not record them, Limits returns
+// DefaultLimits, which were in effect when they were not recorded.
+func (ix *Index) Limits() Limits {
+	d, ok := ix.sectionData("lims")
+	if !ok || len(d) != 24 {
+		return DefaultLimits
+	}
+	return Limits{
+		MaxFileLen:      int64(binary.BigEndian.Uint64(d[0:])),
+		MaxLineLen:      int(binary.BigEndian.Uint64(d[8:])),
+		MaxTextTrigrams: int(binary.BigEndian.Uint64(d[16:])),
+	}
+}
+
+// Filters returns the file selection rules recorded by
+// IndexWriter.SetFilters, or nil if there are none.
+func (ix *Index) Filters() []string {
+	off, size, ok := ix.section("filt")
+	if !ok {
+		return nil
+	}
+	var x []string
+	for end := off + size; off < end; {
+		s := ix.str(off)
+		x = append(x, string(s))
+		off += int64(len(s) + 1)
 	}
 	return x
 }
 
 // NameBytes returns the name corresponding to the given fileid.
 func (ix *Index) NameBytes(fileid uint32) []byte {
-	off := ix.uint32(ix.nameIndex + 4*fileid)
+	off := ix.offset(ix.nameIndex + ix.offSize*int64(fileid))
 	return ix.str(ix.nameData + off)
 }
 
-func (ix *Index) str(off uint32) []byte {
+func (ix *Index) str(off int64) []byte {
 	str := ix.slice(off, -1)
 	i := bytes.IndexByte(str, '\x00')
 	if i < 0 {
-		corrupt()
+		ix.corrupt("unterminated string at offset %d", off)
 	}
 	return str[:i]
 }
@@ -172,51 +436,96 @@ func (ix *Index) Name(fileid uint32) string {
 	return string(ix.NameBytes(fileid))
 }
 
-// listAt returns the index list entry at the given offset.
-func (ix *Index) listAt(off uint32) (trigram, count, offset uint32) {
-	d := ix.slice(ix.postIndex+off, postEntrySize)
-	trigram = uint32(d[0])<<16 | uint32(d[1])<<8 | uint32(d[2])
-	count = binary.BigEndian.Uint32(d[3:])
-	offset = binary.BigEndian.Uint32(d[3+4:])
-	return
+// NumFiles returns the number of files in the index.
+// File IDs range from 0 to NumFiles()-1.
+// The count includes deleted files.
+func (ix *Index) NumFiles() int {
+	return ix.numName
+}
+
+// NumDeleted returns the number of deleted files in the index.
+func (ix *Index) NumDeleted() int {
+	return len(ix.deleted)
+}
+
+// Deleted reports whether the file with the given ID has been deleted.
+func (ix *Index) Deleted(fileid uint32) bool {
+	i := sort.Search(len(ix.deleted), func(i int) bool {
+		return ix.deleted[i] >= fileid
+	})
+	return i < len(ix.deleted) && ix.deleted[i] == fileid
+}
+
+// Lookup returns the file ID of the file with the given name.
+// It does not find deleted files.
+func (ix *Index) Lookup(name string) (fileid uint32, ok bool) {
+	i := sort.Search(ix.numName, func(i int) bool {
+		return string(ix.NameBytes(uint32(i))) >= name
+	})
+	if i < ix.numName && string(ix.NameBytes(uint32(i))) == name && !ix.Deleted(uint32(i)) {
+		return uint32(i), true
+	}
+	return 0, false
+}
+
+// Stat returns the size and modification time that the file with
+// the given ID had when it was indexed.  If that information was
+// not recorded, Stat returns ok == false.
+func (ix *Index) Stat(fileid uint32) (size int64, mtime time.Time, ok bool) {
+	if ix.statData == 0 {
+		return 0, time.Time{}, false
+	}
+	d := ix.slice(ix.statData+statEntrySize*int64(fileid), statEntrySize)
+	size = int64(binary.BigEndian.Uint64(d))
+	nsec := int64(binary.BigEndian.Uint64(d[8:]))
+	if size == 0 && nsec == 0 {
+		return 0, time.Time{}, false
+	}
+	return size, time.Unix(0, nsec), true
+}
+
+// Unchanged reports whether the file with the given ID appears to be
+// unchanged since it was indexed: whether its recorded size and
+// modification time match fi.
+func (ix *Index) Unchanged(fileid uint32, fi os.FileInfo) bool {
+	size, mtime, ok := ix.Stat(fileid)
+	return ok && size == fi.Size() && mtime.Equal(fi.ModTime())
 }
 
-func (ix *Index) dumpPosting() {
-	d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
-	for i := 0; i < ix.numPost; i++ {
-		j := i * postEntrySize
-		t := uint32(d[j])<<16 | uint32(d[j+1])<<8 | uint32(d[j+2])
-		count := int(binary.BigEndian.Uint32(d[j+3:]))
-		offset := binary.BigEndian.Uint32(d[j+3+4:])
-		log.Printf("%#x: %d at %d", t, count, offset)
+// listAt returns the i'th entry of the posting list index.
+func (ix *Index) listAt(i int) (trigram, count uint32, offset int64) {
+	d := ix.slice(ix.postIndex+int64(i)*ix.postEntrySize, int(ix.postEntrySize))
+	trigram = uint32(d[0])<<16 | uint32(d[1])<<8 | uint32(d[2])
+	count = binary.BigEndian.Uint32(d[3:])
+	if ix.offSize == 8 {
+		offset = int64(binary.BigEndian.Uint64(d[3+4:]))
+	} else {
+		offset = int64(binary.BigEndian.Uint32(d[3+4:]))
 	}
+	return
 }
 
-func (ix *Index) findList(trigram uint32) (count int, offset uint32) {
+func (ix *Index) findList(trigram uint32) (count int, offset int64) {
 	// binary search
-	d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
 	i := sort.Search(ix.numPost, func(i int) bool {
-		i *= postEntrySize
-		t := uint32(d[i])<<16 | uint32(d[i+1])<<8 | uint32(d[i+2])
+		t, _, _ := ix.listAt(i)
 		return t >= trigram
 	})
 	if i >= ix.numPost {
 		return 0, 0
 	}
-	i *= postEntrySize
-	t := uint32(d[i])<<16 | uint32(d[i+1])<<8 | uint32(d[i+2])
+	t, n, offset := ix.listAt(i)
 	if t != trigram {
 		return 0, 0
 	}
-	count = int(binary.BigEndian.Uint32(d[i+3:]))
-	offset = binary.BigEndian.Uint32(d[i+3+4:])
-	return
+	return int(n), offset
 }
 
 type postReader struct {
 	ix       *Index
+	trigram  uint32
 	count    int
-	offset   uint32
+	offset   int64
 	fileid   uint32
 	d        []byte
 	restrict []uint32
@@ -228,6 +537,7 @@ func (r *postReader) init(ix *Index, trigram uint32, restrict []uint32) {
 		return
 	}
 	r.ix = ix
+	r.trigram = trigram
 	r.count = count
 	r.offset = offset
 	r.fileid = ^uint32(0)
@@ -245,7 +555,7 @@ func (r *postReader) next() bool {
 		delta64, n := binary.Uvarint(r.d)
 		delta := uint32(delta64)
 		if n <= 0 || delta == 0 {
-			corrupt()
+			r.ix.corrupt("bad posting list for trigram %q", trigramString(r.trigram))
 		}
 		r.d = r.d[n:]
 		r.fileid += delta
@@ -263,14 +573,14 @@ func (r *postReader) next() bool {
 	}
 	// list should end with terminating 0 delta
 	if r.d != nil && (len(r.d) == 0 || r.d[0] != 0) {
-		corrupt()
+		r.ix.corrupt("unterminated posting list for trigram %q", trigramString(r.trigram))
 	}
 	r.fileid = ^uint32(0)
 	return false
 }
 
 func (ix *Index) PostingList(trigram uint32) []uint32 {
-	return ix.postingList(trigram, nil)
+	return ix.live(ix.postingList(trigram, nil))
 }
 
 func (ix *Index) postingList(trigram uint32, restrict []uint32) []uint32 {
@@ -284,7 +594,7 @@ func (ix *Index) postingList(trigram uint32, restrict []uint32) []uint32 {
 }
 
 func (ix *Index) PostingAnd(list []uint32, trigram uint32) []uint32 {
-	return ix.postingAnd(list, trigram, nil)
+	return ix.live(ix.postingAnd(list, trigram, nil))
 }
 
 func (ix *Index) postingAnd(list []uint32, trigram uint32, restrict []uint32) []uint32 {
@@ -306,7 +616,7 @@ func (ix *Index) postingAnd(list []uint32, trigram uint32, restrict []uint32) []
 }
 
 func (ix *Index) PostingOr(list []uint32, trigram uint32) []uint32 {
-	return ix.postingOr(list, trigram, nil)
+	return ix.live(ix.postingOr(list, trigram, nil))
 }
 
 func (ix *Index) postingOr(list []uint32, trigram uint32, restrict []uint32) []uint32 {
@@ -330,10 +640,56 @@ func (ix *Index) postingOr(list []uint32, trigram uint32, restrict []uint32) []u
 }
 
 func (ix *Index) PostingQuery(q *Query) []uint32 {
-	return ix.postingQuery(q, nil)
+	return ix.live(ix.postingQuery(q, nil, nil))
+}
+
+// PostingQueryDone is like PostingQuery but gives up once done is
+// closed, checking between posting lists.  It reports whether it
+// finished; if not, the list it returns is meaningless.
+func (ix *Index) PostingQueryDone(q *Query, done <-chan struct{}) ([]uint32, bool) {
+	list := ix.postingQuery(q, nil, done)
+	if isClosed(done) {
+		return nil, false
+	}
+	return ix.live(list), true
 }
 
-func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
+// isClosed reports whether the channel c, which may be nil, is closed.
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// live removes the deleted files from the sorted list,
+// possibly reusing list's storage.
+func (ix *Index) live(list []uint32) []uint32 {
+	if len(ix.deleted) == 0 {
+		return list
+	}
+	x := list[:0]
+	d := ix.deleted
+	for _, fileid := range list {
+		for len(d) > 0 && d[0] < fileid {
+			d = d[1:]
+		}
+		if len(d) > 0 && d[0] == fileid {
+			continue
+		}
+		x = append(x, fileid)
+	}
+	return x
+}
+
+// postingQuery returns the files matching q among those in restrict,
+// if not nil.  If done is closed, it returns early, with any list.
+func (ix *Index) postingQuery(q *Query, restrict []uint32, done <-chan struct{}) (ret []uint32) {
+	if isClosed(done) {
+		return nil
+	}
 	var list []uint32
 	switch q.Op {
 	case QNone:
@@ -355,7 +711,7 @@ func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
 			} else {
 				list = ix.postingAnd(list, tri, restrict)
 			}
-			if len(list) == 0 {
+			if len(list) == 0 || isClosed(done) {
 				return nil
 			}
 		}
@@ -363,13 +719,16 @@ func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
 			if list == nil {
 				list = restrict
 			}
-			list = ix.postingQuery(sub, list)
+			list = ix.postingQuery(sub, list, done)
 			if len(list) == 0 {
 				return nil
 			}
 		}
 	case QOr:
 		for _, t := range q.Trigram {
+			if isClosed(done) {
+				return nil
+			}
 			tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])
 			if list == nil {
 				list = ix.postingList(tri, restrict)
@@ -378,7 +737,7 @@ func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
 			}
 		}
 		for _, sub := range q.Sub {
-			list1 := ix.postingQuery(sub, restrict)
+			list1 := ix.postingQuery(sub, restrict, done)
 			list = mergeOr(list, list1)
 		}
 	}
@@ -406,8 +765,29 @@ func mergeOr(l1, l2 []uint32) []uint32 {
 	return l
 }
 
-func corrupt() {
-	log.Fatal("corrupt index: remove " + File())
+// corrupt reports that the index is damaged, and how, and exits.
+// While Check runs, it panics with a checkError instead.
+func (ix *Index) corrupt(format string, args ...interface{}) {
+	msg := "corrupt index: " + fmt.Sprintf(format, args...)
+	if ix.checking {
+		panic(checkError(msg))
+	}
+	log.Fatalf("%s: %s; remove it or rebuild it with cindex -reset", ix.name, msg)
+}
+
+// unsupported reports that the index uses a format or features
+// that this package does not know, and exits like corrupt.
+func (ix *Index) unsupported(format string, args ...interface{}) {
+	msg := "unsupported " + fmt.Sprintf(format, args...)
+	if ix.checking {
+		panic(checkError(msg))
+	}
+	log.Fatalf("%s: %s; rebuild it with cindex -reset", ix.name, msg)
+}
+
+// trigramString returns the trigram t as a string.
+func trigramString(t uint32) string {
+	return string([]byte{byte(t >> 16), byte(t >> 8), byte(t)})
 }
 
 // An mmapData is mmap'ed read-only data from a file.
@@ -416,6 +796,19 @@ type mmapData struct {
 	d []byte
 }
 
+// close unmaps the data and closes the file.
+func (m *mmapData) close() error {
+	var err error
+	if m.d != nil {
+		err = munmap(m.d)
+	}
+	if err1 := m.f.Close(); err == nil {
+		err = err1
+	}
+	*m = mmapData{}
+	return err
+}
+
 // mmap maps the given file into memory.
 func mmap(file string) mmapData {
 	f, err := os.Open(file)
@@ -426,11 +819,23 @@ func mmap(file string) mmapData {
 }
 
 // File returns the name of the index file to use.
-// It is either $CSEARCHINDEX or $HOME/.csearchindex.
+// It is the first of the files returned by Files.
 func File() string {
-	f := os.Getenv("CSEARCHINDEX")
-	if f != "" {
-		return f
+	return Files()[0]
+}
+
+// Files returns the names of the index files to search.
+// They are the files in $CSEARCHINDEX, a list separated
+// like $PATH, or else $HOME/.csearchindex.
+func Files() []string {
+	var files []string
+	for _, f := range filepath.SplitList(os.Getenv("CSEARCHINDEX")) {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	if len(files) > 0 {
+		return files
 	}
 	var home string
 	if runtime.GOOS == "windows" {
@@ -438,5 +843,5 @@ func File() string {
 	} else {
 		home = os.Getenv("HOME")
 	}
-	return home + "/.csearchindex"
+	return []string{home + "/.csearchindex"}
 }
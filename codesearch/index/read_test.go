@@ -7,6 +7,9 @@ package index
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -47,6 +50,171 @@ func TestTrivialPosting(t *testing.T) {
 	}
 }
 
+func TestPostingQueryDone(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(out, nil, postFiles)
+	ix := Open(out)
+	defer ix.Close()
+	q := &Query{Op: QAnd, Trigram: []string{"Goo", "Sea"}}
+	if l, ok := ix.PostingQueryDone(q, make(chan struct{})); !ok || !equalList(l, []uint32{1, 3}) {
+		t.Errorf("PostingQueryDone(Goo&Sea) = %v, %v, want [1 3], true", l, ok)
+	}
+	done := make(chan struct{})
+	close(done)
+	if l, ok := ix.PostingQueryDone(q, done); ok {
+		t.Errorf("PostingQueryDone(Goo&Sea) after done = %v, %v, want false", l, ok)
+	}
+}
+
+func TestReadV1(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	f.WriteString(trivialIndexV1)
+	f.Close()
+	ix := Open(f.Name())
+	if n := ix.NumFiles(); n != 6 {
+		t.Errorf("NumFiles() = %d, want 6", n)
+	}
+	if n := ix.Name(3); n != "file3" {
+		t.Errorf("Name(3) = %q, want %q", n, "file3")
+	}
+	if l := ix.PostingList(tri('a', 'b', 'c')); !equalList(l, []uint32{0, 3}) {
+		t.Errorf("PostingList(abc) = %v, want [0 3]", l)
+	}
+	if _, _, ok := ix.Stat(0); ok {
+		t.Errorf("Stat(0) succeeded in version 1 index")
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	f.WriteString(trivialIndexV2)
+	f.Close()
+	ix := Open(f.Name())
+	if v := ix.Version(); v != 2 {
+		t.Errorf("Version() = %d, want 2", v)
+	}
+	if n := ix.Name(5); n != "thefile2" {
+		t.Errorf("Name(5) = %q, want %q", n, "thefile2")
+	}
+	if l := ix.PostingList(tri('b', 'c', '\n')); !equalList(l, []uint32{0, 3}) {
+		t.Errorf("PostingList(bc\\n) = %v, want [0 3]", l)
+	}
+	if lim := ix.Limits(); lim.MaxTextTrigrams != 20000 {
+		t.Errorf("Limits() = %+v, want MaxTextTrigrams 20000", lim)
+	}
+	if err := ix.Verify(); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	f.WriteString(trivialIndex)
+	f.Close()
+	ix := Open(f.Name())
+	if v := ix.Version(); v != FormatVersion {
+		t.Errorf("Version() = %d, want %d", v, FormatVersion)
+	}
+	if err := ix.Verify(); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	ix.Close()
+
+	// Damage a posting list; Open does not notice, but Verify does.
+	data := []byte(trivialIndex)
+	data[16+1+38+10] ^= 0x40
+	ioutil.WriteFile(f.Name(), data, 0666)
+	ix = Open(f.Name())
+	if err := ix.Verify(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Verify of damaged index: %v, want checksum mismatch", err)
+	}
+	ix.Close()
+}
+
+func TestUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, old := range []string{trivialIndexV1, trivialIndexV2} {
+		src := filepath.Join(dir, "old")
+		dst := filepath.Join(dir, "new")
+		ioutil.WriteFile(src, []byte(old), 0666)
+		Upgrade(dst, src)
+		data, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			// Version 2 has all that version 3 records.
+			if string(data) != trivialIndex {
+				t.Errorf("Upgrade(v2) differs from trivial index")
+			}
+		}
+		ix := Open(dst)
+		if v := ix.Version(); v != FormatVersion {
+			t.Errorf("Upgrade(v%d): Version() = %d, want %d", i+1, v, FormatVersion)
+		}
+		if err := ix.Verify(); err != nil {
+			t.Errorf("Upgrade(v%d): Verify: %v", i+1, err)
+		}
+		if n := ix.NumFiles(); n != 6 {
+			t.Errorf("Upgrade(v%d): NumFiles() = %d, want 6", i+1, n)
+		}
+		if l := ix.PostingList(tri('x', 'y', 'z')); !equalList(l, []uint32{4}) {
+			t.Errorf("Upgrade(v%d): PostingList(xyz) = %v, want [4]", i+1, l)
+		}
+		ix.Close()
+	}
+}
+
+func TestLookupStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := dir + "/file"
+	if err := ioutil.WriteFile(name, []byte("hello, world\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := dir + "/index"
+	w := Create(out)
+	w.AddFile(name)
+	w.Flush()
+	ix := Open(out)
+
+	if _, ok := ix.Lookup(dir + "/nonexistent"); ok {
+		t.Errorf("Lookup(nonexistent) succeeded")
+	}
+	id, ok := ix.Lookup(name)
+	if !ok || id != 0 {
+		t.Fatalf("Lookup(%q) = %d, %v, want 0, true", name, id, ok)
+	}
+	size, mtime, ok := ix.Stat(id)
+	if !ok || size != fi.Size() || !mtime.Equal(fi.ModTime()) {
+		t.Errorf("Stat(0) = %d, %v, %v, want %d, %v, true", size, mtime, ok, fi.Size(), fi.ModTime())
+	}
+	if !ix.Unchanged(id, fi) {
+		t.Errorf("Unchanged(0) = false, want true")
+	}
+	if err := ix.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
 func equalList(x, y []uint32) bool {
 	if len(x) != len(y) {
 		return false
@@ -58,3 +226,19 @@ func equalList(x, y []uint32) bool {
 	}
 	return true
 }
+
+func TestFiles(t *testing.T) {
+	defer os.Setenv("CSEARCHINDEX", os.Getenv("CSEARCHINDEX"))
+	sep := string(filepath.ListSeparator)
+	os.Setenv("CSEARCHINDEX", "/a/index"+sep+sep+"/b/index")
+	if f := Files(); !reflect.DeepEqual(f, []string{"/a/index", "/b/index"}) {
+		t.Errorf("Files() = %q, want [/a/index /b/index]", f)
+	}
+	if f := File(); f != "/a/index" {
+		t.Errorf("File() = %q, want /a/index", f)
+	}
+	os.Setenv("CSEARCHINDEX", "")
+	if f := Files(); len(f) != 1 || filepath.Base(f[0]) != ".csearchindex" {
+		t.Errorf("Files() = %q, want [$HOME/.csearchindex]", f)
+	}
+}
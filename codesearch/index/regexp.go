@@ -47,6 +47,17 @@ func (q *Query) or(r *Query) *Query {
 	return q.andOr(r, QOr)
 }
 
+// And returns the query q AND r, for combining the queries of several
+// regexps.  It may reuse q's and r's storage.
+func (q *Query) And(r *Query) *Query {
+	return q.and(r)
+}
+
+// Or returns the query q OR r.  It may reuse q's and r's storage.
+func (q *Query) Or(r *Query) *Query {
+	return q.or(r)
+}
+
 // andOr returns the query q AND r or q OR r, possibly reusing q's and r's storage.
 // It works hard to avoid creating unnecessarily complicated structures.
 func (q *Query) andOr(r *Query, op QueryOp) (out *Query) {
@@ -331,12 +342,56 @@ func (q *Query) String() string {
 
 // RegexpQuery returns a Query for the given regexp.
 func RegexpQuery(re *syntax.Regexp) *Query {
+	if lits, fold, _, ok := Literals(re); ok {
+		return literalQuery(lits, fold)
+	}
 	info := analyze(re)
 	info.simplify(true)
 	info.addExact()
 	return info.match
 }
 
+// literalQuery returns the Query for a regexp matching exactly the
+// strings lits, ignoring ASCII case if fold is set.  Unlike the query
+// that analyze derives, which gives up on long alternations and folded
+// strings, it lists every trigram of every string.
+func literalQuery(lits []string, fold bool) *Query {
+	or := noneQuery
+	for _, lit := range lits {
+		if len(lit) < 3 {
+			return &Query{Op: QAll}
+		}
+		and := allQuery
+		for i := 0; i+3 <= len(lit); i++ {
+			trig := stringSet{lit[i : i+3]}
+			if fold {
+				trig = foldTrigram(lit[i : i+3])
+			}
+			and = and.and(&Query{Op: QOr, Trigram: trig})
+		}
+		or = or.or(and)
+	}
+	return or
+}
+
+// foldTrigram returns the case variants of the lower-case trigram t.
+func foldTrigram(t string) stringSet {
+	set := stringSet{""}
+	for i := 0; i < len(t); i++ {
+		c := t[i]
+		var next stringSet
+		for _, s := range set {
+			next = append(next, s+string(c))
+			if 'a' <= c && c <= 'z' {
+				next = append(next, s+string(c-'a'+'A'))
+			}
+		}
+		set = next
+	}
+	set.clean(false)
+	return set
+}
+
 // A regexpInfo summarizes the results of analyzing a regexp.
 type regexpInfo struct {
 	// canEmpty records whether the regexp matches the empty string
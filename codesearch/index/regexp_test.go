@@ -92,3 +92,29 @@ func TestQuery(t *testing.T) {
 		}
 	}
 }
+
+var literalQueryTests = []struct {
+	re string
+	q  string
+}{
+	{`hello`, `"ell" "hel" "llo"`},
+	{`\bhello\b`, `"ell" "hel" "llo"`},
+	{`(?i)hello`, `("HEL"|"HEl"|"HeL"|"Hel"|"hEL"|"hEl"|"heL"|"hel") ("ELL"|"ELl"|"ElL"|"Ell"|"eLL"|"eLl"|"elL"|"ell") ("LLO"|"LLo"|"LlO"|"Llo"|"lLO"|"lLo"|"llO"|"llo")`},
+	{`(?i)a1_b`, `("A1_"|"a1_") ("1_B"|"1_b")`},
+	{`foo|ab`, `+`},
+	{`alpha|beta|gamma|delta|epsilon|zeta`,
+		`("alp" "lph" "pha")|("bet" "eta")|("del" "elt" "lta")|("eps" "ilo" "lon" "psi" "sil")|("amm" "gam" "mma")|("zet" "eta")`},
+}
+
+func TestLiteralQuery(t *testing.T) {
+	for _, tt := range literalQueryTests {
+		re, err := syntax.Parse(tt.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := RegexpQuery(re).String()
+		if q != tt.q {
+			t.Errorf("RegexpQuery(%#q) = %#q, want %#q", tt.re, q, tt.q)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+// Sharded indexes.
+//
+// Rewriting a large index for every update is slow, and index files
+// in the version 1 and 2 formats cannot exceed 4 GB, so a large index
+// is split into shards, each an ordinary index file holding a disjoint
+// set of files, and the index file itself becomes a manifest listing
+// the shards:
+//
+//	"csearch manifest 1\n"
+//	shard file names, one per line
+//
+// The shard names are relative to the directory holding the manifest.
+// Because no file is in two shards, the files that a query identifies
+// in a sharded index are the union of those it identifies in the shards.
+//
+// A writer never modifies an index file in place.  It writes new shards
+// under unused names, replaces the index file by renaming a new manifest
+// or index onto it, and only then removes the shards that are no longer
+// listed.  A reader that opens the index while it is being replaced may
+// therefore find a listed shard missing, or find the index file naming
+// other shards than it read a moment before; OpenShards notices and
+// starts over.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const manifestMagic = "csearch manifest 1\n"
+
+// Shards returns the names of the index files making up the index in
+// file: the shards listed in file if it is a manifest, or else file.
+func Shards(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if head, err := r.Peek(len(manifestMagic)); err != nil || string(head) != manifestMagic {
+		return []string{file}, nil
+	}
+	r.Discard(len(manifestMagic))
+	var shards []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if name := s.Text(); name != "" {
+			shards = append(shards, filepath.Join(filepath.Dir(file), name))
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("%s: manifest lists no shards", file)
+	}
+	return shards, nil
+}
+
+// openTries is the number of times OpenShards tries to open an index
+// that keeps being replaced before it gives up.
+const openTries = 10
+
+// OpenShards opens the shards of the index in file, as listed by Shards,
+// and returns their names and the open indexes.  If a writer replaces the
+// index while OpenShards opens it, OpenShards starts over, so that the
+// shards it returns all belong to one version of the index.  Unlike Open,
+// OpenShards returns an error if the index is missing or damaged.
+func OpenShards(file string) ([]string, []*Index, error) {
+	for try := 1; ; try++ {
+		before, err := os.Stat(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		shards, ixs, err := openShards(file)
+		after, err1 := os.Stat(file)
+		if err1 == nil && sameFile(before, after) {
+			return shards, ixs, err
+		}
+		for _, ix := range ixs {
+			ix.Close()
+		}
+		if try == openTries {
+			return nil, nil, fmt.Errorf("%s: index keeps changing", file)
+		}
+		time.Sleep(time.Duration(try) * 10 * time.Millisecond)
+	}
+}
+
+// openShards opens the shards of the index in file.
+// If it returns an error, it returns no open indexes.
+func openShards(file string) ([]string, []*Index, error) {
+	shards, err := Shards(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ixs []*Index
+	for _, shard := range shards {
+		ix, err := open(shard)
+		if err != nil {
+			for _, ix := range ixs {
+				ix.Close()
+			}
+			return nil, nil, err
+		}
+		ixs = append(ixs, ix)
+	}
+	return shards, ixs, nil
+}
+
+// open opens the index in file like Open,
+// but it returns damage as an error.
+func open(file string) (ix *Index, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	ix = &Index{name: file, data: mmapFile(f), checking: true}
+	defer func() {
+		if err != nil {
+			ix.Close()
+			ix = nil
+		}
+	}()
+	defer catch(file, &err)
+	ix.init()
+	ix.checking = false
+	return ix, nil
+}
+
+// sameFile reports whether fi1 and fi2 describe
+// the same, unmodified file.
+func sameFile(fi1, fi2 os.FileInfo) bool {
+	return os.SameFile(fi1, fi2) && fi1.Size() == fi2.Size() && fi1.ModTime().Equal(fi2.ModTime())
+}
+
+// WriteManifest writes to file a manifest listing shards, which must
+// be in the same directory as file.  It replaces file atomically, so
+// that readers see either the old index or the new one.
+func WriteManifest(file string, shards []string) error {
+	dir := filepath.Dir(file)
+	var buf bytes.Buffer
+	buf.WriteString(manifestMagic)
+	for _, s := range shards {
+		if filepath.Dir(s) != dir {
+			return fmt.Errorf("shard %s not in directory of %s", s, file)
+		}
+		buf.WriteString(filepath.Base(s) + "\n")
+	}
+	f, err := ioutil.TempFile(dir, filepath.Base(file)+"~")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
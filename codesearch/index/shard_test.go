@@ -0,0 +1,68 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	whole := filepath.Join(dir, "whole")
+	buildIndex(whole, nil, postFiles)
+	if s, err := Shards(whole); err != nil || !reflect.DeepEqual(s, []string{whole}) {
+		t.Errorf("Shards(whole) = %v, %v, want [whole]", s, err)
+	}
+
+	// Split postFiles between two shards.
+	shard1 := filepath.Join(dir, "index.0")
+	shard2 := filepath.Join(dir, "index.1")
+	buildIndex(shard1, nil, map[string]string{"file0": postFiles["file0"], "file3": postFiles["file3"]})
+	buildIndex(shard2, nil, map[string]string{"file1": postFiles["file1"], "file2": postFiles["file2"]})
+	manifest := filepath.Join(dir, "index")
+	if err := WriteManifest(manifest, []string{shard1, shard2}); err != nil {
+		t.Fatal(err)
+	}
+	shards, err := Shards(manifest)
+	if err != nil || !reflect.DeepEqual(shards, []string{shard1, shard2}) {
+		t.Fatalf("Shards(manifest) = %v, %v, want [%s %s]", shards, err, shard1, shard2)
+	}
+	if err := WriteManifest(manifest, []string{"/elsewhere/index.0"}); err == nil {
+		t.Errorf("WriteManifest accepted shard in another directory")
+	}
+
+	// The shards together find what the whole index finds.
+	for _, q := range []*Query{
+		{Op: QAll},
+		{Op: QAnd, Trigram: []string{"Sea", "Goo"}},
+		{Op: QOr, Trigram: []string{"Web", "Pro"}},
+	} {
+		var want, got []string
+		ix := Open(whole)
+		for _, id := range ix.PostingQuery(q) {
+			want = append(want, ix.Name(id))
+		}
+		for _, shard := range shards {
+			ix := Open(shard)
+			for _, id := range ix.PostingQuery(q) {
+				got = append(got, ix.Name(id))
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("query %s: shards found %v, whole index %v", q, got, want)
+		}
+	}
+}
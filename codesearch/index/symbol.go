@@ -0,0 +1,343 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+// Symbols.
+//
+// IndexWriter parses the Go files it indexes and records their top-level
+// declarations in the "syms" section, so that a search for a declaration
+// need not look at every file that mentions the name.  The section holds
+// one entry per declaration:
+//
+//	name, NUL-terminated
+//	kind [1]
+//	file ID [4]
+//	line [4]
+//
+// A method is recorded under the name Type.Method.  The entries are
+// sorted by key, the name or, for a method, the part after the dot,
+// then by name, file ID, and line, so that the declarations matching a
+// name are adjacent.  The "symx" section holds the 4-byte big-endian
+// offset of each entry in the "syms" section, in the same order, for
+// binary search.  Deleting a file leaves its entries in place; like
+// its posting list entries, readers must skip them.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// A SymbolKind says what kind of declaration a Symbol is.
+type SymbolKind byte
+
+const (
+	SymFunc   SymbolKind = 'f'
+	SymMethod SymbolKind = 'm'
+	SymType   SymbolKind = 't'
+	SymConst  SymbolKind = 'c'
+	SymVar    SymbolKind = 'v'
+)
+
+func (k SymbolKind) String() string {
+	switch k {
+	case SymFunc:
+		return "func"
+	case SymMethod:
+		return "method"
+	case SymType:
+		return "type"
+	case SymConst:
+		return "const"
+	case SymVar:
+		return "var"
+	}
+	return "unknown"
+}
+
+// A Symbol is a top-level declaration in a Go file.
+type Symbol struct {
+	Name   string // declared name; Type.Method for a method
+	Kind   SymbolKind
+	FileID uint32 // file declaring the symbol
+	Line   int    // line of the declared name
+}
+
+// Matches reports whether s is a declaration of name, which is
+// either a plain name or, to pick out a method, Type.Method.
+func (s *Symbol) Matches(name string) bool {
+	return s.Name == name || s.Kind == SymMethod && strings.HasSuffix(s.Name, "."+name) && len(s.Name) > len(name)+1
+}
+
+// ParseSymbols returns the top-level declarations in src, the contents
+// of the Go file with the given name, with FileID zero.  If the file
+// has syntax errors, ParseSymbols returns the declarations it could
+// parse, if any.
+func ParseSymbols(name string, src []byte) []Symbol {
+	fset := token.NewFileSet()
+	f, _ := parser.ParseFile(fset, name, src, 0)
+	if f == nil {
+		return nil
+	}
+	var syms []Symbol
+	add := func(id *ast.Ident, kind SymbolKind, prefix string) {
+		if id == nil || id.Name == "_" {
+			return
+		}
+		syms = append(syms, Symbol{prefix + id.Name, kind, 0, fset.Position(id.Pos()).Line})
+	}
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil || len(d.Recv.List) == 0 {
+				add(d.Name, SymFunc, "")
+			} else if recv := recvName(d.Recv.List[0].Type); recv != "" {
+				add(d.Name, SymMethod, recv+".")
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					add(spec.Name, SymType, "")
+				case *ast.ValueSpec:
+					kind := SymVar
+					if d.Tok == token.CONST {
+						kind = SymConst
+					}
+					for _, id := range spec.Names {
+						add(id, kind, "")
+					}
+				}
+			}
+		}
+	}
+	return syms
+}
+
+// recvName returns the name of the type in the method receiver type x,
+// or "" if x is not a valid receiver type.
+func recvName(x ast.Expr) string {
+	for {
+		switch t := x.(type) {
+		case *ast.Ident:
+			return t.Name
+		case *ast.StarExpr:
+			x = t.X
+		case *ast.ParenExpr:
+			x = t.X
+		case *ast.IndexExpr:
+			x = t.X
+		case *ast.IndexListExpr:
+			x = t.X
+		default:
+			return ""
+		}
+	}
+}
+
+// isGo reports whether the file with the given name is a Go file,
+// whose declarations IndexWriter records.
+func isGo(name string) bool {
+	return strings.HasSuffix(name, ".go")
+}
+
+// symbolKey returns the name under which the symbol table sorts the
+// symbol with the given name: the method name of Type.Method, or else
+// the name itself.  All the declarations that match a name share its key.
+func symbolKey(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// symbolLess reports whether a sorts before b in the symbol table.
+func symbolLess(a, b *Symbol) bool {
+	if ka, kb := symbolKey(a.Name), symbolKey(b.Name); ka != kb {
+		return ka < kb
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if a.FileID != b.FileID {
+		return a.FileID < b.FileID
+	}
+	return a.Line < b.Line
+}
+
+// addSymbols sorts syms and writes them to dst as the "syms" section
+// and their offsets as the "symx" section.
+func (w *sectionWriter) addSymbols(dst *bufWriter, syms []Symbol) {
+	sort.Slice(syms, func(i, j int) bool { return symbolLess(&syms[i], &syms[j]) })
+	var b, x []byte
+	var buf [8]byte
+	for _, s := range syms {
+		binary.BigEndian.PutUint32(buf[:], uint32(len(b)))
+		x = append(x, buf[:4]...)
+		b = append(b, s.Name...)
+		b = append(b, 0, byte(s.Kind))
+		binary.BigEndian.PutUint32(buf[0:], s.FileID)
+		binary.BigEndian.PutUint32(buf[4:], uint32(s.Line))
+		b = append(b, buf[:]...)
+	}
+	w.add(dst, "syms", b)
+	w.add(dst, "symx", x)
+}
+
+// symbolAt decodes the entry at the start of d, the rest of
+// the "syms" section of ix, and returns it and its length.
+func (ix *Index) symbolAt(d []byte) (Symbol, int) {
+	i := bytes.IndexByte(d, 0)
+	if i < 0 || len(d) < i+1+1+8 {
+		ix.corrupt("truncated symbol table")
+	}
+	s := Symbol{
+		Name:   string(d[:i]),
+		Kind:   SymbolKind(d[i+1]),
+		FileID: binary.BigEndian.Uint32(d[i+2:]),
+		Line:   int(binary.BigEndian.Uint32(d[i+6:])),
+	}
+	return s, i + 10
+}
+
+// allSymbols returns the entries of the "syms" section of ix,
+// including those of deleted files, and whether there is such
+// a section.
+func (ix *Index) allSymbols() ([]Symbol, bool) {
+	d, ok := ix.sectionData("syms")
+	if !ok {
+		return nil, false
+	}
+	var syms []Symbol
+	for len(d) > 0 {
+		s, n := ix.symbolAt(d)
+		syms = append(syms, s)
+		d = d[n:]
+	}
+	return syms, true
+}
+
+// symbolIndex returns the "syms" section of ix and the offsets of its
+// entries from the "symx" section, or ok == false if ix has no "symx"
+// section.  Indexes written before there was one sort their symbol
+// table by name alone.
+func (ix *Index) symbolIndex() (d, x []byte, ok bool) {
+	x, ok = ix.sectionData("symx")
+	if !ok {
+		return nil, nil, false
+	}
+	d, _ = ix.sectionData("syms")
+	if len(x)%4 != 0 {
+		ix.corrupt("symbol index has length %d", len(x))
+	}
+	return d, x, true
+}
+
+// symbolEntry returns the symbol table d from the start of its i'th
+// entry, whose offset is in x.
+func (ix *Index) symbolEntry(d, x []byte, i int) []byte {
+	off := binary.BigEndian.Uint32(x[4*i:])
+	if int64(off) >= int64(len(d)) {
+		ix.corrupt("symbol %d at offset %d of %d", i, off, len(d))
+	}
+	return d[off:]
+}
+
+// symbolName returns the name in the i'th entry of the symbol table d
+// with entry offsets x.
+func (ix *Index) symbolName(d, x []byte, i int) string {
+	e := ix.symbolEntry(d, x, i)
+	if j := bytes.IndexByte(e, 0); j >= 0 {
+		e = e[:j]
+	}
+	return string(e)
+}
+
+// HasSymbols reports whether ix records the declarations of its
+// Go files.  Indexes written before symbols were recorded, and
+// indexes without Go files, do not.
+func (ix *Index) HasSymbols() bool {
+	_, _, ok := ix.section("syms")
+	return ok
+}
+
+// Symbols returns the declarations of name in the live files of ix,
+// in order of file ID and line.  Name is a plain name, which matches
+// functions, types, constants, variables, and methods of that name,
+// or Type.Method.
+func (ix *Index) Symbols(name string) []Symbol {
+	var cand []Symbol
+	if d, x, ok := ix.symbolIndex(); ok {
+		// The candidates are the entries with the key of name.
+		key := symbolKey(name)
+		n := len(x) / 4
+		i := sort.Search(n, func(i int) bool { return symbolKey(ix.symbolName(d, x, i)) >= key })
+		for ; i < n; i++ {
+			s, _ := ix.symbolAt(ix.symbolEntry(d, x, i))
+			if symbolKey(s.Name) != key {
+				break
+			}
+			cand = append(cand, s)
+		}
+	} else {
+		cand, _ = ix.allSymbols()
+	}
+	var syms []Symbol
+	for i := range cand {
+		s := &cand[i]
+		if s.FileID >= uint32(ix.numName) {
+			ix.corrupt("symbol %s in file %d of %d", s.Name, s.FileID, ix.numName)
+		}
+		if s.Matches(name) && !ix.Deleted(s.FileID) {
+			syms = append(syms, *s)
+		}
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		if syms[i].FileID != syms[j].FileID {
+			return syms[i].FileID < syms[j].FileID
+		}
+		return syms[i].Line < syms[j].Line
+	})
+	return syms
+}
+
+// mapSymbols appends to dst the symbols of ix whose files
+// are mapped by idmap, with their new file IDs.
+func (ix *Index) mapSymbols(dst []Symbol, idmap []idrange) []Symbol {
+	syms, _ := ix.allSymbols()
+	sort.Slice(syms, func(i, j int) bool { return syms[i].FileID < syms[j].FileID })
+	// The ranges are sorted too, so one pass over both does.
+	r := idmap
+	for _, s := range syms {
+		for len(r) > 0 && r[0].hi <= s.FileID {
+			r = r[1:]
+		}
+		if len(r) == 0 {
+			break
+		}
+		if r[0].lo <= s.FileID {
+			s.FileID = s.FileID - r[0].lo + r[0].new
+			dst = append(dst, s)
+		}
+	}
+	return dst
+}
+
+// symbolsComplete reports whether ix records the declarations
+// of the Go files among those mapped by idmap.
+func (ix *Index) symbolsComplete(idmap []idrange) bool {
+	if ix.HasSymbols() {
+		return true
+	}
+	for _, r := range idmap {
+		for id := r.lo; id < r.hi; id++ {
+			if isGo(ix.Name(id)) {
+				return false
+			}
+		}
+	}
+	return true
+}
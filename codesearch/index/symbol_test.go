@@ -0,0 +1,154 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const symbolSrc = `package p
+
+import "io"
+
+func Open(name string) (io.Reader, error) { return nil, nil }
+
+type (
+	File struct{}
+	List[T any] []T
+)
+
+func (f *File) Close() error { return nil }
+func (l List[T]) Len() int   { return len(l) }
+
+const Max, _ = 10, 0
+
+var (
+	open = Open
+	x, y int
+)
+
+func init() {}
+`
+
+func TestParseSymbols(t *testing.T) {
+	want := []Symbol{
+		{"Open", SymFunc, 0, 5},
+		{"File", SymType, 0, 8},
+		{"List", SymType, 0, 9},
+		{"File.Close", SymMethod, 0, 12},
+		{"List.Len", SymMethod, 0, 13},
+		{"Max", SymConst, 0, 15},
+		{"open", SymVar, 0, 18},
+		{"x", SymVar, 0, 19},
+		{"y", SymVar, 0, 19},
+		{"init", SymFunc, 0, 22},
+	}
+	if syms := ParseSymbols("p.go", []byte(symbolSrc)); !reflect.DeepEqual(syms, want) {
+		t.Errorf("ParseSymbols:\nhave %v\nwant %v", syms, want)
+	}
+
+	// A file with a syntax error still yields
+	// the declarations before the error.
+	syms := ParseSymbols("bad.go", []byte("package p\n\nfunc F() {}\n\nfunc {\n"))
+	if len(syms) != 1 || syms[0].Name != "F" {
+		t.Errorf("ParseSymbols(bad.go) = %v, want F", syms)
+	}
+}
+
+var symbolFiles = map[string]string{
+	"/a/close.go": "package a\n\nfunc Close() {}\n",
+	"/a/file.go":  symbolSrc,
+	"/a/file.txt": "func Close() {}\n",
+	"/b/b.go":     "package b\n\ntype File int\n\nfunc (File) Close() error { return nil }\n",
+}
+
+func TestSymbols(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(out, nil, symbolFiles)
+	if err := Check(out); err != nil {
+		t.Fatal(err)
+	}
+
+	ix := Open(out)
+	defer ix.Close()
+	if !ix.HasSymbols() {
+		t.Fatalf("HasSymbols() = false, want true")
+	}
+	if _, _, ok := ix.symbolIndex(); !ok {
+		t.Fatalf("no symbol index")
+	}
+	check := func(name string, want ...string) {
+		t.Helper()
+		var have []string
+		for _, s := range ix.Symbols(name) {
+			have = append(have, ix.Name(s.FileID)+":"+s.Kind.String()+":"+s.Name)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("Symbols(%q) = %v, want %v", name, have, want)
+		}
+	}
+	check("Close", "/a/close.go:func:Close", "/a/file.go:method:File.Close", "/b/b.go:method:File.Close")
+	check("File.Close", "/a/file.go:method:File.Close", "/b/b.go:method:File.Close")
+	check("File", "/a/file.go:type:File", "/b/b.go:type:File")
+	check("ile.Close")
+	check("Len", "/a/file.go:method:List.Len")
+	check("missing")
+
+	out2 := out + "~"
+	defer os.Remove(out2)
+	Delete(out2, out, []string{"/a/file.go"})
+	ix2 := Open(out2)
+	defer ix2.Close()
+	if syms := ix2.Symbols("File"); len(syms) != 1 || ix2.Name(syms[0].FileID) != "/b/b.go" {
+		t.Errorf("Symbols(File) after delete = %v, want only /b/b.go", syms)
+	}
+
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f3.Name())
+	buildIndex(f3.Name(), nil, map[string]string{"/a/a.txt": "no Go here\n"})
+	ix3 := Open(f3.Name())
+	defer ix3.Close()
+	if ix3.HasSymbols() {
+		t.Errorf("HasSymbols() = true for index without Go files")
+	}
+}
+
+func TestUpdateSymbols(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+
+	buildIndex(f1.Name(), []string{"/a", "/b"}, symbolFiles)
+	buildIndex(f2.Name(), []string{"/a"}, map[string]string{
+		"/a/close.go": "package a\n\n// Close is gone.\n\nfunc Shut() {}\n",
+		"/a/new.txt":  "text\n",
+	})
+
+	// /a/close.go changed and /a/file.go was deleted.
+	Update(f3.Name(), f1.Name(), f2.Name(), []string{"/a/file.go"})
+	if err := Check(f3.Name()); err != nil {
+		t.Fatal(err)
+	}
+	ix := Open(f3.Name())
+	defer ix.Close()
+	var have []string
+	for _, name := range []string{"Close", "Shut", "File"} {
+		for _, s := range ix.Symbols(name) {
+			have = append(have, ix.Name(s.FileID)+":"+s.Name)
+		}
+	}
+	want := []string{"/b/b.go:File.Close", "/a/close.go:Shut", "/b/b.go:File"}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("symbols after Update = %v, want %v", have, want)
+	}
+}
@@ -5,13 +5,19 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"runtime"
 	"strings"
 	"unsafe"
 
+	"github.com/mars9/kanabe/codesearch/source"
 	"github.com/mars9/kanabe/codesearch/sparse"
 )
 
@@ -26,27 +32,45 @@ import (
 // create the final posting lists by merging the temporary files as we
 // read them back in.
 //
-// It would also be useful to be able to create an index for a subset
-// of the files and then merge that index into an existing one.  This would
-// allow incremental updating of an existing index when a directory changes.
-// But we have not implemented that.
+// To update an existing index incrementally, create an index for just
+// the files that were added or changed and then combine it with the
+// existing one using Update, which reuses the existing posting lists
+// for the files that did not change.  The size and modification time
+// recorded for each file (see Index.Stat) tell which files those are.
 
 // An IndexWriter creates an on-disk index corresponding to a set of files.
 type IndexWriter struct {
-	LogSkip bool // log information about skipped files
-	Verbose bool // log status using package log
+	LogSkip bool   // log information about skipped files
+	Verbose bool   // log status using package log
+	Workers int    // number of files AddFiles reads in parallel; 0 means DefaultWorkers()
+	Limits  Limits // limits for detecting text files; recorded in the index
+
+	// SkipFunc, if not nil, is called for each file that is not indexed
+	// because it does not look like text, with the reason why.
+	// AddFiles calls it in the order of the names.
+	SkipFunc func(name, reason string)
+
+	// Source is where AddFile and AddFiles read files;
+	// nil means source.Local, the local file system.
+	Source source.Source
 
 	trigram *sparse.Set // trigrams for the current file
 	buf     [8]byte     // scratch buffer
 
-	paths []string
+	paths   []string
+	filters []string // file selection rules, if hasFilt
+	hasFilt bool
 
 	nameData   *bufWriter // temp file holding list of names
 	nameLen    uint32     // number of bytes written to nameData
 	nameIndex  *bufWriter // temp file holding name index
+	statData   *bufWriter // temp file holding file stat section
 	numName    int        // number of names written
 	totalBytes int64
 
+	syms  []Symbol // declarations in Go files
+	langs []string // language of each file
+
 	post      []postEntry // list of (trigram, file#) pairs
 	postFile  []*os.File  // flushed post entries
 	postIndex *bufWriter  // temp file holding posting list index
@@ -63,10 +87,12 @@ func Create(file string) *IndexWriter {
 		trigram:   sparse.NewSet(1 << 24),
 		nameData:  bufCreate(""),
 		nameIndex: bufCreate(""),
+		statData:  bufCreate(""),
 		postIndex: bufCreate(""),
 		main:      bufCreate(file),
 		post:      make([]postEntry, 0, npost),
 		inbuf:     make([]byte, 16384),
+		Limits:    DefaultLimits,
 	}
 }
 
@@ -85,26 +111,42 @@ func makePostEntry(trigram, fileid uint32) postEntry {
 	return postEntry(trigram)<<32 | postEntry(fileid)
 }
 
-// Tuning constants for detecting text files.
-// A file is assumed not to be text files (and thus not indexed)
-// if it contains an invalid UTF-8 sequences, if it is longer than maxFileLength
-// bytes, if it contains a line longer than maxLineLen bytes,
-// or if it contains more than maxTextTrigrams distinct trigrams.
-const (
-	maxFileLen      = 1 << 30
-	maxLineLen      = 2000
-	maxTextTrigrams = 20000
-)
+// Limits holds the tuning parameters for detecting text files.
+// A file is assumed not to be text (and thus not indexed)
+// if it contains an invalid UTF-8 sequence, if it is longer than
+// MaxFileLen bytes, if it contains a line longer than MaxLineLen bytes,
+// or if it contains more than MaxTextTrigrams distinct trigrams.
+type Limits struct {
+	MaxFileLen      int64
+	MaxLineLen      int
+	MaxTextTrigrams int
+}
+
+// DefaultLimits are the limits that Create sets.
+var DefaultLimits = Limits{
+	MaxFileLen:      1 << 30,
+	MaxLineLen:      2000,
+	MaxTextTrigrams: 20000,
+}
 
 // AddPaths adds the given paths to the index's list of paths.
 func (ix *IndexWriter) AddPaths(paths []string) {
 	ix.paths = append(ix.paths, paths...)
 }
 
-// AddFile adds the file with the given name (opened using os.Open)
-// to the index.  It logs errors using package log.
+// SetFilters records in the index the rules used to select the files
+// to index, so that a later indexing run can apply them again.
+// The rules are opaque to the index; they must not contain NUL bytes.
+func (ix *IndexWriter) SetFilters(rules []string) {
+	ix.filters = rules
+	ix.hasFilt = true
+}
+
+// AddFile adds the file with the given name (opened from ix.Source)
+// to the index, recording its size and modification time.
+// It logs errors using package log.
 func (ix *IndexWriter) AddFile(name string) {
-	f, err := os.Open(name)
+	f, err := ix.open(name)
 	if err != nil {
 		log.Print(err)
 		return
@@ -113,16 +155,73 @@ func (ix *IndexWriter) AddFile(name string) {
 	ix.Add(name, f)
 }
 
+// open opens the named file from ix.Source.
+func (ix *IndexWriter) open(name string) (io.ReadCloser, error) {
+	if ix.Source != nil {
+		return ix.Source.Open(name)
+	}
+	return source.Local.Open(name)
+}
+
+// A statReader is an io.Reader that can report the size and
+// modification time of the underlying file, like *os.File.
+type statReader interface {
+	io.Reader
+	Stat() (os.FileInfo, error)
+}
+
 // Add adds the file f to the index under the given name.
+// If f has a Stat method, as *os.File does, Add records the
+// file's size and modification time in the index.
 // It logs errors using package log.
 func (ix *IndexWriter) Add(name string, f io.Reader) {
-	ix.trigram.Reset()
+	t := ix.scan(name, f, ix.trigram, ix.inbuf)
+	if !t.ok {
+		ix.skip(name, t.reason)
+		return
+	}
+	t.size, t.mtime = stat(f)
+	t.trigrams = ix.trigram.Dense()
+	ix.add(&t)
+}
+
+// stat returns the size and modification time of f,
+// or zeros if f cannot report them.
+func stat(f io.Reader) (size, mtime int64) {
+	if sf, ok := f.(statReader); ok {
+		if fi, err := sf.Stat(); err == nil {
+			return fi.Size(), fi.ModTime().UnixNano()
+		}
+	}
+	return 0, 0
+}
+
+// skip reports that the named file is not indexed for the given reason,
+// if any.  An empty reason means that the file could not be read,
+// which tokenize has already logged.
+func (ix *IndexWriter) skip(name, reason string) {
+	if reason == "" {
+		return
+	}
+	if ix.LogSkip {
+		log.Printf("%s: %s, ignoring\n", name, reason)
+	}
+	if ix.SkipFunc != nil {
+		ix.SkipFunc(name, reason)
+	}
+}
+
+// tokenize reads f, collecting its trigrams in the set t and using
+// inbuf as the read buffer.  It returns the number of bytes read and
+// whether the file looks like text that should be indexed, and,
+// if the file can be read but does not, the reason why not.
+func (ix *IndexWriter) tokenize(name string, f io.Reader, t *sparse.Set, inbuf []byte) (n int64, reason string, ok bool) {
+	t.Reset()
 	var (
 		c       = byte(0)
 		i       = 0
-		buf     = ix.inbuf[:0]
+		buf     = inbuf[:0]
 		tv      = uint32(0)
-		n       = int64(0)
 		linelen = 0
 	)
 	for {
@@ -135,10 +234,10 @@ func (ix *IndexWriter) Add(name string, f io.Reader) {
 						break
 					}
 					log.Printf("%s: %v\n", name, err)
-					return
+					return 0, "", false
 				}
 				log.Printf("%s: 0-length read\n", name)
-				return
+				return 0, "", false
 			}
 			buf = buf[:n]
 			i = 0
@@ -147,56 +246,178 @@ func (ix *IndexWriter) Add(name string, f io.Reader) {
 		i++
 		tv |= uint32(c)
 		if n++; n >= 3 {
-			ix.trigram.Add(tv)
+			t.Add(tv)
 		}
 		if !validUTF8((tv>>8)&0xFF, tv&0xFF) {
-			if ix.LogSkip {
-				log.Printf("%s: invalid UTF-8, ignoring\n", name)
-			}
-			return
+			return 0, "invalid UTF-8", false
 		}
-		if n > maxFileLen {
-			if ix.LogSkip {
-				log.Printf("%s: too long, ignoring\n", name)
-			}
-			return
+		if n > ix.Limits.MaxFileLen {
+			return 0, "too long", false
 		}
-		if linelen++; linelen > maxLineLen {
-			if ix.LogSkip {
-				log.Printf("%s: very long lines, ignoring\n", name)
-			}
-			return
+		if linelen++; linelen > ix.Limits.MaxLineLen {
+			return 0, "very long lines", false
 		}
 		if c == '\n' {
 			linelen = 0
 		}
 	}
-	if ix.trigram.Len() > maxTextTrigrams {
-		if ix.LogSkip {
-			log.Printf("%s: too many trigrams, probably not text, ignoring\n", name)
+	if t.Len() > ix.Limits.MaxTextTrigrams {
+		return 0, "too many trigrams, probably not text", false
+	}
+	return n, "", true
+}
+
+// scan tokenizes f like tokenize, collecting its trigrams in t,
+// and determines its language and, if it is a Go file, the
+// declarations in it.  It leaves the size, modification time,
+// and trigrams of the result for the caller to fill in.
+func (ix *IndexWriter) scan(name string, f io.Reader, t *sparse.Set, inbuf []byte) tokenized {
+	r := tokenized{name: name}
+	h := &headReader{r: f}
+	if !isGo(name) {
+		r.n, r.reason, r.ok = ix.tokenize(name, h, t, inbuf)
+	} else {
+		var src bytes.Buffer
+		r.n, r.reason, r.ok = ix.tokenize(name, io.TeeReader(h, &src), t, inbuf)
+		if r.ok {
+			r.syms = ParseSymbols(name, src.Bytes())
 		}
-		return
 	}
-	ix.totalBytes += n
+	if r.ok {
+		r.lang = Language(name, h.head)
+	}
+	return r
+}
+
+// add adds the tokenized file t to the index.
+func (ix *IndexWriter) add(t *tokenized) {
+	ix.totalBytes += t.n
 
 	if ix.Verbose {
-		log.Printf("%d %d %s\n", n, ix.trigram.Len(), name)
+		log.Printf("%d %d %s\n", t.n, len(t.trigrams), t.name)
 	}
 
-	fileid := ix.addName(name)
-	for _, trigram := range ix.trigram.Dense() {
+	fileid := ix.addName(t.name)
+	ix.statData.writeUint64(uint64(t.size))
+	ix.statData.writeUint64(uint64(t.mtime))
+	ix.langs = append(ix.langs, t.lang)
+	for _, trigram := range t.trigrams {
 		if len(ix.post) >= cap(ix.post) {
 			ix.flushPost()
 		}
 		ix.post = append(ix.post, makePostEntry(trigram, fileid))
 	}
+	for _, s := range t.syms {
+		s.FileID = fileid
+		ix.syms = append(ix.syms, s)
+	}
+}
+
+// A tokenized holds the result of reading and tokenizing a file.
+type tokenized struct {
+	name           string
+	n, size, mtime int64
+	trigrams       []uint32
+	syms           []Symbol
+	lang           string
+	reason         string // why the file was not indexed, if !ok
+	ok             bool
+}
+
+// maxDefaultWorkers caps DefaultWorkers, since each worker costs
+// 64 MB whether or not the machine has the cores to keep it busy.
+const maxDefaultWorkers = 8
+
+// DefaultWorkers returns the number of files AddFiles reads in parallel
+// by default: the number of CPUs, but at most 8.
+func DefaultWorkers() int {
+	n := runtime.NumCPU()
+	if n > maxDefaultWorkers {
+		n = maxDefaultWorkers
+	}
+	return n
+}
+
+// AddFiles adds the named files to the index, with the same result as
+// calling AddFile for each name in turn.  It reads up to ix.Workers
+// files at a time in parallel, but adds them to the index in order.
+// Each worker needs its own trigram set, which, like the one used by
+// Add, takes 64 MB.
+func (ix *IndexWriter) AddFiles(names []string) {
+	workers := ix.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers()
+	}
+	if workers > len(names) {
+		workers = len(names)
+	}
+	if workers <= 1 {
+		for _, name := range names {
+			ix.AddFile(name)
+		}
+		return
+	}
+
+	// The results queue keeps the files in order
+	// and bounds the number of files in flight.
+	type job struct {
+		name string
+		c    chan tokenized
+	}
+	jobs := make(chan job)
+	results := make(chan chan tokenized, 4*workers)
+	go func() {
+		for _, name := range names {
+			c := make(chan tokenized, 1)
+			results <- c
+			jobs <- job{name, c}
+		}
+		close(jobs)
+		close(results)
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			t := sparse.NewSet(1 << 24)
+			inbuf := make([]byte, len(ix.inbuf))
+			for j := range jobs {
+				j.c <- ix.tokenizeFile(j.name, t, inbuf)
+			}
+		}()
+	}
+
+	for c := range results {
+		r := <-c
+		if !r.ok {
+			ix.skip(r.name, r.reason)
+			continue
+		}
+		ix.add(&r)
+	}
+}
+
+// tokenizeFile opens and tokenizes the named file for AddFiles,
+// using t and inbuf as in tokenize.
+func (ix *IndexWriter) tokenizeFile(name string, t *sparse.Set, inbuf []byte) tokenized {
+	f, err := ix.open(name)
+	if err != nil {
+		log.Print(err)
+		return tokenized{}
+	}
+	defer f.Close()
+	r := ix.scan(name, f, t, inbuf)
+	if r.ok {
+		r.size, r.mtime = stat(f)
+		r.trigrams = append([]uint32(nil), t.Dense()...)
+	}
+	return r
 }
 
 // Flush flushes the index entry to the target file.
 func (ix *IndexWriter) Flush() {
 	ix.addName("")
 
-	var off [5]uint32
+	var off [6]int64
+	var sect sectionWriter
 	ix.main.writeString(magic)
 	off[0] = ix.main.offset()
 	for _, p := range ix.paths {
@@ -208,35 +429,103 @@ func (ix *IndexWriter) Flush() {
 	copyFile(ix.main, ix.nameData)
 	off[2] = ix.main.offset()
 	ix.mergePost(ix.main)
+	sect.copy(ix.main, "stat", ix.statData)
+	if ix.hasFilt {
+		var b []byte
+		for _, r := range ix.filters {
+			b = append(append(b, r...), 0)
+		}
+		sect.add(ix.main, "filt", b)
+	}
+	var lims [24]byte
+	binary.BigEndian.PutUint64(lims[0:], uint64(ix.Limits.MaxFileLen))
+	binary.BigEndian.PutUint64(lims[8:], uint64(ix.Limits.MaxLineLen))
+	binary.BigEndian.PutUint64(lims[16:], uint64(ix.Limits.MaxTextTrigrams))
+	sect.add(ix.main, "lims", lims[:])
+	if b := encodeLangs(ix.langs); b != nil {
+		sect.add(ix.main, "lang", b)
+	}
+	if len(ix.syms) > 0 {
+		sect.addSymbols(ix.main, ix.syms)
+	}
 	off[3] = ix.main.offset()
 	copyFile(ix.main, ix.nameIndex)
 	off[4] = ix.main.offset()
 	copyFile(ix.main, ix.postIndex)
-	for _, v := range off {
-		ix.main.writeUint32(v)
-	}
-	ix.main.writeString(trailerMagic)
+	off[5] = ix.main.offset()
+	sect.writeIndex(ix.main)
+	writeTrailer(ix.main, off)
 
 	os.Remove(ix.nameData.name)
 	for _, f := range ix.postFile {
 		os.Remove(f.Name())
 	}
 	os.Remove(ix.nameIndex.name)
+	os.Remove(ix.statData.name)
 	os.Remove(ix.postIndex.name)
 
 	log.Printf("%d data bytes, %d index bytes", ix.totalBytes, ix.main.offset())
 
-	ix.main.flush()
+	ix.main.close()
+}
+
+// writeTrailer writes the index trailer to out, given the offsets
+// of the path list, name list, posting lists, name index, posting
+// list index, and section index.
+func writeTrailer(out *bufWriter, off [6]int64) {
+	for _, v := range off {
+		out.writeUint64(uint64(v))
+	}
+	out.writeUint64(features)
+	out.flush()
+	out.writeUint32(out.sum.Sum32())
+	out.writeString(trailerMagic)
+	out.flush()
 }
 
 func copyFile(dst, src *bufWriter) {
 	dst.flush()
-	_, err := io.Copy(dst.file, src.finish())
+	_, err := io.Copy(io.MultiWriter(dst.file, dst.sum), src.finish())
 	if err != nil {
 		log.Fatalf("copying %s to %s: %v", src.name, dst.name, err)
 	}
 }
 
+// A sectionWriter collects the section index entries
+// for the sections written to an index file.
+type sectionWriter struct {
+	tag  []string
+	off  []int64
+	size []int64
+}
+
+// copy copies src to dst as the section with the given tag.
+func (w *sectionWriter) copy(dst *bufWriter, tag string, src *bufWriter) {
+	off := dst.offset()
+	copyFile(dst, src)
+	w.tag = append(w.tag, tag)
+	w.off = append(w.off, off)
+	w.size = append(w.size, dst.offset()-off)
+}
+
+// add writes data to dst as the section with the given tag.
+func (w *sectionWriter) add(dst *bufWriter, tag string, data []byte) {
+	off := dst.offset()
+	dst.write(data)
+	w.tag = append(w.tag, tag)
+	w.off = append(w.off, off)
+	w.size = append(w.size, int64(len(data)))
+}
+
+// writeIndex writes the section index to dst.
+func (w *sectionWriter) writeIndex(dst *bufWriter) {
+	for i, tag := range w.tag {
+		dst.writeString(tag)
+		dst.writeUint64(uint64(w.off[i]))
+		dst.writeUint64(uint64(w.size[i]))
+	}
+}
+
 // addName adds the file with the given name to the index.
 // It returns the assigned file ID number.
 func (ix *IndexWriter) addName(name string) uint32 {
@@ -244,7 +533,7 @@ func (ix *IndexWriter) addName(name string) uint32 {
 		log.Fatalf("%q: file has NUL byte in name", name)
 	}
 
-	ix.nameIndex.writeUint32(ix.nameData.offset())
+	ix.nameIndex.writeUint64(uint64(ix.nameData.offset()))
 	ix.nameData.writeString(name)
 	ix.nameData.writeByte(0)
 	id := ix.numName
@@ -316,7 +605,7 @@ func (ix *IndexWriter) mergePost(out *bufWriter) {
 		// index entry
 		ix.postIndex.write(ix.buf[:3])
 		ix.postIndex.writeUint32(nfile)
-		ix.postIndex.writeUint32(offset)
+		ix.postIndex.writeUint64(uint64(offset))
 
 		if trigram == 1<<24-1 {
 			break
@@ -454,6 +743,7 @@ type bufWriter struct {
 	file *os.File
 	buf  []byte
 	tmp  [8]byte
+	sum  hash.Hash32 // checksum of the data written to file
 }
 
 // bufCreate creates a new file with the given name and returns a
@@ -476,6 +766,7 @@ func bufCreate(name string) *bufWriter {
 		name: f.Name(),
 		buf:  make([]byte, 0, 256<<10),
 		file: f,
+		sum:  crc32.New(castagnoli),
 	}
 }
 
@@ -487,6 +778,7 @@ func (b *bufWriter) write(x []byte) {
 			if _, err := b.file.Write(x); err != nil {
 				log.Fatalf("writing %s: %v", b.name, err)
 			}
+			b.sum.Write(x)
 			return
 		}
 	}
@@ -508,6 +800,7 @@ func (b *bufWriter) writeString(s string) {
 			if _, err := b.file.WriteString(s); err != nil {
 				log.Fatalf("writing %s: %v", b.name, err)
 			}
+			io.WriteString(b.sum, s)
 			return
 		}
 	}
@@ -515,13 +808,9 @@ func (b *bufWriter) writeString(s string) {
 }
 
 // offset returns the current write offset.
-func (b *bufWriter) offset() uint32 {
+func (b *bufWriter) offset() int64 {
 	off, _ := b.file.Seek(0, 1)
-	off += int64(len(b.buf))
-	if int64(uint32(off)) != off {
-		log.Fatalf("index is larger than 4GB")
-	}
-	return uint32(off)
+	return off + int64(len(b.buf))
 }
 
 func (b *bufWriter) flush() {
@@ -532,9 +821,22 @@ func (b *bufWriter) flush() {
 	if err != nil {
 		log.Fatalf("writing %s: %v", b.name, err)
 	}
+	b.sum.Write(b.buf)
 	b.buf = b.buf[:0]
 }
 
+// close flushes b and closes its file, first syncing it, so that the
+// data is on disk before the file is renamed into place.
+func (b *bufWriter) close() {
+	b.flush()
+	if err := b.file.Sync(); err != nil {
+		log.Fatalf("syncing %s: %v", b.name, err)
+	}
+	if err := b.file.Close(); err != nil {
+		log.Fatalf("closing %s: %v", b.name, err)
+	}
+}
+
 // finish flushes the file to disk and returns an open file ready for reading.
 func (b *bufWriter) finish() *os.File {
 	b.flush()
@@ -557,6 +859,14 @@ func (b *bufWriter) writeUint32(x uint32) {
 	b.buf = append(b.buf, byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
 }
 
+func (b *bufWriter) writeUint64(x uint64) {
+	if cap(b.buf)-len(b.buf) < 8 {
+		b.flush()
+	}
+	b.buf = append(b.buf, byte(x>>56), byte(x>>48), byte(x>>40), byte(x>>32),
+		byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+}
+
 func (b *bufWriter) writeUvarint(x uint32) {
 	if cap(b.buf)-len(b.buf) < 5 {
 		b.flush()
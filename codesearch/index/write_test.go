@@ -6,11 +6,16 @@ package index
 
 import (
 	"bytes"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
+
+	"github.com/mars9/kanabe/codesearch/source"
 )
 
 var trivialFiles = map[string]string{
@@ -23,8 +28,89 @@ var trivialFiles = map[string]string{
 }
 
 var trivialIndex = join(
+	checksum(join(
+		// header
+		"csearch index 3\n",
+
+		// list of paths
+		"\x00",
+
+		// list of names
+		"afile4\x00",
+		"f0\x00",
+		"file1\x00",
+		"file3\x00",
+		"file5\x00",
+		"thefile2\x00",
+		"\x00",
+
+		// list of posting lists
+		"\na\n", fileList(2), // file1
+		"\nab", fileList(3, 5), // file3, thefile2
+		"\nda", fileList(0), // afile4
+		"\nxy", fileList(4), // file5
+		"ab\n", fileList(5), // thefile2
+		"abc", fileList(0, 3), // afile4, file3
+		"bc\n", fileList(0, 3), // afile4, file3
+		"dab", fileList(0), // afile4
+		"xyz", fileList(4), // file5
+		"yzw", fileList(4), // file5
+		"zw\n", fileList(4), // file5
+		"\xff\xff\xff", fileList(),
+
+		// stat section
+		strings.Repeat("\x00", 6*16),
+
+		// lims section
+		u64(1<<30), u64(2000), u64(20000),
+
+		// name index
+		u64(0),
+		u64(6+1),
+		u64(6+1+2+1),
+		u64(6+1+2+1+5+1),
+		u64(6+1+2+1+5+1+5+1),
+		u64(6+1+2+1+5+1+5+1+5+1),
+		u64(6+1+2+1+5+1+5+1+5+1+8+1),
+
+		// posting list index,
+		"\na\n", u32(1), u64(0),
+		"\nab", u32(2), u64(5),
+		"\nda", u32(1), u64(5+6),
+		"\nxy", u32(1), u64(5+6+5),
+		"ab\n", u32(1), u64(5+6+5+5),
+		"abc", u32(2), u64(5+6+5+5+5),
+		"bc\n", u32(2), u64(5+6+5+5+5+6),
+		"dab", u32(1), u64(5+6+5+5+5+6+6),
+		"xyz", u32(1), u64(5+6+5+5+5+6+6+5),
+		"yzw", u32(1), u64(5+6+5+5+5+6+6+5+5),
+		"zw\n", u32(1), u64(5+6+5+5+5+6+6+5+5+5),
+		"\xff\xff\xff", u32(0), u64(5+6+5+5+5+6+6+5+5+5+5),
+
+		// section index
+		"stat", u64(16+1+38+62), u64(6*16),
+		"lims", u64(16+1+38+62+96), u64(24),
+
+		// trailer
+		u64(16),
+		u64(16+1),
+		u64(16+1+38),
+		u64(16+1+38+62+96+24),
+		u64(16+1+38+62+96+24+56),
+		u64(16+1+38+62+96+24+56+180),
+
+		// feature flags
+		u64(0),
+	)),
+
+	"\ncsearch trailr\n",
+)
+
+// trivialIndexV2 is trivialIndex in the version 2 format,
+// which has 32-bit offsets and no checksum.
+var trivialIndexV2 = join(
 	// header
-	"csearch index 1\n",
+	"csearch index 2\n",
 
 	// list of paths
 	"\x00",
@@ -52,6 +138,12 @@ var trivialIndex = join(
 	"zw\n", fileList(4), // file5
 	"\xff\xff\xff", fileList(),
 
+	// stat section
+	strings.Repeat("\x00", 6*16),
+
+	// lims section
+	u64(1<<30), u64(2000), u64(20000),
+
 	// name index
 	u32(0),
 	u32(6+1),
@@ -75,20 +167,48 @@ var trivialIndex = join(
 	"zw\n", u32(1), u32(5+6+5+5+5+6+6+5+5+5),
 	"\xff\xff\xff", u32(0), u32(5+6+5+5+5+6+6+5+5+5+5),
 
+	// section index
+	"stat", u32(16+1+38+62), u32(6*16),
+	"lims", u32(16+1+38+62+96), u32(24),
+
 	// trailer
 	u32(16),
 	u32(16+1),
 	u32(16+1+38),
+	u32(16+1+38+62+96+24),
+	u32(16+1+38+62+96+24+28),
+	u32(16+1+38+62+96+24+28+132),
+
+	"\ncsearch trailr\n",
+)
+
+// trivialIndexV1 is trivialIndex in the version 1 format,
+// which has 32-bit offsets and no sections.
+var trivialIndexV1 = join(
+	"csearch index 1\n",
+	trivialIndexV2[16:16+1+38+62],
+	trivialIndexV2[16+1+38+62+96+24:16+1+38+62+96+24+28+132],
+	u32(16),
+	u32(16+1),
+	u32(16+1+38),
 	u32(16+1+38+62),
 	u32(16+1+38+62+28),
-
 	"\ncsearch trailr\n",
 )
 
+// checksum returns s followed by its CRC-32C checksum.
+func checksum(s string) string {
+	return s + u32(crc32.Checksum([]byte(s), castagnoli))
+}
+
 func join(s ...string) string {
 	return strings.Join(s, "")
 }
 
+func u64(x uint64) string {
+	return u32(uint32(x>>32)) + u32(uint32(x))
+}
+
 func u32(x uint32) string {
 	var buf [4]byte
 	buf[0] = byte(x >> 24)
@@ -163,3 +283,131 @@ func TestTrivialWrite(t *testing.T) {
 func TestTrivialWriteDisk(t *testing.T) {
 	testTrivialWrite(t, true)
 }
+
+func TestAddFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var names []string
+	for name, data := range mergeFiles1 {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0777)
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	names = append(names, filepath.Join(dir, "missing"))
+	sort.Strings(names)
+
+	build := func(out string, workers int) []byte {
+		ix := Create(out)
+		ix.Workers = workers
+		ix.AddFiles(names)
+		ix.Flush()
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	serial := build(filepath.Join(dir, "index1"), 1)
+	parallel := build(filepath.Join(dir, "index4"), 4)
+	if !bytes.Equal(serial, parallel) {
+		t.Errorf("parallel index differs from serial index")
+	}
+	// More workers than files start only one per file.
+	if many := build(filepath.Join(dir, "index64"), 64); !bytes.Equal(serial, many) {
+		t.Errorf("index with 64 workers differs from serial index")
+	}
+	if n := DefaultWorkers(); n < 1 || n > maxDefaultWorkers {
+		t.Errorf("DefaultWorkers() = %d, want 1 to %d", n, maxDefaultWorkers)
+	}
+	if n := Open(filepath.Join(dir, "index4")).NumFiles(); n != len(mergeFiles1) {
+		t.Errorf("NumFiles() = %d, want %d", n, len(mergeFiles1))
+	}
+}
+
+func TestSource(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+
+	var names []string
+	for name := range trivialFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ix := Create(out)
+	ix.Source = source.Map(trivialFiles)
+	ix.AddFiles(names)
+	ix.Flush()
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != trivialIndex {
+		t.Errorf("index from source.Map differs from trivial index")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"binary":  "abc\xffdef",
+		"long":    "0123456\n89abcdef",
+		"longest": "0123456789abc",
+		"many":    "abcdefg\nhijklm",
+		"ok":      "hello world",
+	}
+	var names []string
+	for name, data := range files {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lim := Limits{MaxFileLen: 15, MaxLineLen: 12, MaxTextTrigrams: 10}
+	for _, workers := range []int{1, 4} {
+		out := filepath.Join(dir, "index")
+		ix := Create(out)
+		ix.Limits = lim
+		ix.Workers = workers
+		var skipped []string
+		ix.SkipFunc = func(name, reason string) {
+			skipped = append(skipped, filepath.Base(name)+": "+reason)
+		}
+		ix.AddFiles(names)
+		ix.Flush()
+
+		want := []string{
+			"binary: invalid UTF-8",
+			"long: too long",
+			"longest: very long lines",
+			"many: too many trigrams, probably not text",
+		}
+		if !reflect.DeepEqual(skipped, want) {
+			t.Errorf("workers=%d: skipped %q, want %q", workers, skipped, want)
+		}
+		r := Open(out)
+		if l := r.Limits(); l != lim {
+			t.Errorf("Limits() = %+v, want %+v", l, lim)
+		}
+		if n := r.NumFiles(); n != 1 {
+			t.Errorf("NumFiles() = %d, want 1", n)
+		}
+		r.Close()
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package query implements the query language of csearch, which
+// combines regular expressions with boolean operators and with
+// predicates on file names.
+//
+// A query is a sequence of terms separated by white space.  A term is
+// a regular expression that must match some line of a file, or one of
+//
+//	file:regexp   the file's name must match regexp
+//	case:yes      the regular expressions are case-sensitive
+//	case:no       the regular expressions are case-insensitive
+//	case:auto     each is case-sensitive only if it has an upper-case letter
+//
+// Terms combine with the operators NOT, AND, and OR, in decreasing order
+// of precedence, and with parentheses, each written as a separate word.
+// Adjacent terms without an operator between them must both match.
+// Double quotes group text with white space into a single term, and
+// a quoted word is never an operator.  Thus
+//
+//	foo AND bar NOT baz file:\.go$ case:yes
+//
+// matches the Go files that mention foo and bar but not baz, in that case.
+//
+// The query language is opt-in: Parse reads a query, while ParseRegexp
+// takes its argument as a single regular expression, white space and
+// all, so that a plain regular expression that happens to contain AND or
+// file: means what it always has.
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/mars9/kanabe/codesearch/index"
+	"github.com/mars9/kanabe/codesearch/regexp"
+)
+
+// A Query is a compiled query.
+// Like a Regexp, a Query is not safe for concurrent use.
+type Query struct {
+	expr *node
+	text []string // patterns of the terms whose matches are printed
+}
+
+type op int
+
+const (
+	opText op = iota // a line matches re
+	opFile           // the file name matches re
+	opNot
+	opAnd
+	opOr
+)
+
+// A node is a node in the syntax tree of a query.
+type node struct {
+	op  op
+	re  *regexp.Regexp // for opText and opFile
+	sub []*node        // for opNot, opAnd, and opOr
+}
+
+// A token is a word of a query.
+type token struct {
+	text string // the word, without quotes
+	raw  string // the word as written
+}
+
+// isOp reports whether t is the operator or parenthesis s.
+func (t token) isOp(s string) bool {
+	return t.raw == s
+}
+
+// isPrefixed reports whether t is a term with the given prefix,
+// like file:.
+func (t token) isPrefixed(prefix string) bool {
+	return strings.HasPrefix(t.raw, prefix)
+}
+
+// Parse compiles the query s.  Its regular expressions are
+// case-insensitive if fold is set, unless s has a case: term.
+func Parse(s string, fold bool) (*Query, error) {
+	toks, err := split(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{fold: fold}
+
+	// Case applies to the whole query, wherever it is given.
+	var rest []token
+	for _, t := range toks {
+		if !t.isPrefixed("case:") {
+			rest = append(rest, t)
+			continue
+		}
+		switch v := t.text[len("case:"):]; v {
+		case "yes":
+			p.fold, p.auto = false, false
+		case "no":
+			p.fold, p.auto = true, false
+		case "auto":
+			p.auto = true
+		default:
+			return nil, fmt.Errorf("query: case must be yes, no, or auto, not %q", v)
+		}
+	}
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("query: no terms")
+	}
+	p.toks = rest
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.toks) > 0 {
+		return nil, fmt.Errorf("query: unexpected %s", p.toks[0].raw)
+	}
+	q := &Query{expr: n}
+	q.text = positive(n, false, nil)
+	return q, nil
+}
+
+// ParseRegexp returns the query for the single regular expression
+// expr, spaces, operators, and all.
+func ParseRegexp(expr string, fold bool) (*Query, error) {
+	p := &parser{fold: fold}
+	n, err := p.text(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &Query{expr: n, text: positive(n, false, nil)}, nil
+}
+
+// split splits s into words at white space outside double quotes.
+// Within quotes, \" stands for a quote; other backslashes are kept.
+// If a quote is unterminated, split returns the words so far,
+// the last running to the end of s, and an error.
+func split(s string) (toks []token, err error) {
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return toks, nil
+		}
+		var text []byte
+		quoted := false
+		i := 0
+		for ; i < len(s) && (quoted || !unicode.IsSpace(rune(s[i]))); i++ {
+			switch c := s[i]; {
+			case c == '"':
+				quoted = !quoted
+			case quoted && c == '\\' && i+1 < len(s) && s[i+1] == '"':
+				i++
+				text = append(text, '"')
+			default:
+				text = append(text, c)
+			}
+		}
+		toks = append(toks, token{string(text), s[:i]})
+		if quoted {
+			return toks, fmt.Errorf("query: unterminated quoted string")
+		}
+		s = s[i:]
+	}
+}
+
+// A parser holds the state of parsing a query.
+type parser struct {
+	toks []token
+	fold bool // regexps are case-insensitive
+	auto bool // regexps are case-insensitive if all lower case
+}
+
+func (p *parser) peek(s string) bool {
+	return len(p.toks) > 0 && p.toks[0].isOp(s)
+}
+
+func (p *parser) or() (*node, error) {
+	n, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("OR") {
+		p.toks = p.toks[1:]
+		m, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		n = combine(opOr, n, m)
+	}
+	return n, nil
+}
+
+func (p *parser) and() (*node, error) {
+	n, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for len(p.toks) > 0 && !p.peek("OR") && !p.peek(")") {
+		if p.peek("AND") {
+			p.toks = p.toks[1:]
+		}
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		n = combine(opAnd, n, m)
+	}
+	return n, nil
+}
+
+func (p *parser) unary() (*node, error) {
+	if len(p.toks) == 0 {
+		return nil, fmt.Errorf("query: missing term at end")
+	}
+	t := p.toks[0]
+	p.toks = p.toks[1:]
+	switch {
+	case t.isOp("NOT"):
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &node{op: opNot, sub: []*node{n}}, nil
+	case t.isOp("("):
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, fmt.Errorf("query: missing )")
+		}
+		p.toks = p.toks[1:]
+		return n, nil
+	case t.isOp(")"), t.isOp("AND"), t.isOp("OR"):
+		return nil, fmt.Errorf("query: unexpected %s", t.raw)
+	case t.isPrefixed("file:"):
+		re, err := regexp.Compile(t.text[len("file:"):])
+		if err != nil {
+			return nil, fmt.Errorf("query: %v", err)
+		}
+		return &node{op: opFile, re: re}, nil
+	}
+	return p.text(t.text)
+}
+
+// text returns the node for the regexp term pat.
+func (p *parser) text(pat string) (*node, error) {
+	fold := p.fold
+	if p.auto {
+		fold = !hasUpper(pat)
+	}
+	if fold {
+		pat = "(?i)" + pat
+	}
+	re, err := regexp.Compile("(?m)" + pat)
+	if err != nil {
+		return nil, fmt.Errorf("query: %v", err)
+	}
+	return &node{op: opText, re: re}, nil
+}
+
+func hasUpper(s string) bool {
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// combine returns the node for x op y,
+// flattening chains of the same operator.
+func combine(op op, x, y *node) *node {
+	if x.op == op {
+		x.sub = append(x.sub, y)
+		return x
+	}
+	return &node{op: op, sub: []*node{x, y}}
+}
+
+// positive appends to list the patterns of the text terms in n
+// that are not negated, or, if neg is set, those that are.
+func positive(n *node, neg bool, list []string) []string {
+	switch n.op {
+	case opText:
+		if !neg {
+			// Drop the (?m) that Parse added.
+			list = append(list, n.re.String()[len("(?m)"):])
+		}
+	case opNot:
+		list = positive(n.sub[0], !neg, list)
+	case opAnd, opOr:
+		for _, s := range n.sub {
+			list = positive(s, neg, list)
+		}
+	}
+	return list
+}
+
+// IsRegexp reports whether q is a single regular expression,
+// which Regexp returns.  Such a query needs no Select.
+func (q *Query) IsRegexp() bool {
+	return q.expr.op == opText
+}
+
+// Regexp returns a regular expression matching the lines to print for
+// a file that q selects: those matching any regexp term of q that is
+// not negated.  If there are none, it matches every line.
+func (q *Query) Regexp() *regexp.Regexp {
+	pat := "(?m)^"
+	if len(q.text) == 1 {
+		pat = "(?m)" + q.text[0]
+	} else if len(q.text) > 1 {
+		pat = "(?m)(?:" + strings.Join(q.text, ")|(?:") + ")"
+	}
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		panic("query: cannot combine regexps: " + err.Error())
+	}
+	return re
+}
+
+// Index returns the index query that the files q selects must match.
+func (q *Query) Index() *index.Query {
+	return q.expr.index()
+}
+
+func (n *node) index() *index.Query {
+	switch n.op {
+	case opText:
+		return index.RegexpQuery(n.re.Syntax)
+	case opAnd, opOr:
+		q := n.sub[0].index()
+		for _, s := range n.sub[1:] {
+			if n.op == opAnd {
+				q = q.And(s.index())
+			} else {
+				q = q.Or(s.index())
+			}
+		}
+		return q
+	}
+	// The index cannot tell which files lack some text
+	// and does not search file names.
+	return &index.Query{Op: index.QAll}
+}
+
+// A truth is the value of a query for a file,
+// possibly not yet known.
+type truth int
+
+const (
+	no truth = iota
+	yes
+	maybe
+)
+
+// eval evaluates n for the named file holding data,
+// or, if data is nil, for the name alone.
+func (n *node) eval(name string, data []byte) truth {
+	switch n.op {
+	case opText:
+		if data == nil {
+			return maybe
+		}
+		if n.re.Match(data, true, true) >= 0 {
+			return yes
+		}
+		return no
+	case opFile:
+		if n.re.MatchString(name, true, true) >= 0 {
+			return yes
+		}
+		return no
+	case opNot:
+		switch n.sub[0].eval(name, data) {
+		case yes:
+			return no
+		case no:
+			return yes
+		}
+		return maybe
+	}
+	// An AND is no if any sub is, an OR yes if any sub is.
+	stop, v := no, yes
+	if n.op == opOr {
+		stop, v = yes, no
+	}
+	for _, s := range n.sub {
+		switch s.eval(name, data) {
+		case stop:
+			return stop
+		case maybe:
+			v = maybe
+		}
+	}
+	return v
+}
+
+// Select reports whether q selects the named file holding data.
+func (q *Query) Select(name string, data []byte) bool {
+	if data == nil {
+		data = []byte{}
+	}
+	return q.expr.eval(name, data) == yes
+}
+
+// MaySelect reports whether q can select the named file,
+// judging by its name alone.
+func (q *Query) MaySelect(name string) bool {
+	return q.expr.eval(name, nil) != no
+}
+
+// Copy returns a copy of q that can be used
+// in a different goroutine, as a regexp.Selector.
+func (q *Query) Copy() regexp.Selector {
+	return &Query{expr: q.expr.copy(), text: q.text}
+}
+
+func (n *node) copy() *node {
+	c := &node{op: n.op}
+	if n.re != nil {
+		c.re = n.re.Copy()
+	}
+	for _, s := range n.sub {
+		c.sub = append(c.sub, s.copy())
+	}
+	return c
+}
@@ -0,0 +1,187 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package query
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/mars9/kanabe/codesearch/regexp"
+	"github.com/mars9/kanabe/codesearch/source"
+)
+
+var queryFiles = source.Map{
+	"a.go":      "package a\n\nfunc Foo() { bar() }\n",
+	"b.go":      "package b\n\n// foo calls bar and baz.\nfunc foo() { bar(); baz() }\n",
+	"c.txt":     "foo bar\n",
+	"d.go":      "package d\n\nvar x = \"say hi\"\n",
+	"e_test.go": "package e\n\nfunc TestFoo() { bar() }\n",
+}
+
+var selectTests = []struct {
+	query string
+	fold  bool
+	want  []string
+}{
+	{"foo", false, []string{"b.go", "c.txt"}},
+	{"foo", true, []string{"a.go", "b.go", "c.txt", "e_test.go"}},
+	{"func foo", false, []string{"b.go"}},
+	{"foo AND bar", false, []string{"b.go", "c.txt"}},
+	{"foo bar", false, []string{"b.go", "c.txt"}},
+	{"foo bar file:.", false, []string{"b.go", "c.txt"}},
+	{"foo AND bar NOT baz", true, []string{"a.go", "c.txt", "e_test.go"}},
+	{"foo AND bar NOT baz file:\\.go$", true, []string{"a.go", "e_test.go"}},
+	{"foo AND bar NOT baz file:\\.go$ case:yes", true, nil},
+	{"case:auto Foo", false, []string{"a.go", "e_test.go"}},
+	{"case:auto foo", false, []string{"a.go", "b.go", "c.txt", "e_test.go"}},
+	{"Foo OR hi", false, []string{"a.go", "d.go", "e_test.go"}},
+	{"( Foo OR hi ) NOT file:_test", false, []string{"a.go", "d.go"}},
+	{"NOT foo file:go$", false, []string{"a.go", "d.go", "e_test.go"}},
+	{"\"say hi\" OR baz", false, []string{"b.go", "d.go"}},
+	{"\"AND\" file:.", false, nil},
+}
+
+func TestSelect(t *testing.T) {
+	for _, tt := range selectTests {
+		q, err := Parse(tt.query, tt.fold)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.query, err)
+			continue
+		}
+		var got []string
+		for _, name := range []string{"a.go", "b.go", "c.txt", "d.go", "e_test.go"} {
+			if q.Select(name, []byte(queryFiles[name])) {
+				got = append(got, name)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q, %v) selects %v, want %v", tt.query, tt.fold, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"foo AND",
+		"AND foo",
+		"foo OR OR bar",
+		"( foo",
+		"foo )",
+		"NOT",
+		"case:maybe foo",
+		"case:yes",
+		"foo AND \"bar",
+		"foo AND ba(r",
+		"file:( foo",
+	} {
+		if _, err := Parse(s, false); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", s)
+		}
+	}
+
+}
+
+// Regexps that look like queries are plain regexps to ParseRegexp.
+var regexpFiles = source.Map{
+	"q.sql":  "SELECT a FROM t AND b\nselect x\n",
+	"f.txt":  "see file:12 here\nfile: none\n",
+	"c.txt":  "case: x\ncase:y\n",
+	"p.txt":  "f(a OR b)\nNOT ( x )\n",
+	"no.txt": "nothing to see\n",
+}
+
+func TestParseRegexp(t *testing.T) {
+	for _, tt := range []struct {
+		re   string
+		want string
+	}{
+		{`file:\d+`, "f.txt:1:see file:12 here\n"},
+		{`case: x`, "c.txt:1:case: x\n"},
+		{`SELECT .* AND .*`, "q.sql:1:SELECT a FROM t AND b\n"},
+		{`\(a OR b\)`, "p.txt:1:f(a OR b)\n"},
+		{`NOT \( x \)`, "p.txt:2:NOT ( x )\n"},
+		{`"say`, ""},
+	} {
+		q, err := ParseRegexp(tt.re, false)
+		if err != nil {
+			t.Errorf("ParseRegexp(%q): %v", tt.re, err)
+			continue
+		}
+		if !q.IsRegexp() {
+			t.Errorf("ParseRegexp(%q) is not a plain regexp", tt.re)
+		}
+		var out bytes.Buffer
+		g := regexp.Grep{
+			Regexp: q.Regexp(),
+			Stdout: &out,
+			Stderr: &out,
+			N:      true,
+			Source: regexpFiles,
+		}
+		for _, name := range []string{"c.txt", "f.txt", "no.txt", "p.txt", "q.sql"} {
+			if q.MaySelect(name) {
+				g.File(name)
+			}
+		}
+		if out.String() != tt.want {
+			t.Errorf("ParseRegexp(%q) grep = %q, want %q", tt.re, out.String(), tt.want)
+		}
+	}
+}
+
+func TestIndexQuery(t *testing.T) {
+	for _, tt := range []struct {
+		query, want string
+	}{
+		{"hello", `"ell" "hel" "llo"`},
+		{"hello AND world", `"ell" "hel" "llo" "orl" "rld" "wor"`},
+		{"hello OR world", `("ell" "hel" "llo")|("orl" "rld" "wor")`},
+		{"hello NOT world", `"ell" "hel" "llo"`},
+		{"NOT hello file:x", `+`},
+	} {
+		q, err := Parse(tt.query, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := q.Index().String(); s != tt.want {
+			t.Errorf("Parse(%q).Index() = %s, want %s", tt.query, s, tt.want)
+		}
+	}
+}
+
+func TestMaySelect(t *testing.T) {
+	q, err := Parse("foo NOT file:_test file:\\.go$", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"a.go": true, "a_test.go": false, "c.txt": false} {
+		if got := q.MaySelect(name); got != want {
+			t.Errorf("MaySelect(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestGrep(t *testing.T) {
+	q, err := Parse("foo AND bar NOT baz case:no", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	g := regexp.Grep{
+		Regexp:  q.Regexp(),
+		Select:  q,
+		Stdout:  &out,
+		Stderr:  &out,
+		N:       true,
+		Workers: 4,
+		Source:  queryFiles,
+	}
+	g.Files([]string{"a.go", "b.go", "c.txt", "d.go", "e_test.go"})
+	want := "a.go:3:func Foo() { bar() }\nc.txt:1:foo bar\ne_test.go:3:func TestFoo() { bar() }\n"
+	if out.String() != want {
+		t.Errorf("grep = %q, want %q", out.String(), want)
+	}
+}
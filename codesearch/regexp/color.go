@@ -0,0 +1,233 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+// Color highlighting of Grep output.
+//
+// As in GNU grep, the colors are ANSI SGR sequences that the
+// GREP_COLORS environment variable can override, as in
+//
+//	GREP_COLORS='ms=01;31:fn=35:ln=32:se=36'
+//
+// The capabilities understood are ms (matched text in a selected line),
+// mt (same as ms), sl (selected lines), cx (context lines),
+// fn (file names), ln (line numbers), se (separators) and the boolean
+// ne, which omits the erase-to-end-of-line sequence after each color.
+// Others, such as bn and mc, are accepted but have no effect.
+// The older GREP_COLOR variable, if set, gives the color of matched text.
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A colors holds the SGR sequences used to color output.
+// An empty string means no color.
+type colors struct {
+	match   string // matched text
+	line    string // selected (matching) lines
+	context string // context lines
+	file    string // file names
+	lineno  string // line numbers
+	sep     string // separators
+	noErase bool   // omit \33[K after each sequence
+}
+
+var defaultColors = colors{
+	match:  "01;31",
+	file:   "35",
+	lineno: "32",
+	sep:    "36",
+}
+
+// parseColors returns the default colors, modified
+// by the settings in GREP_COLOR and GREP_COLORS.
+func parseColors(color, colors string) *colors {
+	c := defaultColors
+	if color != "" && validSGR(color) {
+		c.match = color
+	}
+	for _, f := range strings.Split(colors, ":") {
+		key, val := f, ""
+		if i := strings.Index(f, "="); i >= 0 {
+			key, val = f[:i], f[i+1:]
+		}
+		if !validSGR(val) {
+			continue
+		}
+		switch key {
+		case "mt", "ms":
+			c.match = val
+		case "sl":
+			c.line = val
+		case "cx":
+			c.context = val
+		case "fn":
+			c.file = val
+		case "ln":
+			c.lineno = val
+		case "se":
+			c.sep = val
+		case "ne":
+			c.noErase = true
+		}
+	}
+	return &c
+}
+
+// validSGR reports whether s is a plausible list of SGR parameters.
+func validSGR(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if (s[i] < '0' || s[i] > '9') && s[i] != ';' {
+			return false
+		}
+	}
+	return true
+}
+
+// paint appends text to b, colored with the SGR sequence sgr.
+func (c *colors) paint(b []byte, sgr string, text []byte) []byte {
+	if sgr == "" || len(text) == 0 {
+		return append(b, text...)
+	}
+	b = append(b, "\033["...)
+	b = append(b, sgr...)
+	b = append(b, 'm')
+	if !c.noErase {
+		b = append(b, "\033[K"...)
+	}
+	b = append(b, text...)
+	b = append(b, "\033[m"...)
+	if !c.noErase {
+		b = append(b, "\033[K"...)
+	}
+	return b
+}
+
+// A colorFlag is a flag.Value that accepts only
+// the valid settings of the Color flag.
+type colorFlag struct {
+	p *string
+}
+
+func (f colorFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	return *f.p
+}
+
+func (f colorFlag) Set(s string) error {
+	switch s {
+	case "auto", "always", "never":
+		*f.p = s
+		return nil
+	}
+	return fmt.Errorf("invalid color setting %q: want auto, always, or never", s)
+}
+
+// initColor decides whether g colors its output,
+// according to g.Color, the environment, and g.Stdout.
+// Only the first call has any effect.
+func (g *Grep) initColor() {
+	if g.colorInit {
+		return
+	}
+	g.colorInit = true
+	switch {
+	case g.JSON:
+		return
+	case g.Color == "always":
+	case g.Color == "auto":
+		if os.Getenv("TERM") == "dumb" || !isTerminal(g.Stdout) {
+			return
+		}
+	default:
+		return
+	}
+	g.colors = parseColors(os.Getenv("GREP_COLOR"), os.Getenv("GREP_COLORS"))
+}
+
+// isTerminal reports whether w is a terminal.
+// It settles for checking that w is a character device.
+func isTerminal(w interface{}) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// printColorLine is printLine for colored output.
+// In matching lines, it highlights every match.
+func (g *Grep) printColorLine(name string, lineno int, sep byte, line []byte) {
+	c := g.colors
+	s := []byte{sep}
+	var b []byte
+	if !g.H {
+		b = c.paint(b, c.file, []byte(name))
+		b = c.paint(b, c.sep, s)
+	}
+	if g.N {
+		b = c.paint(b, c.lineno, strconv.AppendInt(nil, int64(lineno), 10))
+		b = c.paint(b, c.sep, s)
+	}
+	text := bytes.TrimSuffix(line, nl)
+	if sep == '-' {
+		b = c.paint(b, c.context, text)
+	} else {
+		prev := 0
+		for _, loc := range g.Regexp.FindAllIndex(text, -1) {
+			if loc[0] == loc[1] {
+				continue
+			}
+			b = c.paint(b, c.line, text[prev:loc[0]])
+			b = c.paint(b, c.match, text[loc[0]:loc[1]])
+			prev = loc[1]
+		}
+		b = c.paint(b, c.line, text[prev:])
+	}
+	b = append(b, line[len(text):]...)
+	g.Stdout.Write(b)
+}
+
+// printName prints name on a line by itself, for the L flag.
+func (g *Grep) printName(name string) {
+	if g.colors == nil {
+		fmt.Fprintf(g.Stdout, "%s\n", name)
+		return
+	}
+	g.Stdout.Write(append(g.colors.paint(nil, g.colors.file, []byte(name)), '\n'))
+}
+
+// printCount prints the count of matching lines in name, for the C flag.
+func (g *Grep) printCount(name string, count int) {
+	if g.colors == nil {
+		fmt.Fprintf(g.Stdout, "%s: %d\n", name, count)
+		return
+	}
+	c := g.colors
+	b := c.paint(nil, c.file, []byte(name))
+	b = c.paint(b, c.sep, []byte{':'})
+	g.Stdout.Write(append(b, fmt.Sprintf(" %d\n", count)...))
+}
+
+// printGroupSep prints the separator between groups of context lines,
+// on a line of its own even if the last file did not end in a newline.
+func (g *Grep) printGroupSep() {
+	if g.partial {
+		g.Stdout.Write(nl)
+		g.partial = false
+	}
+	if g.colors == nil {
+		g.Stdout.Write(groupSep)
+		return
+	}
+	g.Stdout.Write(append(g.colors.paint(nil, g.colors.sep, groupSep[:2]), '\n'))
+}
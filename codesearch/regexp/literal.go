@@ -0,0 +1,143 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+// Literal search.
+//
+// Most searches are for an identifier or a handful of them.  A regexp
+// that matches only a small set of fixed strings, possibly ignoring ASCII
+// case and possibly between word boundaries, is matched without the DFA:
+// a single string by bytes.Index, which scans for its first byte with
+// vector instructions, and several strings by an Aho-Corasick automaton,
+// which reads each byte of the text once however many strings there are.
+
+import "bytes"
+
+// maxLitStates is the number of states, of 1 kB each, in the largest
+// Aho-Corasick automaton that newLitMatcher builds.
+const maxLitStates = 4096
+
+// A litMatcher matches a set of strings, as described by index.Literals.
+type litMatcher struct {
+	fold bool
+	word bool
+
+	// For a single string matched exactly.
+	lit []byte
+
+	// For the others, the Aho-Corasick automaton.
+	// State 0 is the start state.
+	next [][256]int32 // next state, per byte of the text
+	out  [][]int      // lengths of the strings ending in each state
+}
+
+// newLitMatcher returns a litMatcher for the given results of index.Literals,
+// or nil if the strings are too many or too long to be worth it.
+func newLitMatcher(lits []string, fold, word bool) *litMatcher {
+	m := &litMatcher{fold: fold, word: word}
+	if len(lits) == 1 && !fold {
+		m.lit = []byte(lits[0])
+		return m
+	}
+
+	// Build the trie.
+	m.next = make([][256]int32, 1)
+	m.out = make([][]int, 1)
+	for _, s := range lits {
+		st := int32(0)
+		for i := 0; i < len(s); i++ {
+			if m.next[st][s[i]] == 0 {
+				if len(m.next) >= maxLitStates {
+					return nil
+				}
+				m.next = append(m.next, [256]int32{})
+				m.out = append(m.out, nil)
+				m.next[st][s[i]] = int32(len(m.next) - 1)
+			}
+			st = m.next[st][s[i]]
+		}
+		m.out[st] = append(m.out[st], len(s))
+	}
+
+	// Turn it into a DFA, breadth first, so that each state's failure
+	// state, the state for its longest proper suffix, is done before it.
+	fail := make([]int32, len(m.next))
+	queue := []int32{0}
+	for len(queue) > 0 {
+		st := queue[0]
+		queue = queue[1:]
+		m.out[st] = append(m.out[st], m.out[fail[st]]...)
+		for c := 0; c < 256; c++ {
+			t := m.next[st][c]
+			if t != 0 {
+				if st != 0 {
+					fail[t] = m.next[fail[st]][c]
+				}
+				queue = append(queue, t)
+			} else if st != 0 {
+				m.next[st][c] = m.next[fail[st]][c]
+			}
+		}
+	}
+	return m
+}
+
+// match is like matcher.match: it returns the offset of the newline
+// ending the first line of b with a match, or len(b) if that line has
+// no newline, or -1 if there is no match.  The text before b and after
+// it, for word boundaries, is taken to be the end of a line.
+func (m *litMatcher) match(b []byte) int {
+	end := m.find(b)
+	if end < 0 {
+		return -1
+	}
+	if i := bytes.IndexByte(b[end:], '\n'); i >= 0 {
+		return end + i
+	}
+	return len(b)
+}
+
+// find returns the offset of the end of the first match in b, or -1.
+func (m *litMatcher) find(b []byte) int {
+	if m.lit != nil {
+		for off := 0; ; {
+			i := bytes.Index(b[off:], m.lit)
+			if i < 0 {
+				return -1
+			}
+			start, end := off+i, off+i+len(m.lit)
+			if !m.word || m.atBoundaries(b, start, end) {
+				return end
+			}
+			off = start + 1
+		}
+	}
+	st := int32(0)
+	for i, c := range b {
+		if m.fold && 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		st = m.next[st][c]
+		for _, n := range m.out[st] {
+			if !m.word || m.atBoundaries(b, i+1-n, i+1) {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// atBoundaries reports whether b[start:end] begins
+// and ends at word boundaries.
+func (m *litMatcher) atBoundaries(b []byte, start, end int) bool {
+	before, after := false, false
+	if start > 0 {
+		before = isWordByte(int(b[start-1]))
+	}
+	if end < len(b) {
+		after = isWordByte(int(b[end]))
+	}
+	return before != isWordByte(int(b[start])) && after != isWordByte(int(b[end-1]))
+}
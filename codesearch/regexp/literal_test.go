@@ -0,0 +1,119 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mars9/kanabe/codesearch/index"
+)
+
+var litMatchText = []string{
+	"",
+	"hello, world\n",
+	"say hello\nto the world\n",
+	"othello\nhelloworld\nhello_\n-hello-\n",
+	"HeLLo there\nfoo.bar(x)\nfoobar\n",
+	"a.foo\nfoo.\n.foo.\nxfoo\n",
+	"abcabcabd\nabd\n",
+	"shers\nhis hers she\n",
+	"no newline at the end: hello",
+}
+
+var litMatchRegexps = []string{
+	`hello`,
+	`(?i)hello`,
+	`\bhello\b`,
+	`(?i)\bHELLO\b`,
+	`\bfoo\.\b`,
+	`\b\.foo\b`,
+	`foo\.bar\(`,
+	`abd|abcabd|bca`,
+	`he|she|his|hers`,
+	`\b(?:he|she|his|hers)\b`,
+	`(?i)world|there`,
+	`\bworld|there\b`,
+}
+
+// TestLitMatch checks that the literal matcher
+// agrees with the DFA on every suffix of the texts.
+func TestLitMatch(t *testing.T) {
+	for _, expr := range litMatchRegexps {
+		re, err := Compile("(?m)" + expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, ok := index.Literals(re.Syntax); ok && re.lit == nil {
+			t.Errorf("Compile(%#q) has no literal matcher", expr)
+		}
+		for _, text := range litMatchText {
+			b := []byte(text)
+			for i := 0; i <= len(b); i++ {
+				want := re.m.match(b[i:], true, true)
+				got := re.Match(b[i:], true, true)
+				if got != want {
+					t.Errorf("%#q.Match(%q) = %d, want %d", expr, b[i:], got, want)
+				}
+				got = re.MatchString(text[i:], true, true)
+				if got != want {
+					t.Errorf("%#q.MatchString(%q) = %d, want %d", expr, text[i:], got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestLitMatcherLimit(t *testing.T) {
+	var lits []string
+	for i := 0; i < 1000; i++ {
+		lits = append(lits, string(rune('a'+i%26))+string(rune('a'+i/26))+"xxxxxxxx")
+	}
+	if m := newLitMatcher(lits, false, false); m != nil {
+		t.Errorf("newLitMatcher built %d states, more than %d", len(m.next), maxLitStates)
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	f, err := ioutil.TempFile("", "patterns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("a.b\n\nc|d\r\n")
+	f.Close()
+
+	for _, tt := range []struct {
+		p    Patterns
+		args []string
+		expr string
+		rest []string
+	}{
+		{Patterns{}, []string{"a.b", "x"}, `a.b`, []string{"x"}},
+		{Patterns{F: true}, []string{"a.b"}, `a\.b`, []string{}},
+		{Patterns{W: true}, []string{"a|b"}, `\b(?:a|b)\b`, []string{}},
+		{Patterns{E: []string{"a.b", "c"}}, []string{"x"}, `(?:a.b)|(?:c)`, []string{"x"}},
+		{Patterns{F: true, W: true, E: []string{"a.b", "c"}}, nil, `\b(?:(?:a\.b)|(?:c))\b`, nil},
+		{Patterns{F: true, E: []string{"e"}, File: f.Name()}, nil, `(?:e)|(?:a\.b)|(?:c\|d)`, nil},
+	} {
+		expr, rest, err := tt.p.Expr(tt.args)
+		if err != nil {
+			t.Errorf("%+v.Expr(%q): %v", tt.p, tt.args, err)
+			continue
+		}
+		if expr != tt.expr || !reflect.DeepEqual(rest, tt.rest) {
+			t.Errorf("%+v.Expr(%q) = %#q, %q, want %#q, %q", tt.p, tt.args, expr, rest, tt.expr, tt.rest)
+		}
+	}
+
+	if _, _, err := (&Patterns{}).Expr(nil); err == nil {
+		t.Errorf("Expr(nil) succeeded, want error")
+	}
+	if _, _, err := (&Patterns{File: f.Name() + ".missing"}).Expr(nil); err == nil {
+		t.Errorf("Expr with missing file succeeded, want error")
+	}
+}
@@ -7,13 +7,17 @@ package regexp
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"os"
+	"io/ioutil"
 	"regexp/syntax"
+	"runtime"
 	"sort"
+	"strconv"
 
+	"github.com/mars9/kanabe/codesearch/source"
 	"github.com/mars9/kanabe/codesearch/sparse"
 )
 
@@ -354,14 +358,61 @@ type Grep struct {
 	Stdout io.Writer // output target
 	Stderr io.Writer // error target
 
+	// Source is where File reads files;
+	// nil means source.Local, the local file system.
+	Source source.Source
+
 	L bool // L flag - print file names only
 	C bool // C flag - print count of matches
 	N bool // N flag - print line numbers
 	H bool // H flag - do not print file names
 
+	A int // A flag - print lines of context after each match
+	B int // B flag - print lines of context before each match
+
+	JSON  bool   // JSON flag - print results as JSON objects
+	Color string // color flag - "always", "never", or "auto" for when Stdout is a terminal
+
+	Workers    int // number of files Files searches in parallel
+	Candidates int // number of files the index proposed, for the JSON summary
+
+	// Rank, if positive, makes Files print the output for the Rank
+	// most relevant matching files first, best first, and then the
+	// output for the others in the usual order.
+	Rank int
+
+	// Lines, if not nil, restricts the matches in each file to
+	// the lines listed for its name, counting from 1, so that
+	// a caller that knows where to look can still print the
+	// results like any other search.
+	Lines map[string][]int
+
+	// Select, if not nil, decides which files to search, given their
+	// whole contents.  Files gives each worker its own copy.
+	Select Selector
+
 	Match bool
 
-	buf []byte
+	buf     []byte
+	grouped bool       // a group of context lines has been printed
+	partial bool       // the last line printed had no newline
+	nfile   int        // number of files searched
+	nmatch  int        // number of matching lines
+	score   *fileScore // where Reader records the file's score, or nil
+
+	colors    *colors // colors for output, or nil
+	colorInit bool    // colors has been set up
+}
+
+// A Selector decides whether Grep searches a file.
+type Selector interface {
+	// Select reports whether to search the named file,
+	// which holds data.
+	Select(name string, data []byte) bool
+
+	// Copy returns a copy of the Selector
+	// that can be used in a different goroutine.
+	Copy() Selector
 }
 
 func (g *Grep) AddFlags() {
@@ -369,18 +420,232 @@ func (g *Grep) AddFlags() {
 	flag.BoolVar(&g.C, "c", false, "print match counts only")
 	flag.BoolVar(&g.N, "n", false, "show line numbers")
 	flag.BoolVar(&g.H, "h", false, "omit file names")
+	flag.IntVar(&g.A, "A", 0, "print `n` lines of context after each match")
+	flag.IntVar(&g.B, "B", 0, "print `n` lines of context before each match")
+	flag.Var(contextFlag{&g.A, &g.B}, "C", "print `n` lines of context around each match")
+	flag.BoolVar(&g.JSON, "json", false, "print results as JSON objects")
+	g.Color = "auto"
+	flag.Var(colorFlag{&g.Color}, "color", "highlight matches: `when` is auto, always, or never")
+	flag.IntVar(&g.Workers, "p", runtime.NumCPU(), "number of files to search in parallel")
+	flag.IntVar(&g.Rank, "rank", 0, "print the `n` most relevant matching files first")
 }
 
 func (g *Grep) File(name string) {
-	f, err := os.Open(name)
+	src := g.Source
+	if src == nil {
+		src = source.Local
+	}
+	f, err := src.Open(name)
 	if err != nil {
 		fmt.Fprintf(g.Stderr, "%s\n", err)
 		return
 	}
 	defer f.Close()
+	if g.Select != nil {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			fmt.Fprintf(g.Stderr, "%s: %v\n", name, err)
+			return
+		}
+		if !g.Select.Select(name, data) {
+			g.nfile++
+			return
+		}
+		g.Reader(bytes.NewReader(data), name)
+		return
+	}
 	g.Reader(f, name)
 }
 
+// A contextFlag is a flag.Value that sets both the A and B flags.
+type contextFlag struct {
+	a, b *int
+}
+
+func (f contextFlag) String() string {
+	if f.a == nil {
+		return "0"
+	}
+	return strconv.Itoa(*f.a)
+}
+
+func (f contextFlag) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid context length %q", s)
+	}
+	*f.a, *f.b = n, n
+	return nil
+}
+
+// context reports whether g prints context lines.
+func (g *Grep) context() bool {
+	return (g.A > 0 || g.B > 0) && !g.L && !g.C && !g.JSON
+}
+
+// JSON output consists of one object per line.  The type field says
+// which kind of object it is: "match" for a matching line, "file" for
+// a matching file with -l, "count" for a file's match count with -c,
+// and "summary" for the statistics that Done prints at the end.
+
+type jsonMatch struct {
+	Type  string `json:"type"`
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+	Start int    `json:"start"` // byte offset of the match within Text
+	End   int    `json:"end"`
+	Text  string `json:"text"`
+}
+
+type jsonFile struct {
+	Type  string `json:"type"`
+	File  string `json:"file"`
+	Count int    `json:"count,omitempty"`
+}
+
+type jsonSummary struct {
+	Type       string `json:"type"`
+	Files      int    `json:"files"`                // number of files searched
+	Candidates int    `json:"candidates,omitempty"` // number of files the index proposed
+	Matches    int    `json:"matches"`              // number of matching lines
+}
+
+func (g *Grep) printJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		bug()
+	}
+	g.Stdout.Write(append(b, '\n'))
+}
+
+// Done finishes the output.  In JSON mode, it prints a summary of the
+// files searched and matches found; otherwise it does nothing.
+func (g *Grep) Done() {
+	if !g.JSON {
+		return
+	}
+	g.printJSON(&jsonSummary{
+		Type:       "summary",
+		Files:      g.nfile,
+		Candidates: g.Candidates,
+		Matches:    g.nmatch,
+	})
+}
+
+// A grepResult is the output of searching a single file in Files.
+type grepResult struct {
+	stdout, stderr bytes.Buffer
+	match          bool
+	nfile, nmatch  int
+	score          fileScore
+}
+
+// Files searches the named files, with the same result as calling
+// g.File for each name in turn.  It searches up to g.Workers files
+// at a time in parallel, each worker using its own copy of g.Regexp,
+// and buffers the output of each file until the output of the
+// files before it has been written.  If g.Rank is set, Files instead
+// searches all the files before writing any output, and then writes
+// it in order of relevance, as described for Rank.
+func (g *Grep) Files(names []string) {
+	if g.Workers <= 1 && g.Rank <= 0 {
+		for _, name := range names {
+			g.File(name)
+		}
+		return
+	}
+	workers := g.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Decide about colors before the workers replace Stdout.
+	g.initColor()
+
+	// The results queue keeps the output in order
+	// and bounds the number of files in flight.
+	type job struct {
+		name string
+		c    chan *grepResult
+	}
+	jobs := make(chan job)
+	results := make(chan chan *grepResult, 4*workers)
+	go func() {
+		for _, name := range names {
+			c := make(chan *grepResult, 1)
+			results <- c
+			jobs <- job{name, c}
+		}
+		close(jobs)
+		close(results)
+	}()
+	for i := 0; i < workers; i++ {
+		w := *g
+		w.Regexp = g.Regexp.Copy()
+		if g.Select != nil {
+			w.Select = g.Select.Copy()
+		}
+		w.buf = nil
+		go func() {
+			for j := range jobs {
+				r := new(grepResult)
+				w.Stdout = &r.stdout
+				w.Stderr = &r.stderr
+				w.Match = false
+				w.grouped = false
+				w.partial = false
+				w.nfile, w.nmatch = 0, 0
+				if g.Rank > 0 {
+					w.score = &r.score
+				}
+				w.File(j.name)
+				r.match = w.Match
+				r.nfile, r.nmatch = w.nfile, w.nmatch
+				j.c <- r
+			}
+		}()
+	}
+
+	if g.Rank > 0 {
+		var all []*grepResult
+		var scores []*fileScore
+		for c := range results {
+			r := <-c
+			all = append(all, r)
+			scores = append(scores, &r.score)
+		}
+		for _, i := range rankOrder(names, scores, g.Rank) {
+			g.writeResult(all[i])
+		}
+		return
+	}
+	for c := range results {
+		g.writeResult(<-c)
+	}
+}
+
+// writeResult writes the output of searching a file in Files
+// and adds its counts to g's.
+func (g *Grep) writeResult(r *grepResult) {
+	if g.context() && r.stdout.Len() > 0 {
+		// Separate the context groups of different files.
+		if g.grouped {
+			g.printGroupSep()
+		}
+		g.grouped = true
+	}
+	if b := r.stdout.Bytes(); len(b) > 0 {
+		g.Stdout.Write(b)
+		g.partial = b[len(b)-1] != '\n'
+	}
+	g.Stderr.Write(r.stderr.Bytes())
+	if r.match {
+		g.Match = true
+	}
+	g.nfile += r.nfile
+	g.nmatch += r.nmatch
+}
+
 var nl = []byte{'\n'}
 
 func countNL(b []byte) int {
@@ -402,19 +667,30 @@ func (g *Grep) Reader(r io.Reader, name string) {
 	}
 	var (
 		buf        = g.buf[:0]
-		needLineno = g.N
+		ctx        = g.context()
+		needLineno = g.N || ctx || g.JSON || g.Lines != nil
 		lineno     = 1
 		count      = 0
-		prefix     = ""
 		beginText  = true
 		endText    = false
+		cs         = contextState{sep: g.grouped}
+		listed     = false // with -l, the name has been printed
+		want       map[int]bool
 	)
-	if !g.H {
-		prefix = name + ":"
+	if g.Lines != nil {
+		want = make(map[int]bool)
+		for _, n := range g.Lines[name] {
+			want[n] = true
+		}
 	}
+	g.initColor()
+	g.nfile++
 	for {
 		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
 		buf = buf[:len(buf)+n]
+		if g.score != nil {
+			g.score.size += int64(n)
+		}
 		end := len(buf)
 		if err == nil {
 			end = bytes.LastIndex(buf, nl) + 1
@@ -428,16 +704,52 @@ func (g *Grep) Reader(r io.Reader, name string) {
 			if m1 < chunkStart {
 				break
 			}
-			g.Match = true
-			if g.L {
-				fmt.Fprintf(g.Stdout, "%s\n", name)
-				return
-			}
 			lineStart := bytes.LastIndex(buf[chunkStart:m1], nl) + 1 + chunkStart
 			lineEnd := m1 + 1
 			if lineEnd > end {
 				lineEnd = end
 			}
+			if want != nil && !want[lineno+countNL(buf[chunkStart:lineStart])] {
+				// Not one of the lines: treat it like any other.
+				if ctx {
+					g.skipLines(&cs, name, buf[chunkStart:lineEnd], lineno)
+				}
+				lineno += countNL(buf[chunkStart:lineEnd])
+				chunkStart = lineEnd
+				continue
+			}
+			if g.score != nil {
+				g.score.add(buf[lineStart:lineEnd])
+			}
+			if listed {
+				// Only counting matches for the score.
+				if want != nil {
+					lineno += countNL(buf[chunkStart:lineEnd])
+				}
+				chunkStart = lineEnd
+				continue
+			}
+			g.Match = true
+			g.nmatch++
+			if g.L {
+				if g.JSON {
+					g.printJSON(&jsonFile{Type: "file", File: name})
+				} else {
+					g.printName(name)
+				}
+				if g.score == nil {
+					return
+				}
+				listed = true
+				if want != nil {
+					lineno += countNL(buf[chunkStart:lineEnd])
+				}
+				chunkStart = lineEnd
+				continue
+			}
+			if ctx {
+				g.skipLines(&cs, name, buf[chunkStart:lineStart], lineno)
+			}
 			if needLineno {
 				lineno += countNL(buf[chunkStart:lineStart])
 			}
@@ -445,16 +757,35 @@ func (g *Grep) Reader(r io.Reader, name string) {
 			switch {
 			case g.C:
 				count++
-			case g.N:
-				fmt.Fprintf(g.Stdout, "%s%d:%s", prefix, lineno, line)
+			case g.JSON:
+				text := bytes.TrimSuffix(line, nl)
+				start, end := 0, len(text)
+				if loc := g.Regexp.FindIndex(text); loc != nil {
+					start, end = loc[0], loc[1]
+				}
+				g.printJSON(&jsonMatch{
+					Type:  "match",
+					File:  name,
+					Line:  lineno,
+					Start: start,
+					End:   end,
+					Text:  string(text),
+				})
+			case ctx:
+				g.printGroup(&cs, name, line, lineno)
 			default:
-				fmt.Fprintf(g.Stdout, "%s%s", prefix, line)
+				g.printLine(name, lineno, ':', line)
 			}
 			if needLineno {
 				lineno++
 			}
 			chunkStart = lineEnd
 		}
+		if ctx {
+			// The rest of the chunk has no matches, but its lines
+			// may be context for the matches before and after it.
+			g.skipLines(&cs, name, buf[chunkStart:end], lineno)
+		}
 		if needLineno && err == nil {
 			lineno += countNL(buf[chunkStart:end])
 		}
@@ -468,6 +799,108 @@ func (g *Grep) Reader(r io.Reader, name string) {
 		}
 	}
 	if g.C && count > 0 {
-		fmt.Fprintf(g.Stdout, "%s: %d\n", name, count)
+		if g.JSON {
+			g.printJSON(&jsonFile{Type: "count", File: name, Count: count})
+		} else {
+			g.printCount(name, count)
+		}
+	}
+	if cs.last > 0 {
+		g.grouped = true
+	}
+}
+
+var groupSep = []byte("--\n")
+
+// A contextState records the context lines of a file
+// that may still need to be printed.
+type contextState struct {
+	before [][]byte // unprinted lines just before the current line
+	after  int      // number of lines still to print after the last match
+	last   int      // number of the last line printed, or 0
+	sep    bool     // output of an earlier file needs separating
+}
+
+// skipLines handles the non-matching lines in text, the first of which
+// has number lineno.  It prints the ones that follow the last match
+// closely enough to be its context, and it saves copies of the last
+// ones in cs.before, because the text will be overwritten before the
+// next match is found.
+func (g *Grep) skipLines(cs *contextState, name string, text []byte, lineno int) {
+	for cs.after > 0 && len(text) > 0 {
+		i := bytes.IndexByte(text, '\n') + 1
+		if i == 0 {
+			i = len(text)
+		}
+		g.printLine(name, lineno, '-', text[:i])
+		cs.last = lineno
+		cs.after--
+		text = text[i:]
+		lineno++
+	}
+	if g.B == 0 || len(text) == 0 {
+		return
+	}
+
+	// Find the start of the last g.B lines of text.
+	i := len(text) - 1 // ignore the final newline
+	for n := 0; n < g.B; n++ {
+		i = bytes.LastIndex(text[:i], nl)
+		if i < 0 {
+			break
+		}
+	}
+	if i >= 0 {
+		cs.before = cs.before[:0]
+	}
+	for text = text[i+1:]; len(text) > 0; {
+		j := bytes.IndexByte(text, '\n') + 1
+		if j == 0 {
+			j = len(text)
+		}
+		if len(cs.before) == g.B {
+			copy(cs.before, cs.before[1:])
+			cs.before = cs.before[:g.B-1]
+		}
+		cs.before = append(cs.before, append([]byte(nil), text[:j]...))
+		text = text[j:]
+	}
+}
+
+// printGroup prints the matching line with number lineno,
+// preceded by the saved context lines and, if the lines do not
+// continue the previous group, a separator.
+func (g *Grep) printGroup(cs *contextState, name string, line []byte, lineno int) {
+	first := lineno - len(cs.before)
+	if cs.last > 0 && first > cs.last+1 || cs.last == 0 && cs.sep {
+		g.printGroupSep()
+	}
+	for i, b := range cs.before {
+		g.printLine(name, first+i, '-', b)
+	}
+	cs.before = cs.before[:0]
+	g.printLine(name, lineno, ':', line)
+	cs.last = lineno
+	cs.after = g.A
+}
+
+// printLine prints a line of output, using sep to separate
+// the file name and line number from the text:
+// ':' for matching lines and '-' for context lines.
+func (g *Grep) printLine(name string, lineno int, sep byte, line []byte) {
+	g.partial = !bytes.HasSuffix(line, nl)
+	if g.colors != nil {
+		g.printColorLine(name, lineno, sep, line)
+		return
+	}
+	switch {
+	case g.H && g.N:
+		fmt.Fprintf(g.Stdout, "%d%c%s", lineno, sep, line)
+	case g.H:
+		g.Stdout.Write(line)
+	case g.N:
+		fmt.Fprintf(g.Stdout, "%s%c%d%c%s", name, sep, lineno, sep, line)
+	default:
+		fmt.Fprintf(g.Stdout, "%s%c%s", name, sep, line)
 	}
 }
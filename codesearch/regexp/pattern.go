@@ -0,0 +1,100 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	stdregexp "regexp"
+	"strings"
+)
+
+// Patterns holds the flags that say what to search for,
+// in place of a single regular expression argument.
+type Patterns struct {
+	F    bool     // F flag - patterns are fixed strings
+	W    bool     // W flag - patterns match whole words only
+	E    []string // E flag - patterns, one per flag
+	File string   // patterns flag - file listing patterns, one per line
+}
+
+// AddFlags defines the -F, -w, -e, and -patterns flags.
+// Since csearch uses -f for file names, the flag that grep
+// calls -f is -patterns in both cgrep and csearch.
+func (p *Patterns) AddFlags() {
+	flag.BoolVar(&p.F, "F", false, "patterns are fixed strings, not regexps")
+	flag.BoolVar(&p.W, "w", false, "match whole words only")
+	flag.Var((*patternList)(&p.E), "e", "search for `pattern`; repeat to search for several")
+	flag.StringVar(&p.File, "patterns", "", "search for the patterns listed in `file`, one per line")
+}
+
+// Used reports whether any of the flags was given.
+func (p *Patterns) Used() bool {
+	return p.F || p.W || p.Listed()
+}
+
+// Listed reports whether the patterns come from -e or -patterns
+// rather than from the first argument.
+func (p *Patterns) Listed() bool {
+	return len(p.E) > 0 || p.File != ""
+}
+
+// Expr returns the regular expression matching any of the patterns,
+// without flags, and the arguments that remain.  The patterns are
+// those given by -e and listed in the -patterns file, in that order,
+// or else args[0].  Blank lines in the file are ignored.
+func (p *Patterns) Expr(args []string) (expr string, rest []string, err error) {
+	pats := append([]string(nil), p.E...)
+	if p.File != "" {
+		data, err := ioutil.ReadFile(p.File)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSuffix(line, "\r")
+			if line != "" {
+				pats = append(pats, line)
+			}
+		}
+		if len(pats) == 0 {
+			return "", nil, fmt.Errorf("%s: no patterns", p.File)
+		}
+	}
+	if len(pats) == 0 {
+		if len(args) == 0 {
+			return "", nil, fmt.Errorf("no pattern")
+		}
+		pats, args = args[:1], args[1:]
+	}
+	var list []string
+	for _, pat := range pats {
+		if p.F {
+			pat = stdregexp.QuoteMeta(pat)
+		}
+		list = append(list, pat)
+	}
+	expr = list[0]
+	if len(list) > 1 {
+		expr = "(?:" + strings.Join(list, ")|(?:") + ")"
+	}
+	if p.W {
+		expr = `\b(?:` + expr + `)\b`
+	}
+	return expr, args, nil
+}
+
+// A patternList is a flag.Value that collects
+// the patterns given in repeated flags.
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *patternList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
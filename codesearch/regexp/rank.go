@@ -0,0 +1,128 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+// Ranking.
+//
+// With Grep.Rank set, Files scores each matching file by how likely it
+// is to be the one the user is looking for and prints the best first.
+// A file scores for the number of its matching lines, with diminishing
+// returns; for the density of the matches; and above all for matching
+// lines that look like definitions.  It loses for each directory level
+// in its name, and heavily for lying in a tree of copied or generated
+// code, like vendor or testdata.
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Score weights.
+const (
+	defScore     = 4    // for having a matching definition
+	maxDensity   = 4    // cap on the score for matches per KB
+	depthPenalty = 0.25 // per directory level
+	treePenalty  = 8    // per vendored or test data directory
+)
+
+// penalized lists the directories whose trees hold
+// code that is seldom the code being searched for.
+var penalized = []string{"vendor", "testdata", "third_party", "node_modules"}
+
+// defPrefixes are the keywords that begin definitions
+// in common languages.
+var defPrefixes = []string{
+	"func ", "type ", "def ", "class ", "struct ", "interface ",
+	"enum ", "const ", "var ", "let ", "fn ", "pub fn ", "function ",
+	"#define ", "module ", "trait ", "impl ",
+}
+
+// A fileScore collects what Reader learns about a file for ranking.
+type fileScore struct {
+	matches int   // matching lines
+	defs    int   // matching lines that look like definitions
+	size    int64 // bytes read
+}
+
+// add records the matching line.
+func (s *fileScore) add(line []byte) {
+	s.matches++
+	if isDef(line) {
+		s.defs++
+	}
+}
+
+// isDef reports whether line looks like a definition.
+func isDef(line []byte) bool {
+	line = bytes.TrimLeft(line, " \t")
+	for _, p := range defPrefixes {
+		if bytes.HasPrefix(line, []byte(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// value returns the score of the file with the given name.
+func (s *fileScore) value(name string) float64 {
+	if s.matches == 0 {
+		return math.Inf(-1)
+	}
+	v := math.Log2(1 + float64(s.matches))
+	kb := float64(s.size) / 1024
+	if kb < 1 {
+		kb = 1
+	}
+	v += math.Min(float64(s.matches)/kb, maxDensity)
+	if s.defs > 0 {
+		v += defScore
+	}
+	elems := strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' })
+	if len(elems) > 1 {
+		v -= depthPenalty * float64(len(elems)-1)
+		for _, e := range elems[:len(elems)-1] {
+			for _, p := range penalized {
+				if e == p {
+					v -= treePenalty
+				}
+			}
+		}
+	}
+	return v
+}
+
+// rankOrder returns the order in which to print the results of the
+// named files, given their scores: first the indexes of the best n
+// matching files, best first, then the others in their original order.
+func rankOrder(names []string, scores []*fileScore, n int) []int {
+	type ranked struct {
+		i int
+		v float64
+	}
+	var best []ranked
+	for i, s := range scores {
+		if s.matches > 0 {
+			best = append(best, ranked{i, s.value(names[i])})
+		}
+	}
+	sort.SliceStable(best, func(i, j int) bool { return best[i].v > best[j].v })
+	if len(best) > n {
+		best = best[:n]
+	}
+	order := make([]int, 0, len(names))
+	first := make(map[int]bool)
+	for _, r := range best {
+		order = append(order, r.i)
+		first[r.i] = true
+	}
+	for i := range names {
+		if !first[i] {
+			order = append(order, i)
+		}
+	}
+	return order
+}
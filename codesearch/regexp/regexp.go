@@ -6,7 +6,12 @@
 // use in grep-like programs.
 package regexp
 
-import "regexp/syntax"
+import (
+	stdregexp "regexp"
+	"regexp/syntax"
+
+	"github.com/mars9/kanabe/codesearch/index"
+)
 
 func bug() {
 	panic("codesearch/regexp: internal error")
@@ -18,6 +23,8 @@ type Regexp struct {
 	Syntax *syntax.Regexp
 	expr   string // original expression
 	m      matcher
+	lit    *litMatcher       // for regexps that match only fixed strings, or nil
+	stdre  *stdregexp.Regexp // for the Find methods; compiled on first use
 }
 
 // String returns the source text used to compile the regular expression.
@@ -47,13 +54,86 @@ func Compile(expr string) (*Regexp, error) {
 	if err := r.m.init(prog); err != nil {
 		return nil, err
 	}
+	if lits, fold, word, ok := index.Literals(re); ok {
+		r.lit = newLitMatcher(lits, fold, word)
+	}
 	return r, nil
 }
 
+// Copy returns a new Regexp object copied from re, with its own
+// matching state, so that the copy can be used in a different goroutine.
+func (re *Regexp) Copy() *Regexp {
+	r, err := Compile(re.expr)
+	if err != nil {
+		bug()
+	}
+	return r
+}
+
 func (r *Regexp) Match(b []byte, beginText, endText bool) (end int) {
+	if r.lit != nil {
+		return r.lit.match(b)
+	}
 	return r.m.match(b, beginText, endText)
 }
 
 func (r *Regexp) MatchString(s string, beginText, endText bool) (end int) {
+	if r.lit != nil {
+		return r.lit.match([]byte(s))
+	}
 	return r.m.matchString(s, beginText, endText)
 }
+
+// Match and MatchString only locate the lines that contain a match:
+// the DFA they run does not track where a match begins.  The Find
+// methods below report the exact location of matches, and of the
+// parenthesized subexpressions within them, inside a single line,
+// such as one that Match found.  They run the standard library's
+// regexp package on the line, so they cost more than Match and should
+// be applied only to matching lines.  The line should not include
+// its trailing newline.  Since the Find methods see only the line,
+// \A and \z match at its beginning and end, like ^ and $.
+// Return values are as in the standard library's regexp package.
+
+func (re *Regexp) std() *stdregexp.Regexp {
+	if re.stdre == nil {
+		re.stdre = stdregexp.MustCompile(re.expr)
+	}
+	return re.stdre
+}
+
+// FindIndex returns a two-element slice giving the byte offsets of
+// the leftmost match of re in line, or nil if there is no match.
+func (re *Regexp) FindIndex(line []byte) []int {
+	return re.std().FindIndex(line)
+}
+
+// FindAllIndex returns the locations of successive non-overlapping
+// matches of re in line, at most n of them if n >= 0.
+func (re *Regexp) FindAllIndex(line []byte, n int) [][]int {
+	return re.std().FindAllIndex(line, n)
+}
+
+// FindSubmatchIndex returns the location of the leftmost match of re
+// in line and of its subexpressions, as pairs of byte offsets.
+// A subexpression that did not take part in the match has offsets -1.
+func (re *Regexp) FindSubmatchIndex(line []byte) []int {
+	return re.std().FindSubmatchIndex(line)
+}
+
+// FindAllSubmatchIndex is like FindAllIndex but also reports the
+// locations of the subexpressions, as in FindSubmatchIndex.
+func (re *Regexp) FindAllSubmatchIndex(line []byte, n int) [][]int {
+	return re.std().FindAllSubmatchIndex(line, n)
+}
+
+// NumSubexp returns the number of parenthesized subexpressions in re.
+func (re *Regexp) NumSubexp() int {
+	return re.std().NumSubexp()
+}
+
+// SubexpNames returns the names of the parenthesized subexpressions
+// in re, indexed as in FindSubmatchIndex.
+func (re *Regexp) SubexpNames() []string {
+	return re.std().SubexpNames()
+}
@@ -6,9 +6,16 @@ package regexp
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
+
+	"github.com/mars9/kanabe/codesearch/source"
 )
 
 var nstateTests = []struct {
@@ -188,6 +195,42 @@ func grep(re *Regexp, b []byte) []int {
 	return m
 }
 
+var findTests = []struct {
+	re   string
+	line string
+	m    []int
+	sub  []int
+	all  [][]int
+}{
+	{`b+`, "abbcb", []int{1, 3}, []int{1, 3}, [][]int{{1, 3}, {4, 5}}},
+	{`(a)(x)?b`, "cab", []int{1, 3}, []int{1, 3, 1, 2, -1, -1}, [][]int{{1, 3}}},
+	{`^x`, "ax", nil, nil, nil},
+	{`\bfoo$`, "a foo", []int{2, 5}, []int{2, 5}, [][]int{{2, 5}}},
+}
+
+func TestFind(t *testing.T) {
+	for _, tt := range findTests {
+		re, err := Compile("(?m)" + tt.re)
+		if err != nil {
+			t.Errorf("Compile(%#q): %v", tt.re, err)
+			continue
+		}
+		line := []byte(tt.line)
+		if m := re.FindIndex(line); !reflect.DeepEqual(m, tt.m) {
+			t.Errorf("%#q.FindIndex(%q) = %v, want %v", tt.re, tt.line, m, tt.m)
+		}
+		if m := re.FindSubmatchIndex(line); !reflect.DeepEqual(m, tt.sub) {
+			t.Errorf("%#q.FindSubmatchIndex(%q) = %v, want %v", tt.re, tt.line, m, tt.sub)
+		}
+		if m := re.FindAllIndex(line, -1); !reflect.DeepEqual(m, tt.all) {
+			t.Errorf("%#q.FindAllIndex(%q) = %v, want %v", tt.re, tt.line, m, tt.all)
+		}
+		if n := re.NumSubexp(); tt.sub != nil && n != len(tt.sub)/2-1 {
+			t.Errorf("%#q.NumSubexp() = %d, want %d", tt.re, n, len(tt.sub)/2-1)
+		}
+	}
+}
+
 var grepTests = []struct {
 	re  string
 	s   string
@@ -197,6 +240,22 @@ var grepTests = []struct {
 }{
 	{re: `a+`, s: "abc\ndef\nghalloo\n", out: "input:abc\ninput:ghalloo\n"},
 	{re: `x.*y`, s: "xay\nxa\ny\n", out: "input:xay\n"},
+
+	// context
+	{re: `c`, s: "a\nb\nc\nd\ne\n", g: Grep{A: 1}, out: "input:c\ninput-d\n"},
+	{re: `c`, s: "a\nb\nc\nd\ne\n", g: Grep{B: 1, N: true}, out: "input-2-b\ninput:3:c\n"},
+	{re: `c`, s: "a\nb\nc\nd\ne", g: Grep{A: 5, B: 5, H: true}, out: "a\nb\nc\nd\ne"},
+	{re: `[ae]`, s: "a\nb\nc\nd\ne\n", g: Grep{A: 1, H: true, N: true}, out: "1:a\n2-b\n--\n5:e\n"},
+	{re: `[ad]`, s: "a\nb\nc\nd\ne\n", g: Grep{A: 1, B: 1}, out: "input:a\ninput-b\ninput-c\ninput:d\ninput-e\n"},
+	{re: `[ab]`, s: "a\nb\nc\n", g: Grep{A: 1, B: 1, C: true}, out: "input: 2\n"},
+
+	// json
+	{re: `l+o`, s: "x\nhello world\n", g: Grep{JSON: true, A: 1},
+		out: `{"type":"match","file":"input","line":2,"start":2,"end":5,"text":"hello world"}` + "\n"},
+	{re: `^a`, s: "abc", g: Grep{JSON: true},
+		out: `{"type":"match","file":"input","line":1,"start":0,"end":1,"text":"abc"}` + "\n"},
+	{re: `a`, s: "a\na\n", g: Grep{JSON: true, C: true}, out: `{"type":"count","file":"input","count":2}` + "\n"},
+	{re: `a`, s: "a\na\n", g: Grep{JSON: true, L: true}, out: `{"type":"file","file":"input"}` + "\n"},
 }
 
 func TestGrep(t *testing.T) {
@@ -217,3 +276,297 @@ func TestGrep(t *testing.T) {
 		}
 	}
 }
+
+func TestGrepColor(t *testing.T) {
+	defer os.Setenv("GREP_COLORS", os.Getenv("GREP_COLORS"))
+	defer os.Setenv("GREP_COLOR", os.Getenv("GREP_COLOR"))
+	os.Setenv("GREP_COLOR", "")
+
+	re, err := Compile(`(?m)o+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		env string
+		g   Grep
+		out string
+	}{
+		{"", Grep{Color: "always", N: true},
+			"\033[35m\033[Kinput\033[m\033[K\033[36m\033[K:\033[m\033[K\033[32m\033[K2\033[m\033[K\033[36m\033[K:\033[m\033[K" +
+				"f\033[01;31m\033[Koo\033[m\033[K b\033[01;31m\033[Ko\033[m\033[K\n"},
+		{"ms=4:fn=:se=:ne", Grep{Color: "always", A: 1}, "input:f\033[4moo\033[m b\033[4mo\033[m\ninput-x\n"},
+		{"", Grep{Color: "auto"}, "input:foo bo\n"},
+		{"", Grep{Color: "always", JSON: true}, `{"type":"match","file":"input","line":2,"start":1,"end":3,"text":"foo bo"}` + "\n"},
+	}
+	for i, tt := range tests {
+		os.Setenv("GREP_COLORS", tt.env)
+		var out bytes.Buffer
+		g := tt.g
+		g.Regexp = re
+		g.Stdout = &out
+		g.Reader(strings.NewReader("a\nfoo bo\nx\n"), "input")
+		if out.String() != tt.out {
+			t.Errorf("#%d: grep = %q, want %q", i, out.String(), tt.out)
+		}
+	}
+}
+
+func TestGrepFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grep-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var names []string
+	for i := 0; i < 50; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("file%02d", i))
+		data := fmt.Sprintf("line one\nline %d two\nline three\n", i)
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	names = append(names, filepath.Join(dir, "missing"))
+
+	re, err := Compile(`(?m)[13] two`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grep := func(workers int) (string, string, bool) {
+		var out, errb bytes.Buffer
+		g := Grep{Regexp: re, Stdout: &out, Stderr: &errb, N: true, Workers: workers}
+		g.Files(names)
+		return out.String(), errb.String(), g.Match
+	}
+	out1, err1, match1 := grep(1)
+	out4, err4, match4 := grep(4)
+	if out1 != out4 || err1 != err4 || match1 != match4 {
+		t.Errorf("parallel grep = %q, %q, %v, want %q, %q, %v", out4, err4, match4, out1, err1, match1)
+	}
+	if n := strings.Count(out1, "\n"); n != 10 || !match1 || err1 == "" {
+		t.Errorf("grep found %d lines, match=%v, stderr=%q; want 10 lines, match, error", n, match1, err1)
+	}
+
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: ioutil.Discard, JSON: true, Candidates: 51, Workers: 4}
+	g.Files(names)
+	g.Done()
+	lines := strings.SplitAfter(out.String(), "\n")
+	summary := `{"type":"summary","files":50,"candidates":51,"matches":10}` + "\n"
+	if len(lines) != 12 || lines[10] != summary {
+		t.Errorf("json grep = %q, want 10 matches and %q", out.String(), summary)
+	}
+}
+
+func TestGrepContextNoNewline(t *testing.T) {
+	re, err := Compile(`(?m)x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := source.Map{
+		"nonl.txt": "x\ny",
+		"f19.txt":  "x\nz\n",
+		"last.txt": "a\nx",
+	}
+	want := "nonl.txt:x\nnonl.txt-y\n--\nf19.txt:x\nf19.txt-z\n--\nlast.txt-a\nlast.txt:x"
+	for _, workers := range []int{1, 4} {
+		var out bytes.Buffer
+		g := Grep{Regexp: re, Stdout: &out, Stderr: &out, A: 1, B: 1, Workers: workers, Source: files}
+		g.Files([]string{"nonl.txt", "f19.txt", "last.txt"})
+		if out.String() != want {
+			t.Errorf("grep -A 1 -B 1 with %d workers = %q, want %q", workers, out.String(), want)
+		}
+	}
+}
+
+func TestGrepSource(t *testing.T) {
+	re, err := Compile(`(?m)two`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out, errb bytes.Buffer
+	g := Grep{
+		Regexp: re,
+		Stdout: &out,
+		Stderr: &errb,
+		N:      true,
+		Source: source.Map{"/m/a": "one\ntwo\n", "/m/b": "three\n"},
+	}
+	g.Files([]string{"/m/a", "/m/b", "/m/c"})
+	if want := "/m/a:2:two\n"; out.String() != want {
+		t.Errorf("grep = %q, want %q", out.String(), want)
+	}
+	if !strings.Contains(errb.String(), "/m/c") {
+		t.Errorf("grep stderr = %q, want error for /m/c", errb.String())
+	}
+}
+
+var rankFiles = source.Map{
+	"a/use.go":               "x := parse(s)\n",
+	"a/deep/er/calls.go":     "parse(a)\nparse(b)\nparse(c)\n",
+	"b/parse.go":             "// parse parses s.\nfunc parse(s string) {\n}\n",
+	"vendor/c/parse.go":      "func parse(s string) {\n}\n",
+	"testdata/parse.go":      "func parse() {}\n",
+	"nomatch.go":             "nothing here\n",
+	"a/deep/er/still/use.go": "y := parse(t)\n",
+}
+
+func TestRank(t *testing.T) {
+	re, err := Compile(`(?m)parse\(`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range rankFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, workers := range []int{1, 4} {
+		for _, l := range []bool{false, true} {
+			var out bytes.Buffer
+			g := Grep{
+				Regexp:  re,
+				Stdout:  &out,
+				Stderr:  &out,
+				L:       l,
+				Rank:    3,
+				Workers: workers,
+				Source:  rankFiles,
+			}
+			g.Files(names)
+			var got []string
+			for _, line := range strings.SplitAfter(out.String(), "\n") {
+				if i := strings.Index(line, ":"); i >= 0 {
+					line = line[:i]
+				}
+				line = strings.TrimSuffix(line, "\n")
+				if line != "" && (len(got) == 0 || got[len(got)-1] != line) {
+					got = append(got, line)
+				}
+			}
+			// The definition comes first, then the most matches;
+			// the other files follow in name order, vendored ones too.
+			want := []string{
+				"b/parse.go",
+				"a/deep/er/calls.go",
+				"a/use.go",
+				"a/deep/er/still/use.go",
+				"testdata/parse.go",
+				"vendor/c/parse.go",
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("workers=%d l=%v: ranked files:\n%s\nwant:\n%s", workers, l, strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	re, err := Compile(`(?m)\bx\b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := source.Map{
+		"a": "x\ny\nx = 1\nz\nx\n",
+		"b": "x\n",
+		"c": "var x\n",
+	}
+	for _, tt := range []struct {
+		workers int
+		l, c    bool
+		a       int
+		want    string
+	}{
+		{1, false, false, 0, "a:3:x = 1\na:5:x\nc:1:var x\n"},
+		{4, false, false, 0, "a:3:x = 1\na:5:x\nc:1:var x\n"},
+		{1, false, false, 1, "a-2-y\na:3:x = 1\na-4-z\na:5:x\n--\nc:1:var x\n"},
+		{1, true, false, 0, "a\nc\n"},
+		{1, false, true, 0, "a: 2\nc: 1\n"},
+	} {
+		var out bytes.Buffer
+		g := Grep{
+			Regexp:  re,
+			Stdout:  &out,
+			Stderr:  &out,
+			N:       true,
+			L:       tt.l,
+			C:       tt.c,
+			A:       tt.a,
+			B:       tt.a,
+			Workers: tt.workers,
+			Source:  files,
+			Lines:   map[string][]int{"a": {3, 5}, "c": {1}},
+		}
+		g.Files([]string{"a", "b", "c"})
+		if out.String() != tt.want {
+			t.Errorf("workers=%d l=%v c=%v A=%d: grep = %q, want %q", tt.workers, tt.l, tt.c, tt.a, out.String(), tt.want)
+		}
+	}
+}
+
+// refGrep is a simple line-at-a-time implementation of
+// grep -n with context, for testing Grep.Reader.
+func refGrep(re *Regexp, text string, after, before int) string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	var out bytes.Buffer
+	last := -1
+	for i, line := range lines {
+		if re.MatchString(line, true, true) < 0 {
+			continue
+		}
+		first := i - before
+		if first <= last {
+			first = last + 1
+		}
+		if first < 0 {
+			first = 0
+		}
+		if last >= 0 && first > last+1 {
+			out.WriteString("--\n")
+		}
+		for j := first; j < i; j++ {
+			fmt.Fprintf(&out, "%d-%s", j+1, lines[j])
+		}
+		fmt.Fprintf(&out, "%d:%s", i+1, line)
+		last = i
+		for j := i + 1; j <= i+after && j < len(lines); j++ {
+			if re.MatchString(lines[j], true, true) >= 0 {
+				break
+			}
+			fmt.Fprintf(&out, "%d-%s", j+1, lines[j])
+			last = j
+		}
+	}
+	return out.String()
+}
+
+func TestGrepContextRefill(t *testing.T) {
+	// Several megabytes of text, so that matches and their
+	// context straddle the boundaries of Reader's 1 MB buffer.
+	var text bytes.Buffer
+	for i := 0; text.Len() < 3<<20; i++ {
+		if i%997 == 0 || i%1009 == 0 || i%1013 == 3 {
+			fmt.Fprintf(&text, "match %d\n", i)
+		} else {
+			fmt.Fprintf(&text, "line %d %s\n", i, strings.Repeat("x", i%150))
+		}
+	}
+	text.WriteString("match without newline")
+
+	re, err := Compile(`(?m)match`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ a, b int }{{0, 3}, {3, 0}, {2, 5}, {20, 20}} {
+		var out bytes.Buffer
+		g := Grep{Regexp: re, Stdout: &out, Stderr: &out, H: true, N: true, A: c.a, B: c.b}
+		g.Reader(bytes.NewReader(text.Bytes()), "input")
+		if want := refGrep(re, text.String(), c.a, c.b); out.String() != want {
+			t.Errorf("-A %d -B %d: output differs from reference (%d bytes, want %d)", c.a, c.b, out.Len(), len(want))
+		}
+	}
+}
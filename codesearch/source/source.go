@@ -0,0 +1,191 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package source defines where code search finds the files
+// it indexes and searches.
+package source
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Source is a tree of named files, such as the local file system.
+type Source interface {
+	// List calls fn for root and for each file and directory in the
+	// tree rooted at root, as filepath.Walk does, including honoring
+	// filepath.SkipDir.
+	List(root string, fn filepath.WalkFunc) error
+
+	// Open opens the named file for reading.  If the returned
+	// reader has a Stat method, as *os.File does, the index records
+	// the size and modification time it reports.
+	Open(name string) (io.ReadCloser, error)
+
+	// Stat returns information about the named file.
+	Stat(name string) (os.FileInfo, error)
+}
+
+// Local is the local file system.
+var Local Source = local{}
+
+type local struct{}
+
+func (local) List(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
+
+func (local) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (local) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Stack returns a Source combining srcs.  Each method uses the first
+// source that has the named file: the first for which Stat, or Open,
+// does not fail with an error satisfying os.IsNotExist.
+func Stack(srcs ...Source) Source {
+	return stack(srcs)
+}
+
+type stack []Source
+
+func (s stack) List(root string, fn filepath.WalkFunc) error {
+	for _, src := range s[:len(s)-1] {
+		if _, err := src.Stat(root); !os.IsNotExist(err) {
+			return src.List(root, fn)
+		}
+	}
+	return s[len(s)-1].List(root, fn)
+}
+
+func (s stack) Open(name string) (io.ReadCloser, error) {
+	for _, src := range s[:len(s)-1] {
+		if f, err := src.Open(name); !os.IsNotExist(err) {
+			return f, err
+		}
+	}
+	return s[len(s)-1].Open(name)
+}
+
+func (s stack) Stat(name string) (os.FileInfo, error) {
+	for _, src := range s[:len(s)-1] {
+		if fi, err := src.Stat(name); !os.IsNotExist(err) {
+			return fi, err
+		}
+	}
+	return s[len(s)-1].Stat(name)
+}
+
+// A Map is an in-memory Source, mapping slash-separated
+// file names to their contents.  Its files have no
+// modification times; its directories are implied
+// by the names of the files.
+type Map map[string]string
+
+func (m Map) List(root string, fn filepath.WalkFunc) error {
+	fi, err := m.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	if !fi.IsDir() {
+		return fn(root, fi, nil)
+	}
+	var names []string
+	for name := range m {
+		if within(name, root) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// Report each directory before the files in it.
+	seen := map[string]bool{root: true}
+	var skip []string
+	if err := fn(root, fi, nil); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+Names:
+	for _, name := range names {
+		for _, dir := range skip {
+			if within(name, dir) {
+				continue Names
+			}
+		}
+		for i := len(root) + 1; i < len(name); i++ {
+			dir := name[:i]
+			if name[i] != '/' || seen[dir] {
+				continue
+			}
+			seen[dir] = true
+			if err := fn(dir, mapInfo{path.Base(dir), 0, true}, nil); err != nil {
+				if err == filepath.SkipDir {
+					skip = append(skip, dir)
+					continue Names
+				}
+				return err
+			}
+		}
+		if err := fn(name, mapInfo{path.Base(name), int64(len(m[name])), false}, nil); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m Map) Open(name string) (io.ReadCloser, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(strings.NewReader(data)), nil
+}
+
+func (m Map) Stat(name string) (os.FileInfo, error) {
+	if data, ok := m[name]; ok {
+		return mapInfo{path.Base(name), int64(len(data)), false}, nil
+	}
+	for n := range m {
+		if within(n, name) {
+			return mapInfo{path.Base(name), 0, true}, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// within reports whether name is in the directory tree dir.
+func within(name, dir string) bool {
+	return strings.HasPrefix(name, dir) && (strings.HasSuffix(dir, "/") || len(name) > len(dir) && name[len(dir)] == '/')
+}
+
+// A mapInfo is the os.FileInfo for a file or directory in a Map.
+type mapInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (fi mapInfo) Name() string       { return fi.name }
+func (fi mapInfo) Size() int64        { return fi.size }
+func (fi mapInfo) ModTime() time.Time { return time.Time{} }
+func (fi mapInfo) IsDir() bool        { return fi.isDir }
+func (fi mapInfo) Sys() interface{}   { return nil }
+
+func (fi mapInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
@@ -0,0 +1,104 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var tree = Map{
+	"/a/x.go":     "package x\n",
+	"/a/b/y.go":   "package y\n",
+	"/a/b/c/z.go": "package z\n",
+	"/a/d/w.go":   "package w\n",
+	"/ab/v.go":    "package v\n",
+}
+
+func list(t *testing.T, src Source, root string, skip string) []string {
+	var names []string
+	err := src.List(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			names = append(names, "error "+path)
+			return nil
+		}
+		if fi.IsDir() {
+			names = append(names, path+"/")
+		} else {
+			names = append(names, path)
+		}
+		if path == skip {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("List(%s): %v", root, err)
+	}
+	return names
+}
+
+func TestMap(t *testing.T) {
+	got := list(t, tree, "/a", "/a/b/c")
+	want := []string{"/a/", "/a/b/", "/a/b/c/", "/a/b/y.go", "/a/d/", "/a/d/w.go", "/a/x.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List(/a) = %v, want %v", got, want)
+	}
+	got = list(t, tree, "/a/x.go", "")
+	if want := []string{"/a/x.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List(/a/x.go) = %v, want %v", got, want)
+	}
+	got = list(t, tree, "/c", "")
+	if want := []string{"error /c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List(/c) = %v, want %v", got, want)
+	}
+
+	if fi, err := tree.Stat("/a/b"); err != nil || !fi.IsDir() || fi.Name() != "b" {
+		t.Errorf("Stat(/a/b) = %v, %v", fi, err)
+	}
+	if fi, err := tree.Stat("/a/x.go"); err != nil || fi.IsDir() || fi.Size() != 10 {
+		t.Errorf("Stat(/a/x.go) = %v, %v", fi, err)
+	}
+	if _, err := tree.Stat("/a/b/y"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/a/b/y): %v, want not exist", err)
+	}
+	f, err := tree.Open("/ab/v.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(f); string(data) != "package v\n" {
+		t.Errorf("Open(/ab/v.go) read %q", data)
+	}
+	if _, err := tree.Open("/a/b"); !os.IsNotExist(err) {
+		t.Errorf("Open(/a/b): %v, want not exist", err)
+	}
+}
+
+func TestStack(t *testing.T) {
+	src := Stack(Map{"/a/x.go": "first\n"}, tree)
+	f, err := src.Open("/a/x.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(f); string(data) != "first\n" {
+		t.Errorf("Open(/a/x.go) read %q, want first source's file", data)
+	}
+	if _, err := src.Open("/ab/v.go"); err != nil {
+		t.Errorf("Open(/ab/v.go): %v", err)
+	}
+	if _, err := src.Stat("/a/b/c"); err != nil {
+		t.Errorf("Stat(/a/b/c): %v", err)
+	}
+	if _, err := src.Open("/nope"); !os.IsNotExist(err) {
+		t.Errorf("Open(/nope): %v, want not exist", err)
+	}
+	got := list(t, src, "/ab", "")
+	if want := []string{"/ab/", "/ab/v.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List(/ab) = %v, want %v", got, want)
+	}
+}